@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	accessTokenParam     = "kai_token"
+	accessTokenCookie    = "kai_token"
+	accessTokenCookieTTL = 7 * 24 * time.Hour
+)
+
+// accessTokenGate only lets requests through that carry the token in the
+// kai_token query parameter or hold the cookie set after a successful visit.
+// The parameter and cookie are removed before the request reaches next.
+func accessTokenGate(token string, next http.Handler) http.Handler {
+	cookieValue := accessCookieValue(token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rawQuery, value, found := cutQueryParam(r.URL.RawQuery, accessTokenParam); found {
+			if !constantTimeEqual(value, token) {
+				denyAccess(w)
+				return
+			}
+			r.URL.RawQuery = rawQuery
+
+			http.SetCookie(w, &http.Cookie{
+				Name:     accessTokenCookie,
+				Value:    cookieValue,
+				Path:     "/",
+				MaxAge:   int(accessTokenCookieTTL.Seconds()),
+				HttpOnly: true,
+				Secure:   r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https"),
+				SameSite: http.SameSiteLaxMode,
+			})
+			// Browsers are sent back to the clean URL. Webhooks and API
+			// clients keep the token in their configured URL, so their
+			// requests are forwarded as they are.
+			if (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+				return
+			}
+			stripAccessCookie(r)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(accessTokenCookie)
+		if err != nil || !constantTimeEqual(cookie.Value, cookieValue) {
+			denyAccess(w)
+			return
+		}
+		stripAccessCookie(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accessCookieValue derives the cookie from the token so the token itself is
+// never stored in the browser.
+func accessCookieValue(token string) string {
+	sum := sha256.Sum256([]byte("kai-access:" + token))
+	return hex.EncodeToString(sum[:])
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// cutQueryParam removes every name=value pair from a raw query and returns
+// the first value. The other pairs keep their order and escaping, so URL
+// signatures computed by webhook senders stay valid.
+func cutQueryParam(rawQuery, name string) (rest, value string, found bool) {
+	if rawQuery == "" {
+		return rawQuery, "", false
+	}
+	parts := strings.Split(rawQuery, "&")
+	kept := parts[:0]
+	for _, part := range parts {
+		key, val, _ := strings.Cut(part, "=")
+		if key, err := url.QueryUnescape(key); err != nil || key != name {
+			kept = append(kept, part)
+			continue
+		}
+		if !found {
+			value, _ = url.QueryUnescape(val)
+			found = true
+		}
+	}
+	return strings.Join(kept, "&"), value, found
+}
+
+// stripAccessCookie hides kai's cookie from the local service. Only the
+// kai_token pair is removed from the Cookie headers; the app's cookies are
+// passed on byte for byte, even those Go's cookie parser would reject.
+func stripAccessCookie(r *http.Request) {
+	headers := r.Header.Values("Cookie")
+	if len(headers) == 0 {
+		return
+	}
+	r.Header.Del("Cookie")
+	for _, header := range headers {
+		pairs := strings.Split(header, ";")
+		kept := pairs[:0]
+		for _, pair := range pairs {
+			name, _, _ := strings.Cut(pair, "=")
+			if strings.TrimSpace(name) != accessTokenCookie {
+				kept = append(kept, pair)
+			}
+		}
+		if rest := strings.TrimLeft(strings.Join(kept, ";"), " "); rest != "" {
+			r.Header.Add("Cookie", rest)
+		}
+	}
+}
+
+func denyAccess(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, "kai: this tunnel requires an access token; open the link you were given (it contains ?kai_token=...)", http.StatusUnauthorized)
+}
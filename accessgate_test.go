@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessTokenGate(t *testing.T) {
+	var seen *http.Request
+	gate := accessTokenGate("s3cr3t", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		seen = nil
+		rec := httptest.NewRecorder()
+		gate.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve(httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusUnauthorized || seen != nil {
+		t.Fatalf("expected 401 without a token, got %d", rec.Code)
+	}
+	if rec := serve(httptest.NewRequest(http.MethodGet, "/?kai_token=wrong", nil)); rec.Code != http.StatusUnauthorized || seen != nil {
+		t.Fatalf("expected 401 for a wrong token, got %d", rec.Code)
+	}
+
+	browser := httptest.NewRequest(http.MethodGet, "/dashboard?tab=1&kai_token=s3cr3t", nil)
+	browser.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rec := serve(browser)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/dashboard?tab=1" || seen != nil {
+		t.Fatalf("expected redirect to the clean URL, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != accessTokenCookie || cookies[0].Value == "s3cr3t" || !cookies[0].HttpOnly {
+		t.Fatalf("unexpected cookie: %+v", cookies)
+	}
+
+	withCookie := httptest.NewRequest(http.MethodGet, "/dashboard", nil)
+	withCookie.AddCookie(cookies[0])
+	withCookie.AddCookie(&http.Cookie{Name: "session", Value: "app"})
+	if rec := serve(withCookie); rec.Code != http.StatusNoContent || seen == nil {
+		t.Fatalf("expected the cookie to grant access, got %d", rec.Code)
+	}
+	if got := seen.Header.Get("Cookie"); got != "session=app" {
+		t.Fatalf("kai cookie should be hidden from the local service, got %q", got)
+	}
+
+	webhook := httptest.NewRequest(http.MethodPost, "/hooks?kai_token=s3cr3t", strings.NewReader("{}"))
+	if rec := serve(webhook); rec.Code != http.StatusNoContent || seen == nil {
+		t.Fatalf("expected webhook to pass through, got %d", rec.Code)
+	}
+	if seen.URL.RawQuery != "" {
+		t.Fatalf("token should be stripped from the query, got %q", seen.URL.RawQuery)
+	}
+}
+
+func TestAccessTokenGateLeavesAppDataUnchanged(t *testing.T) {
+	var seen *http.Request
+	gate := accessTokenGate("s3cr3t", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/hooks?z=2&kai_token=s3cr3t&a=%7e1&b=x+y", strings.NewReader("{}"))
+	req.Header.Set("Cookie", `theme="dark\mode"; kai_token=`+accessCookieValue("s3cr3t")+`; name=Zoë`)
+	gate.ServeHTTP(httptest.NewRecorder(), req)
+	if seen == nil {
+		t.Fatalf("expected the request to pass the gate")
+	}
+	if seen.URL.RawQuery != "z=2&a=%7e1&b=x+y" {
+		t.Fatalf("query should only lose the token, got %q", seen.URL.RawQuery)
+	}
+	if got := seen.Header.Values("Cookie"); len(got) != 1 || got[0] != `theme="dark\mode"; name=Zoë` {
+		t.Fatalf("cookies should only lose kai's, got %q", got)
+	}
+}
+
+func TestApplyHTTPAuthFlags(t *testing.T) {
+	proxies := []ProxyConfig{
+		{Type: "http", Subdomain: "web"},
+		{Type: "tcp", RemotePort: 22022},
+		{Type: "https", Subdomain: "secure", LocalTLS: true},
+	}
+	if err := applyHTTPAuthFlags(proxies, "admin:hunter2", "tok"); err != nil {
+		t.Fatalf("apply auth flags: %v", err)
+	}
+	if proxies[0].HTTPUser != "admin" || proxies[0].HTTPPassword != "hunter2" || proxies[0].AccessToken != "tok" {
+		t.Fatalf("http proxy not protected: %+v", proxies[0])
+	}
+	if proxies[1].HTTPUser != "" || proxies[1].AccessToken != "" {
+		t.Fatalf("tcp proxy should be untouched: %+v", proxies[1])
+	}
+	if proxies[2].HTTPUser != "" || proxies[2].AccessToken != "tok" {
+		t.Fatalf("https proxy with --local-tls should only get the access token: %+v", proxies[2])
+	}
+
+	if err := applyHTTPAuthFlags([]ProxyConfig{{Type: "tcp"}}, "", "tok"); err == nil {
+		t.Fatalf("expected error without an http tunnel")
+	}
+	for _, raw := range []string{"admin", ":pass", "admin:"} {
+		if _, _, err := parseBasicAuth(raw); err == nil {
+			t.Fatalf("expected error for --basic-auth %q", raw)
+		}
+	}
+	if user, password, err := parseBasicAuth(`admin:pa"ss\wo:rd`); err != nil || user != "admin" || password != `pa"ss\wo:rd` {
+		t.Fatalf("unexpected --basic-auth result: %q %q %v", user, password, err)
+	}
+}
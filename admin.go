@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// frpcAdmin talks to the admin API (webServer) of an frpc process kai started.
+// The API listens on loopback with random credentials so other local users
+// cannot reload or rewrite the tunnel config.
+type frpcAdmin struct {
+	Port     int
+	User     string
+	Password string
+}
+
+// frpcProxyStatus is one entry of frpc's GET /api/status response, which
+// groups proxies by type.
+type frpcProxyStatus struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Status     string `json:"status"`
+	Err        string `json:"err"`
+	LocalAddr  string `json:"local_addr"`
+	Plugin     string `json:"plugin"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+// newFrpcAdmin reserves a loopback port and credentials for frpc's admin API.
+func newFrpcAdmin() (*frpcAdmin, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("error: reserve admin port: %w", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("error: generate admin password: %w", err)
+	}
+	return &frpcAdmin{Port: port, User: "kai", Password: hex.EncodeToString(secret)}, nil
+}
+
+func (a *frpcAdmin) status(ctx context.Context) (map[string][]frpcProxyStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/api/status", a.Port), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(a.User, a.Password)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin API returned %s", resp.Status)
+	}
+
+	var out map[string][]frpcProxyStatus
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode admin status: %w", err)
+	}
+	return out, nil
+}
+
+// waitRemotePort polls the admin API until frpc reports the port frps
+// assigned to the named proxy.
+func (a *frpcAdmin) waitRemotePort(ctx context.Context, name string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var lastErr error
+	for {
+		statuses, err := a.status(ctx)
+		if err == nil {
+			lastErr = fmt.Errorf("proxy %q not reported by frpc", name)
+			for _, group := range statuses {
+				for _, status := range group {
+					if status.Name != name {
+						continue
+					}
+					if port, ok := remoteAddrPort(status.RemoteAddr); ok {
+						return port, nil
+					}
+					lastErr = fmt.Errorf("proxy %q has no remote address yet", name)
+				}
+			}
+		} else {
+			lastErr = err
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, lastErr
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// remoteAddrPort extracts the port from a remote address reported by frps
+// (":39123") or frpc ("p.ranax.co:39123").
+func remoteAddrPort(addr string) (int, bool) {
+	_, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, false
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, false
+	}
+	return port, true
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFrpcAdminWaitRemotePort(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "kai" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		remote := ""
+		if calls.Add(1) > 1 {
+			remote = "p.ranax.co:39123"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"tcp":[{"name":"ssh","type":"tcp","status":"running","local_addr":"127.0.0.1:22","remote_addr":"` + remote + `"}]}`))
+	}))
+	defer srv.Close()
+
+	admin := &frpcAdmin{Port: srv.Listener.Addr().(*net.TCPAddr).Port, User: "kai", Password: "secret"}
+	port, err := admin.waitRemotePort(context.Background(), "ssh")
+	if err != nil || port != 39123 {
+		t.Fatalf("waitRemotePort = %d, %v", port, err)
+	}
+
+	admin.Password = "wrong"
+	if _, err := admin.status(context.Background()); err == nil {
+		t.Fatalf("expected an error for wrong credentials")
+	}
+}
+
+func TestRemoteAddrPort(t *testing.T) {
+	for addr, want := range map[string]int{":6000": 6000, "p.ranax.co:39123": 39123, "": 0, "p.ranax.co:0": 0} {
+		port, ok := remoteAddrPort(addr)
+		if port != want || ok != (want != 0) {
+			t.Fatalf("remoteAddrPort(%q) = %d, %v", addr, port, ok)
+		}
+	}
+}
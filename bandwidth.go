@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	bandwidthUnitKB = 1024
+	bandwidthUnitMB = 1024 * 1024
+)
+
+// applyBandwidthFlags applies --bandwidth-limit and --bandwidth-limit-mode to
+// every tunnel except UDP ones, which frp does not limit.
+func applyBandwidthFlags(proxies []ProxyConfig, limit, mode string) error {
+	if limit == "" {
+		if mode != "" {
+			return fmt.Errorf("error: --bandwidth-limit-mode needs --bandwidth-limit")
+		}
+		return nil
+	}
+	bytes, err := parseBandwidthLimit(limit)
+	if err != nil {
+		return err
+	}
+	applied := false
+	for i := range proxies {
+		if proxies[i].Type == "udp" {
+			continue
+		}
+		proxies[i].BandwidthLimit = bytes
+		proxies[i].BandwidthLimitMode = mode
+		applied = true
+	}
+	if !applied {
+		return fmt.Errorf("error: --bandwidth-limit is not supported for udp tunnels")
+	}
+	return nil
+}
+
+// parseBandwidthLimit parses a per-second limit such as "2MB" with the units
+// of parseSize.
+func parseBandwidthLimit(raw string) (int64, error) {
+	bytes, err := parseSize(raw)
+	if err != nil {
+		return 0, fmt.Errorf("error: invalid bandwidth limit %q: %v", raw, err)
+	}
+	if bytes < bandwidthUnitKB {
+		return 0, fmt.Errorf("error: bandwidth limit %q is below the minimum of 1KB", raw)
+	}
+	return bytes, nil
+}
+
+func validateBandwidthLimit(proxy ProxyConfig) error {
+	if proxy.BandwidthLimit == 0 {
+		if proxy.BandwidthLimitMode != "" {
+			return fmt.Errorf("error: --bandwidth-limit-mode needs --bandwidth-limit")
+		}
+		return nil
+	}
+	if proxy.Type == "udp" {
+		return fmt.Errorf("error: bandwidth limits are not supported for udp tunnels")
+	}
+	if proxy.BandwidthLimit < bandwidthUnitKB {
+		return fmt.Errorf("error: bandwidth limit is below the minimum of 1KB")
+	}
+	if proxy.BandwidthLimitMode != "" && proxy.BandwidthLimitMode != "client" && proxy.BandwidthLimitMode != "server" {
+		return fmt.Errorf("error: --bandwidth-limit-mode must be client or server")
+	}
+	return nil
+}
+
+// BandwidthQuantity formats BandwidthLimit the way frp expects it: a whole
+// number of MB or KB. Limits that are not whole KB are rounded up.
+func (p ProxyConfig) BandwidthQuantity() string {
+	if p.BandwidthLimit%bandwidthUnitMB == 0 {
+		return fmt.Sprintf("%dMB", p.BandwidthLimit/bandwidthUnitMB)
+	}
+	return fmt.Sprintf("%dKB", (p.BandwidthLimit+bandwidthUnitKB-1)/bandwidthUnitKB)
+}
+
+// bandwidthLimiter is a token bucket shared by all connections of a proxy,
+// like frpc's client-side limit. It allows bursts of one second of traffic.
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// burst is the largest chunk the limiter hands out at once.
+func (l *bandwidthLimiter) burst() int {
+	return int(l.rate)
+}
+
+// wait blocks until n bytes may pass. n must not exceed burst.
+func (l *bandwidthLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// limitedConn passes both directions of a connection through a limiter.
+type limitedConn struct {
+	net.Conn
+	limiter *bandwidthLimiter
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(p) > c.limiter.burst() {
+		p = p[:c.limiter.burst()]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.limiter.wait(n)
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := min(len(p), c.limiter.burst())
+		c.limiter.wait(chunk)
+		n, err := c.Conn.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
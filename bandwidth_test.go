@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthQuantity(t *testing.T) {
+	for raw, want := range map[string]string{"2MB": "2MB", "512KB": "512KB", "1536KB": "1536KB", "1GB": "1024MB", "1500": "2KB"} {
+		limit, err := parseBandwidthLimit(raw)
+		if err != nil {
+			t.Fatalf("parse %q: %v", raw, err)
+		}
+		if got := (ProxyConfig{BandwidthLimit: limit}).BandwidthQuantity(); got != want {
+			t.Fatalf("%q rendered as %q, want %q", raw, got, want)
+		}
+	}
+	for _, raw := range []string{"", "fast", "100B", "-1MB"} {
+		if _, err := parseBandwidthLimit(raw); err == nil {
+			t.Fatalf("expected an error for %q", raw)
+		}
+	}
+}
+
+func TestApplyBandwidthFlags(t *testing.T) {
+	proxies := []ProxyConfig{{Type: "http"}, {Type: "udp"}}
+	if err := applyBandwidthFlags(proxies, "2MB", "server"); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if proxies[0].BandwidthLimit != 2*1024*1024 || proxies[0].BandwidthLimitMode != "server" || proxies[1].BandwidthLimit != 0 {
+		t.Fatalf("unexpected proxies: %+v", proxies)
+	}
+	if err := applyBandwidthFlags(proxies, "", "server"); err == nil {
+		t.Fatalf("expected an error for a mode without a limit")
+	}
+	if err := applyBandwidthFlags([]ProxyConfig{{Type: "udp"}}, "2MB", ""); err == nil {
+		t.Fatalf("expected an error without a tcp-based tunnel")
+	}
+	if err := validateBandwidthLimit(ProxyConfig{Type: "tcp", BandwidthLimit: 4096, BandwidthLimitMode: "both"}); err == nil {
+		t.Fatalf("expected an error for an unknown mode")
+	}
+	if err := validateBandwidthLimit(ProxyConfig{Type: "udp", BandwidthLimit: 4096}); err == nil {
+		t.Fatalf("expected an error for udp")
+	}
+}
+
+func TestLimitedConnThrottles(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	limited := &limitedConn{Conn: server, limiter: newBandwidthLimiter(100 * 1024)}
+
+	go func() {
+		defer limited.Close()
+		_, _ = limited.Write(make([]byte, 150*1024))
+	}()
+	start := time.Now()
+	n, err := io.Copy(io.Discard, client)
+	elapsed := time.Since(start)
+	if err != nil || n != 150*1024 {
+		t.Fatalf("copy: %d, %v", n, err)
+	}
+	// The first 100KB are the burst; the remaining 50KB take half a second.
+	if elapsed < 400*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("150KB at 100KB/s took %s", elapsed)
+	}
+}
+
+func TestRenderFrpcConfigBandwidthAndGroup(t *testing.T) {
+	rendered, err := renderFrpcConfig(TunnelConfig{
+		ServerAddr: "p.ranax.co",
+		ServerPort: 7000,
+		Token:      "abc",
+		Proxies: []ProxyConfig{
+			{Name: "db", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: 5432, RemotePort: 6000, BandwidthLimit: 2 * 1024 * 1024, Group: "db", GroupKey: "k"},
+			{Name: "web", Type: "http", LocalIP: "127.0.0.1", LocalPort: 3000, Subdomain: "web", BandwidthLimit: 512 * 1024, BandwidthLimitMode: "server"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("render config: %v", err)
+	}
+	text := string(rendered)
+	for _, want := range []string{
+		`transport.bandwidthLimit     = "2MB"`,
+		`transport.bandwidthLimitMode = "client"`,
+		`transport.bandwidthLimit     = "512KB"`,
+		`transport.bandwidthLimitMode = "server"`,
+		`loadBalancer.group    = "db"`,
+		`loadBalancer.groupKey = "k"`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("expected %q in rendered config, got %q", want, text)
+		}
+	}
+	if got := strings.Count(text, "loadBalancer.group "); got != 1 {
+		t.Fatalf("expected one group, got %d in %q", got, text)
+	}
+
+	msg := newFrpProxyMsg(ProxyConfig{Name: "db", Type: "tcp", RemotePort: 6000, BandwidthLimit: 2 * 1024 * 1024, Group: "db", GroupKey: "k"})
+	if msg.BandwidthLimit != "2MB" || msg.BandwidthLimitMode != "client" || msg.Group != "db" || msg.GroupKey != "k" {
+		t.Fatalf("unexpected native proxy message: %+v", msg)
+	}
+}
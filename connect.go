@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// VisitorConfig is the visitor side of a secret (stcp/xtcp) tunnel: a local
+// listener whose connections are forwarded to the named proxy through frps.
+type VisitorConfig struct {
+	Name       string
+	Type       string
+	ServerName string
+	SecretKey  string
+	BindAddr   string
+	BindPort   int
+
+	// UseEncryption and UseCompression must match the proxy's settings.
+	UseEncryption  bool
+	UseCompression bool
+}
+
+func runConnect(args []string) error {
+	defaults, err := loadTunnelDefaults()
+	if err != nil {
+		return err
+	}
+
+	var serverName string
+	normalizedArgs := args
+	if len(normalizedArgs) > 0 && !strings.HasPrefix(normalizedArgs[0], "-") {
+		serverName = normalizedArgs[0]
+		normalizedArgs = normalizedArgs[1:]
+	}
+
+	fs := flag.NewFlagSet("connect", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		printConnectUsage(fs)
+	}
+
+	ttype := fs.String("type", "stcp", "Secret tunnel type: stcp or xtcp")
+	secret := fs.String("secret", "", "Shared secret key of the tunnel")
+	bind := fs.String("bind", "", "Local address to listen on (host:port or port)")
+	conn := registerConnectionFlags(fs, defaults)
+
+	if err := fs.Parse(normalizedArgs); err != nil {
+		return err
+	}
+	if serverName == "" && fs.NArg() > 0 {
+		serverName = fs.Arg(0)
+	}
+
+	bindAddr, bindPort, err := parseBindAddr(*bind)
+	if err != nil {
+		return err
+	}
+
+	visitor := VisitorConfig{
+		Name:       fmt.Sprintf("%s-visitor-%d", serverName, bindPort),
+		Type:       strings.ToLower(*ttype),
+		ServerName: serverName,
+		SecretKey:  *secret,
+		BindAddr:   bindAddr,
+		BindPort:   bindPort,
+	}
+	if err := validateVisitor(visitor); err != nil {
+		return err
+	}
+
+	cfg := conn.tunnelConfig(nil)
+	visitor.UseEncryption = *conn.useEncryption
+	visitor.UseCompression = *conn.useCompression
+	cfg.Visitors = []VisitorConfig{visitor}
+	return startTunnel(cfg)
+}
+
+func printConnectUsage(fs *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  kai connect <name> --secret <key> --bind <addr:port> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Examples:")
+	fmt.Fprintln(os.Stderr, "  kai connect postgres --secret s3cr3t --bind 127.0.0.1:15432")
+	fmt.Fprintln(os.Stderr, "  kai connect ssh --type xtcp --secret s3cr3t --bind 2222")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Flags:")
+	fs.PrintDefaults()
+}
+
+// parseBindAddr accepts "host:port" or a bare port, which binds to 127.0.0.1.
+func parseBindAddr(raw string) (string, int, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", 0, fmt.Errorf("error: --bind is required")
+	}
+	host, portText := "127.0.0.1", raw
+	if strings.Contains(raw, ":") {
+		var err error
+		host, portText, err = net.SplitHostPort(raw)
+		if err != nil {
+			return "", 0, fmt.Errorf("error: invalid --bind %q: %v", raw, err)
+		}
+		if host == "" {
+			host = "127.0.0.1"
+		}
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("error: invalid --bind port %q", portText)
+	}
+	return host, port, nil
+}
+
+func validateVisitor(visitor VisitorConfig) error {
+	if visitor.ServerName == "" {
+		return fmt.Errorf("error: tunnel name is required (kai connect <name>)")
+	}
+	if !isSecretProxyType(visitor.Type) {
+		return fmt.Errorf("error: --type must be stcp or xtcp")
+	}
+	if visitor.SecretKey == "" {
+		return fmt.Errorf("error: --secret is required")
+	}
+	return nil
+}
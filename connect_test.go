@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseBindAddr(t *testing.T) {
+	host, port, err := parseBindAddr("127.0.0.1:15432")
+	if err != nil || host != "127.0.0.1" || port != 15432 {
+		t.Fatalf("unexpected bind result: %q %d %v", host, port, err)
+	}
+	host, port, err = parseBindAddr("2222")
+	if err != nil || host != "127.0.0.1" || port != 2222 {
+		t.Fatalf("unexpected bare port result: %q %d %v", host, port, err)
+	}
+	if _, _, err := parseBindAddr(""); err == nil {
+		t.Fatalf("expected error for empty --bind")
+	}
+	if _, _, err := parseBindAddr("localhost:http"); err == nil {
+		t.Fatalf("expected error for non-numeric port")
+	}
+}
+
+func TestRenderFrpcConfigSecretTunnelAndVisitor(t *testing.T) {
+	proxies := []ProxyConfig{{Type: "stcp", LocalIP: "127.0.0.1", LocalPort: 5432, SecretKey: "db-key"}}
+	assignProxyNames(proxies, 42)
+	if proxies[0].Name != "stcp-5432" {
+		t.Fatalf("expected stable secret proxy name, got %q", proxies[0].Name)
+	}
+
+	rendered, err := renderFrpcConfig(TunnelConfig{
+		ServerAddr: "p.ranax.co",
+		ServerPort: 7000,
+		Token:      "abc",
+		Proxies:    proxies,
+		Visitors: []VisitorConfig{
+			{Name: "stcp-5432-visitor-15432", Type: "stcp", ServerName: "stcp-5432", SecretKey: "db-key", BindAddr: "127.0.0.1", BindPort: 15432},
+		},
+	})
+	if err != nil {
+		t.Fatalf("render config: %v", err)
+	}
+	text := string(rendered)
+	for _, want := range []string{
+		`type      = "stcp"`,
+		`secretKey = "db-key"`,
+		"[[visitors]]",
+		`serverName = "stcp-5432"`,
+		`bindPort   = 15432`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("expected %q in rendered config, got %q", want, text)
+		}
+	}
+}
+
+func TestRenderFrpcConfigQuotesStrings(t *testing.T) {
+	rendered, err := renderFrpcConfig(TunnelConfig{
+		ServerAddr: "p.ranax.co",
+		ServerPort: 7000,
+		Token:      "tok\nen",
+		Proxies:    []ProxyConfig{{Name: "stcp-22", Type: "stcp", LocalIP: "127.0.0.1", LocalPort: 22, SecretKey: `pa"ss\word`}},
+		Visitors: []VisitorConfig{
+			{Name: "stcp-22-visitor-2222", Type: "stcp", ServerName: "stcp-22", SecretKey: `pa"ss\word`, BindAddr: "127.0.0.1", BindPort: 2222},
+		},
+	})
+	if err != nil {
+		t.Fatalf("render config: %v", err)
+	}
+	text := string(rendered)
+	for _, want := range []string{
+		`token  = "tok\nen"`,
+		`secretKey = "pa\"ss\\word"`,
+		`secretKey  = "pa\"ss\\word"`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("expected %q in rendered config, got %q", want, text)
+		}
+	}
+	if got := tomlQuote("a\x00b\x7f"); got != `"a\u0000b\u007F"` {
+		t.Fatalf("unexpected control character escaping: %s", got)
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// frpcTempPrefix names the temp dirs frpc is extracted into. `kai stop`
+	// only removes temp dirs with this prefix.
+	frpcTempPrefix = "pclient-"
+
+	// runIDEnv and runLogEnv pass the run ID and log file from `kai up -d`
+	// to the background process.
+	runIDEnv  = "KAI_RUN_ID"
+	runLogEnv = "KAI_RUN_LOG"
+
+	detachedStartTimeout = 30 * time.Second
+	defaultStopTimeout   = 10 * time.Second
+)
+
+// errProcessGone is returned by processStartTime for a PID without a process.
+var errProcessGone = errors.New("process not found")
+
+// newRunState describes this process for the run state file.
+func newRunState(cfg TunnelConfig, engine, server, tempDir string) runState {
+	state := runState{
+		ID:      os.Getenv(runIDEnv),
+		PID:     os.Getpid(),
+		Started: time.Now().UTC(),
+		Engine:  engine,
+		Server:  server,
+		Tunnels: cfg.Tunnels,
+		LogFile: os.Getenv(runLogEnv),
+		TempDir: tempDir,
+	}
+	if state.ID == "" {
+		state.ID = newRunID()
+	}
+	if started, err := processStartTime(state.PID); err == nil {
+		state.ProcessStart = started
+	}
+	if configPath, err := resolveConfigPath(); err == nil && configPath != "" {
+		if abs, err := filepath.Abs(configPath); err == nil {
+			configPath = abs
+		}
+		state.Config = configPath
+	}
+	for _, proxy := range cfg.Proxies {
+		state.Proxies = append(state.Proxies, proxy.Name)
+	}
+	state.URLs = runStateURLs(cfg)
+	return state
+}
+
+func runStateURLs(cfg TunnelConfig) []string {
+	var urls []string
+	for _, proxy := range cfg.Proxies {
+		if url := publicURL(cfg.ServerAddr, proxy); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+func newRunID() string {
+	b := make([]byte, 3)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// stripDetachFlag removes -d/--detach from args so the background process
+// runs in the foreground of its own session.
+func stripDetachFlag(args []string) []string {
+	out := make([]string, 0, len(args))
+	for _, arg := range args {
+		name, value, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && (name == "d" || name == "detach") && value != "false" {
+			continue
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+// startDetached runs kai with args as a background process that outlives the
+// terminal, then waits until its tunnels are up and prints where to find it.
+func startDetached(args []string) error {
+	dir, err := runStateDir()
+	if err != nil {
+		return fmt.Errorf("error: locate run dir: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("error: create run dir: %w", err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error: locate kai executable: %w", err)
+	}
+
+	id := newRunID()
+	logPath := filepath.Join(dir, id+".log")
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error: open log file: %w", err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(), runIDEnv+"="+id, runLogEnv+"="+logPath)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = detachedProcAttr()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error: start background tunnel: %w", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	return waitForDetached(id, cmd.Process.Pid, logPath, exited, detachedStartTimeout)
+}
+
+func waitForDetached(id string, pid int, logPath string, exited <-chan error, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-exited:
+			exitCode := 1
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				exitCode = exitErr.ExitCode()
+			}
+			return &tunnelError{
+				Code:     "tunnel_exited",
+				Message:  fmt.Sprintf("error: background tunnel exited (%v); last log lines:\n%s", err, tailFile(logPath, 20)),
+				ExitCode: exitCode,
+				Err:      err,
+			}
+		case <-deadline:
+			log.Printf("Tunnel %s (pid %d) is still starting; check `kai ls` or %s", id, pid, logPath)
+			return nil
+		case <-ticker.C:
+		}
+
+		states, err := readRunStates()
+		if err != nil {
+			continue
+		}
+		idx := slices.IndexFunc(states, func(s runState) bool { return s.ID == id })
+		if idx < 0 {
+			continue
+		}
+		status, err := fetchTunnelStatus(context.Background(), states[idx])
+		if err != nil || !status.Connected || slices.ContainsFunc(status.Proxies, func(p proxyStatus) bool { return p.Status != "running" }) {
+			continue
+		}
+
+		log.Printf("Tunnel %s is running in the background (pid %d):", id, pid)
+		for _, proxy := range status.Proxies {
+			if proxy.RemoteAddr != "" {
+				log.Printf("  %s -> %s", proxy.RemoteAddr, proxy.Local)
+			}
+		}
+		log.Printf("Logs: %s", logPath)
+		log.Printf("Stop it with: kai stop %s", id)
+		return nil
+	}
+}
+
+// tailFile returns the last n lines of a file, for error messages.
+func tailFile(path string, n int) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// liveRunStates reads the run state files and drops those of processes that
+// are gone, deleting their files and temp dirs.
+func liveRunStates() ([]runState, map[int]*tunnelStatus, error) {
+	states, err := readRunStates()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error: read tunnel state: %w", err)
+	}
+	live := states[:0]
+	statuses := make(map[int]*tunnelStatus, len(states))
+	for _, state := range states {
+		status, err := fetchTunnelStatus(context.Background(), state)
+		if err != nil && isStaleRunState(state, err) {
+			cleanupRunState(state)
+			continue
+		}
+		if err == nil {
+			statuses[state.PID] = status
+		}
+		live = append(live, state)
+	}
+	return live, statuses, nil
+}
+
+// isStaleRunState decides whether a tunnel whose status API failed with err
+// is gone: nothing listens on its status address, or its PID now belongs to
+// another process.
+func isStaleRunState(state runState, err error) bool {
+	if errors.Is(err, errTunnelNotRunning) {
+		return true
+	}
+	same, checkErr := isRunStateProcess(state)
+	return checkErr == nil && !same
+}
+
+// isRunStateProcess reports whether state.PID is still the process that wrote
+// the state file, by comparing process start times. An error means it could
+// not be told.
+func isRunStateProcess(state runState) (bool, error) {
+	started, err := processStartTime(state.PID)
+	if errors.Is(err, errProcessGone) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if state.ProcessStart.IsZero() {
+		return false, errors.New("the state file does not record the process start time")
+	}
+	// ps reports whole seconds and the Linux boot time can shift slightly.
+	diff := started.Sub(state.ProcessStart)
+	return diff > -2*time.Second && diff < 2*time.Second, nil
+}
+
+// cleanupRunState removes what a tunnel that did not exit cleanly left behind.
+func cleanupRunState(state runState) {
+	removeRunState(state.PID)
+	if state.TempDir != "" && strings.HasPrefix(filepath.Base(state.TempDir), frpcTempPrefix) &&
+		filepath.Dir(filepath.Clean(state.TempDir)) == filepath.Clean(os.TempDir()) {
+		_ = os.RemoveAll(state.TempDir)
+	}
+}
+
+// lsEntry is one line of `kai ls --output json`.
+type lsEntry struct {
+	ID      string    `json:"id"`
+	PID     int       `json:"pid"`
+	Tunnels []string  `json:"tunnels,omitempty"`
+	Started time.Time `json:"started"`
+	Status  string    `json:"status"`
+	URLs    []string  `json:"urls"`
+	Config  string    `json:"config,omitempty"`
+	LogFile string    `json:"log_file,omitempty"`
+}
+
+func runLs(args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	output := fs.String("output", "text", "Output format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("error: --output must be text or json")
+	}
+
+	states, statuses, err := liveRunStates()
+	if err != nil {
+		return err
+	}
+	entries := make([]lsEntry, 0, len(states))
+	for _, state := range states {
+		entries = append(entries, newLsEntry(state, statuses[state.PID]))
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]any{"tunnels": entries})
+	}
+	printLsEntries(os.Stdout, entries, time.Now())
+	return nil
+}
+
+// newLsEntry prefers the live status, which knows server-assigned ports and
+// regenerated subdomains, over the URLs recorded at startup.
+func newLsEntry(state runState, status *tunnelStatus) lsEntry {
+	entry := lsEntry{
+		ID:      state.ID,
+		PID:     state.PID,
+		Tunnels: state.Tunnels,
+		Started: state.Started,
+		Status:  "unreachable",
+		URLs:    state.URLs,
+		Config:  state.Config,
+		LogFile: state.LogFile,
+	}
+	if status == nil {
+		return entry
+	}
+	entry.Status = "connecting"
+	if status.Connected {
+		entry.Status = "connected"
+	}
+	entry.URLs = nil
+	for _, proxy := range status.Proxies {
+		if proxy.RemoteAddr != "" {
+			entry.URLs = append(entry.URLs, proxy.RemoteAddr)
+		}
+	}
+	return entry
+}
+
+func printLsEntries(w io.Writer, entries []lsEntry, now time.Time) {
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "No running tunnels.")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPID\tTUNNELS\tSTATUS\tUPTIME\tURLS")
+	for _, entry := range entries {
+		tunnels := strings.Join(entry.Tunnels, ",")
+		if tunnels == "" {
+			tunnels = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", entry.ID, entry.PID, tunnels, entry.Status,
+			now.Sub(entry.Started).Round(time.Second), strings.Join(entry.URLs, " "))
+	}
+	tw.Flush()
+}
+
+func runStop(args []string) error {
+	fs := flag.NewFlagSet("stop", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  kai stop <name|id|pid...> [flags]")
+		fmt.Fprintln(os.Stderr, "  kai stop --all [flags]")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Flags:")
+		fs.PrintDefaults()
+	}
+	all := fs.Bool("all", false, "Stop every running tunnel")
+	timeout := fs.Duration("timeout", defaultStopTimeout, "How long to wait for a clean shutdown before killing the process")
+
+	var targets []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		targets = append(targets, args[0])
+		args = args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	targets = append(targets, fs.Args()...)
+	if *all == (len(targets) > 0) {
+		return fmt.Errorf("error: name a tunnel (see kai ls) or use --all")
+	}
+
+	states, _, err := liveRunStates()
+	if err != nil {
+		return err
+	}
+	selected := states
+	if !*all {
+		if selected, err = matchRunStates(states, targets); err != nil {
+			return err
+		}
+	}
+	if len(selected) == 0 {
+		log.Println("No running tunnels.")
+		return nil
+	}
+	for _, state := range selected {
+		if err := stopRunningTunnel(state, *timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchRunStates finds the tunnels each target refers to: a run ID, a PID,
+// a `kai up` profile name or a proxy name.
+func matchRunStates(states []runState, targets []string) ([]runState, error) {
+	var out []runState
+	for _, target := range targets {
+		found := false
+		for _, state := range states {
+			if state.ID != target && strconv.Itoa(state.PID) != target &&
+				!slices.Contains(state.Tunnels, target) && !slices.Contains(state.Proxies, target) {
+				continue
+			}
+			found = true
+			if !slices.ContainsFunc(out, func(s runState) bool { return s.PID == state.PID }) {
+				out = append(out, state)
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("error: no running tunnel matches %q (see kai ls)", target)
+		}
+	}
+	return out, nil
+}
+
+// stopRunningTunnel asks the tunnel to shut down through its API, which runs
+// the same cleanup as Ctrl+C. If it is still running after timeout, the
+// process (and its frpc child) is killed and its leftovers removed.
+func stopRunningTunnel(state runState, timeout time.Duration) error {
+	resp, err := callTunnelAPI(context.Background(), state, http.MethodPost, "/api/stop")
+	if err == nil {
+		resp.Body.Close()
+		if waitForRunStateRemoval(state, timeout) {
+			log.Printf("Stopped tunnel %s (pid %d)", state.ID, state.PID)
+			return nil
+		}
+	} else if errors.Is(err, errTunnelNotRunning) {
+		cleanupRunState(state)
+		log.Printf("Tunnel %s (pid %d) was not running; removed its state", state.ID, state.PID)
+		return nil
+	}
+
+	// The PID may have been reused since the state file was written.
+	same, checkErr := isRunStateProcess(state)
+	if checkErr != nil {
+		return fmt.Errorf("error: stop tunnel %s: not killing pid %d, which could not be verified as the tunnel: %w", state.ID, state.PID, checkErr)
+	}
+	if !same {
+		cleanupRunState(state)
+		log.Printf("Tunnel %s (pid %d) was not running; removed its state", state.ID, state.PID)
+		return nil
+	}
+	if err := killProcessTree(state.PID); err != nil {
+		return fmt.Errorf("error: stop tunnel %s (pid %d): %w", state.ID, state.PID, err)
+	}
+	cleanupRunState(state)
+	log.Printf("Killed tunnel %s (pid %d)", state.ID, state.PID)
+	return nil
+}
+
+func waitForRunStateRemoval(state runState, timeout time.Duration) bool {
+	dir, err := runStateDir()
+	if err != nil {
+		return false
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d.json", state.PID))
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return true
+		}
+		// The PID may have been reused by a new tunnel in the meantime.
+		if err == nil && !bytes.Contains(data, []byte(`"id": "`+state.ID+`"`)) {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStripDetachFlag(t *testing.T) {
+	got := stripDetachFlag([]string{"web", "-d", "--detach", "--detach=true", "-d=false", "--debug", "--server", "d"})
+	want := []string{"web", "-d=false", "--debug", "--server", "d"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("stripDetachFlag = %q, want %q", got, want)
+	}
+}
+
+func TestMatchRunStates(t *testing.T) {
+	states := []runState{
+		{ID: "a1b2c3", PID: 100, Tunnels: []string{"web", "api"}, Proxies: []string{"web-1", "api-1"}},
+		{ID: "d4e5f6", PID: 200, Proxies: []string{"ssh"}},
+	}
+	for target, pid := range map[string]int{"a1b2c3": 100, "200": 200, "api": 100, "ssh": 200} {
+		got, err := matchRunStates(states, []string{target})
+		if err != nil || len(got) != 1 || got[0].PID != pid {
+			t.Fatalf("match %q: got %+v, %v", target, got, err)
+		}
+	}
+	if got, err := matchRunStates(states, []string{"web", "api", "ssh"}); err != nil || len(got) != 2 {
+		t.Fatalf("expected each process once, got %+v, %v", got, err)
+	}
+	if _, err := matchRunStates(states, []string{"db"}); err == nil || !strings.Contains(err.Error(), `"db"`) {
+		t.Fatalf("expected an error for an unknown name, got %v", err)
+	}
+}
+
+func TestStopRunningTunnelUsesAPI(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	captureLog(t)
+
+	cfg := TunnelConfig{ServerAddr: "p.ranax.co", Proxies: []ProxyConfig{{Name: "web", Type: "http", Subdomain: "web", LocalIP: "127.0.0.1", LocalPort: 3000}}}
+	stopped := make(chan struct{})
+	srv := &statusServer{
+		state:   runState{ID: "a1b2c3", PID: 4242, Started: time.Now().UTC(), Tunnels: []string{"web"}},
+		cfg:     cfg,
+		monitor: newTunnelMonitor(cfg),
+	}
+	// Like Ctrl+C, stopping makes startTunnel return and close the server.
+	srv.stop = func() {
+		close(stopped)
+		go srv.Close()
+	}
+	if err := srv.start(); err != nil {
+		t.Fatalf("start status server: %v", err)
+	}
+
+	states, err := readRunStates()
+	if err != nil || len(states) != 1 {
+		t.Fatalf("expected one run state, got %+v, %v", states, err)
+	}
+	if err := stopRunningTunnel(states[0], 5*time.Second); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Fatalf("stop func was not called")
+	}
+	if states, _ := readRunStates(); len(states) != 0 {
+		t.Fatalf("state file should be gone after stop, got %+v", states)
+	}
+}
+
+func TestProcessStartTime(t *testing.T) {
+	started, err := processStartTime(os.Getpid())
+	if err != nil {
+		t.Fatalf("start time of this process: %v", err)
+	}
+	if started.After(time.Now()) || time.Since(started) > time.Hour {
+		t.Fatalf("unexpected start time %v", started)
+	}
+	if state := newRunState(TunnelConfig{}, "native", "p.ranax.co:7000", ""); state.ProcessStart.IsZero() {
+		t.Fatalf("run state should record the process start time")
+	}
+}
+
+func TestStopRunningTunnelVerifiesPID(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	captureLog(t)
+	// An API that answers with an error, so stop falls back to killing.
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer api.Close()
+
+	cmd := runHelperCommand(t, "wait", TunnelConfig{})
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start helper: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	defer cmd.Process.Kill()
+	started, err := processStartTime(cmd.Process.Pid)
+	if err != nil {
+		t.Fatalf("start time of the helper: %v", err)
+	}
+	state := runState{ID: "a1b2c3", PID: cmd.Process.Pid, StatusAddr: strings.TrimPrefix(api.URL, "http://")}
+
+	// A process that started at another time only reuses the PID.
+	state.ProcessStart = started.Add(-time.Hour)
+	if err := stopRunningTunnel(state, 100*time.Millisecond); err != nil {
+		t.Fatalf("stop with a reused PID: %v", err)
+	}
+	select {
+	case <-exited:
+		t.Fatalf("a process that reused the PID was killed")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	state.ProcessStart = started
+	if err := stopRunningTunnel(state, 100*time.Millisecond); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the tunnel process was not killed")
+	}
+}
+
+func TestCleanupRunStateOnlyRemovesFrpcTempDirs(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	frpcDir, err := os.MkdirTemp("", frpcTempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(frpcDir)
+	otherDir := t.TempDir()
+
+	cleanupRunState(runState{PID: 1, TempDir: otherDir})
+	if _, err := os.Stat(otherDir); err != nil {
+		t.Fatalf("unrelated dir should be kept: %v", err)
+	}
+	cleanupRunState(runState{PID: 1, TempDir: filepath.Join(otherDir, frpcTempPrefix+"x")})
+	if _, err := os.Stat(otherDir); err != nil {
+		t.Fatalf("dir outside the temp dir should be kept: %v", err)
+	}
+	cleanupRunState(runState{PID: 1, TempDir: frpcDir})
+	if _, err := os.Stat(frpcDir); !os.IsNotExist(err) {
+		t.Fatalf("frpc temp dir should be removed, got %v", err)
+	}
+}
+
+func TestPrintLsEntries(t *testing.T) {
+	started := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	state := runState{ID: "a1b2c3", PID: 4242, Started: started, Tunnels: []string{"web", "api"}, URLs: []string{"https://web.p.ranax.co"}}
+
+	entry := newLsEntry(state, nil)
+	if entry.Status != "unreachable" || !slices.Equal(entry.URLs, state.URLs) {
+		t.Fatalf("unexpected entry without status: %+v", entry)
+	}
+	entry = newLsEntry(state, &tunnelStatus{Connected: true, Proxies: []proxyStatus{{RemoteAddr: "https://brave-otter-4821.p.ranax.co"}}})
+	if entry.Status != "connected" || !slices.Equal(entry.URLs, []string{"https://brave-otter-4821.p.ranax.co"}) {
+		t.Fatalf("live status should win: %+v", entry)
+	}
+
+	var buf bytes.Buffer
+	printLsEntries(&buf, []lsEntry{entry}, started.Add(2*time.Minute))
+	for _, want := range []string{"ID", "a1b2c3", "4242", "web,api", "connected", "2m0s", "https://brave-otter-4821.p.ranax.co"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("expected %q in output, got %q", want, buf.String())
+		}
+	}
+}
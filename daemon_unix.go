@@ -0,0 +1,94 @@
+//go:build !windows
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// detachedProcAttr starts the background tunnel in its own session so it
+// survives the terminal closing and can be killed as a process group.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// killProcessTree kills kai and the frpc it started. Background tunnels lead
+// their own process group; for foreground ones only kai itself is killed and
+// frpc exits when its pipes close.
+func killProcessTree(pid int) error {
+	if err := syscall.Kill(-pid, syscall.SIGKILL); err == nil {
+		return nil
+	}
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
+
+// processStartTime returns when the process pid started. Linux has it in
+// /proc; other systems are asked through ps.
+func processStartTime(pid int) (time.Time, error) {
+	if _, err := os.Stat("/proc/self/stat"); err == nil {
+		return procStartTime(pid)
+	}
+	cmd := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid))
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	out, err := cmd.Output()
+	if len(bytes.TrimSpace(out)) == 0 {
+		var exitErr *exec.ExitError
+		if err == nil || errors.As(err, &exitErr) {
+			return time.Time{}, errProcessGone
+		}
+		return time.Time{}, err
+	}
+	return time.ParseInLocation("Mon Jan _2 15:04:05 2006", strings.TrimSpace(string(out)), time.Local)
+}
+
+// procStartTime reads the start time from /proc/<pid>/stat, where it is
+// counted in clock ticks (100 per second on Linux) since boot.
+func procStartTime(pid int) (time.Time, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, errProcessGone
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	// The command name in parentheses may contain spaces, so the fields
+	// are counted from the state after it: starttime is the 20th.
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return time.Time{}, fmt.Errorf("unexpected /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("unexpected /proc/%d/stat", pid)
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unexpected /proc/%d/stat: %w", pid, err)
+	}
+
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+			boot, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("unexpected btime in /proc/stat: %w", err)
+			}
+			return time.Unix(boot, 0).Add(time.Duration(ticks) * time.Second / 100), nil
+		}
+	}
+	return time.Time{}, errors.New("no btime in /proc/stat")
+}
@@ -0,0 +1,59 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	detachedProcess = 0x00000008
+	// errorInvalidParameter is what OpenProcess fails with for a PID that
+	// has no process.
+	errorInvalidParameter syscall.Errno = 87
+	// stillActive is the exit code GetExitCodeProcess reports for a process
+	// that is still running.
+	stillActive = 259
+)
+
+// detachedProcAttr starts the background tunnel without a console so it
+// survives the terminal closing.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP | detachedProcess,
+		HideWindow:    true,
+	}
+}
+
+// killProcessTree kills kai and the frpc it started.
+func killProcessTree(pid int) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(pid)).Run()
+}
+
+// processStartTime returns when the process pid was created.
+func processStartTime(pid int) (time.Time, error) {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err == errorInvalidParameter {
+		return time.Time{}, errProcessGone
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer syscall.CloseHandle(h)
+
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return time.Time{}, err
+	}
+	if code != stillActive {
+		return time.Time{}, errProcessGone
+	}
+	var created, exited, kernel, user syscall.Filetime
+	if err := syscall.GetProcessTimes(h, &created, &exited, &kernel, &user); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, created.Nanoseconds()), nil
+}
@@ -0,0 +1,6 @@
+//go:build nofrpc || !(linux || darwin || windows)
+
+package main
+
+// Builds without an embedded frpc run tunnels with the native client.
+var frpcBinary []byte
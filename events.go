@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tunnelEvent is one line of `--output json`. Fields that do not apply to an
+// event are omitted.
+type tunnelEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Engine   string    `json:"engine,omitempty"`
+	Server   string    `json:"server,omitempty"`
+	Proxy    string    `json:"proxy,omitempty"`
+	Type     string    `json:"type,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	URLs     []string  `json:"urls,omitempty"`
+	ShareURL string    `json:"share_url,omitempty"`
+	Local    string    `json:"local,omitempty"`
+	Attempt  int       `json:"attempt,omitempty"`
+	DelayMS  int64     `json:"delay_ms,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Code     string    `json:"code,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	ExitCode int       `json:"exit_code,omitempty"`
+}
+
+// tunnelEvents writes newline-delimited JSON events to stdout when the tunnel
+// runs with `--output json`. In text mode it does nothing and the log output
+// is the only interface. A nil *tunnelEvents is valid and discards events.
+type tunnelEvents struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newTunnelEvents(output string, w io.Writer) *tunnelEvents {
+	if output != "json" {
+		return &tunnelEvents{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &tunnelEvents{enc: enc}
+}
+
+func (e *tunnelEvents) enabled() bool {
+	return e != nil && e.enc != nil
+}
+
+// engineOutput is where the tunnel engine's own log lines go. In JSON mode
+// stdout is reserved for events.
+func (e *tunnelEvents) engineOutput() io.Writer {
+	if e.enabled() {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+func (e *tunnelEvents) emit(ev tunnelEvent) {
+	if !e.enabled() {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_ = e.enc.Encode(ev)
+}
+
+func (e *tunnelEvents) emitError(err error) {
+	ev := tunnelEvent{Event: "error", Code: "tunnel_error", Message: err.Error(), ExitCode: 1}
+	var tunnelErr *tunnelError
+	if errors.As(err, &tunnelErr) {
+		ev.Code = tunnelErr.Code
+		ev.ExitCode = tunnelErr.ExitCode
+	}
+	e.emit(ev)
+}
+
+// proxyReadyEvent describes a proxy that frps accepted. URLs is only set when
+// an HTTP tunnel answers on more than one host.
+func proxyReadyEvent(serverAddr string, proxy ProxyConfig) tunnelEvent {
+	ev := tunnelEvent{
+		Event:    "proxy_ready",
+		Proxy:    proxy.Name,
+		Type:     proxy.Type,
+		URL:      publicURL(serverAddr, proxy),
+		ShareURL: accessURL(serverAddr, proxy),
+		Local:    fmt.Sprintf("%s:%d", proxy.LocalIP, proxy.LocalPort),
+	}
+	if addrs := publicAddresses(serverAddr, proxy); len(addrs) > 1 {
+		for _, addr := range addrs {
+			ev.URLs = append(ev.URLs, withScheme(addr))
+		}
+	}
+	return ev
+}
+
+// accessURL is the link to hand out for a tunnel protected by an access
+// token, or "" for other tunnels.
+func accessURL(serverAddr string, proxy ProxyConfig) string {
+	if proxy.AccessToken == "" {
+		return ""
+	}
+	return withAccessToken(publicURL(serverAddr, proxy), proxy.AccessToken)
+}
+
+func withAccessToken(addr, token string) string {
+	return withScheme(addr) + "/?" + accessTokenParam + "=" + url.QueryEscape(token)
+}
+
+// publicURL is publicAddress with an explicit scheme, which is easier for
+// scripts to consume.
+func publicURL(serverAddr string, proxy ProxyConfig) string {
+	switch proxy.Type {
+	case "http", "https":
+		return withScheme(publicAddress(serverAddr, proxy))
+	case "tcp", "udp":
+		return fmt.Sprintf("%s://%s:%d", proxy.Type, serverAddr, proxy.RemotePort)
+	default:
+		return ""
+	}
+}
+
+// withScheme adds http:// to HTTP tunnel addresses, which are printed without
+// a scheme.
+func withScheme(addr string) string {
+	if addr == "" || strings.Contains(addr, "://") {
+		return addr
+	}
+	return "http://" + addr
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func decodeEvents(t *testing.T, buf *bytes.Buffer) []tunnelEvent {
+	t.Helper()
+	var events []tunnelEvent
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var ev tunnelEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatalf("decode event: %v", err)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestTunnelMonitorEmitsJSONEvents(t *testing.T) {
+	captureLog(t)
+	var buf bytes.Buffer
+	monitor := newTunnelMonitor(TunnelConfig{
+		ServerAddr: "p.ranax.co",
+		Proxies: []ProxyConfig{
+			{Name: "web", Type: "http", Subdomain: "web", LocalIP: "127.0.0.1", LocalPort: 3000},
+			{Name: "ssh", Type: "tcp", RemotePort: 22022, LocalIP: "127.0.0.1", LocalPort: 22},
+		},
+	})
+	monitor.events = newTunnelEvents("json", &buf)
+
+	monitor.loginSucceeded()
+	monitor.proxyStarted("web")
+	monitor.proxyStarted("web")
+	monitor.proxyStarted("ssh")
+	monitor.events.emitError(&tunnelError{Code: "subdomain_in_use", Message: "taken", ExitCode: exitCodeTunnelSubdomainInUse})
+
+	events := decodeEvents(t, &buf)
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %+v", events)
+	}
+	if events[0].Event != "connected" || events[0].Time.IsZero() {
+		t.Fatalf("unexpected first event: %+v", events[0])
+	}
+	if events[1].Event != "proxy_ready" || events[1].URL != "http://web.p.ranax.co" || events[1].Local != "127.0.0.1:3000" {
+		t.Fatalf("unexpected http proxy_ready: %+v", events[1])
+	}
+	if events[2].URL != "tcp://p.ranax.co:22022" {
+		t.Fatalf("unexpected tcp proxy_ready: %+v", events[2])
+	}
+	if events[3].Event != "error" || events[3].Code != "subdomain_in_use" || events[3].ExitCode != exitCodeTunnelSubdomainInUse {
+		t.Fatalf("unexpected error event: %+v", events[3])
+	}
+}
+
+func TestSuperviseTunnelEmitsReconnecting(t *testing.T) {
+	captureLog(t)
+	var buf bytes.Buffer
+	events := newTunnelEvents("json", &buf)
+	_ = superviseTunnel(context.Background(), fastRestartPolicy(1), "frpc", events, func(ctx context.Context) error {
+		return errors.New("frpc exited: exit status 1")
+	})
+
+	got := decodeEvents(t, &buf)
+	if len(got) != 1 || got[0].Event != "reconnecting" || got[0].Attempt != 1 || got[0].Reason != "frpc exited: exit status 1" {
+		t.Fatalf("unexpected events: %+v", got)
+	}
+}
+
+func TestTunnelEventsTextModeIsSilent(t *testing.T) {
+	var buf bytes.Buffer
+	events := newTunnelEvents("text", &buf)
+	events.emit(tunnelEvent{Event: "starting"})
+	var nilEvents *tunnelEvents
+	nilEvents.emit(tunnelEvent{Event: "starting"})
+	if buf.Len() != 0 {
+		t.Fatalf("expected no output in text mode, got %q", buf.String())
+	}
+}
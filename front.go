@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// isLocalHTTPProxy reports whether kai sees plain HTTP for the proxy, which is
+// what the local fronts need. HTTPS tunnels only qualify when kai terminates
+// TLS itself.
+func isLocalHTTPProxy(proxy ProxyConfig) bool {
+	return proxy.Type == "http" || (proxy.Type == "https" && proxy.LocalTLS)
+}
+
+// localFronts are kai's own HTTP handlers (access token gate, inspector) placed
+// between the tunnel engine and local HTTP services. Each fronted proxy gets a
+// loopback listener that forwards to the original LocalIP:LocalPort.
+type localFronts struct {
+	servers []*http.Server
+}
+
+// startLocalFronts starts a front for every proxy that needs one and returns
+// cfg with those proxies pointed at the front listeners. insp may be nil.
+func startLocalFronts(cfg TunnelConfig, insp *inspector) (*localFronts, TunnelConfig, error) {
+	fronts := &localFronts{}
+	engineCfg := cfg
+	engineCfg.Proxies = append([]ProxyConfig(nil), cfg.Proxies...)
+
+	for i, proxy := range engineCfg.Proxies {
+		if !isLocalHTTPProxy(proxy) || (insp == nil && proxy.AccessToken == "") {
+			continue
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fronts.Close()
+			return nil, cfg, fmt.Errorf("error: local front listen: %w", err)
+		}
+
+		target := &url.URL{Scheme: "http", Host: net.JoinHostPort(proxy.LocalIP, strconv.Itoa(proxy.LocalPort))}
+		var handler http.Handler = newLocalReverseProxy(target)
+		if insp != nil {
+			handler = insp.recordingHandler(proxy.Name, target.Host, handler)
+		}
+		if proxy.AccessToken != "" {
+			handler = accessTokenGate(proxy.AccessToken, handler)
+		}
+		fronts.serve(ln, handler)
+
+		engineCfg.Proxies[i].LocalIP = "127.0.0.1"
+		engineCfg.Proxies[i].LocalPort = ln.Addr().(*net.TCPAddr).Port
+	}
+	return fronts, engineCfg, nil
+}
+
+func (f *localFronts) serve(ln net.Listener, handler http.Handler) {
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 30 * time.Second}
+	f.servers = append(f.servers, srv)
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("local front: %v", err)
+		}
+	}()
+}
+
+func (f *localFronts) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, srv := range f.servers {
+		_ = srv.Shutdown(ctx)
+	}
+	return nil
+}
+
+// newLocalReverseProxy forwards requests to target unchanged, including the
+// Host and X-Forwarded-* headers set by frps.
+func newLocalReverseProxy(target *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.Host = pr.In.Host
+			for _, key := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+				if values := pr.In.Header.Values(key); len(values) > 0 {
+					pr.Out.Header[key] = values
+				}
+			}
+		},
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if rec, ok := w.(*recordingResponseWriter); ok {
+				rec.proxyErr = err
+			}
+			http.Error(w, "kai: local service unavailable: "+err.Error(), http.StatusBadGateway)
+		},
+	}
+}
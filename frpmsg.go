@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// frp control messages are framed as a one-byte type, a big-endian int64
+// length and a JSON body. Only the messages kai needs are modelled here.
+const (
+	frpMsgLogin         byte = 'o'
+	frpMsgLoginResp     byte = '1'
+	frpMsgNewProxy      byte = 'p'
+	frpMsgNewProxyResp  byte = '2'
+	frpMsgCloseProxy    byte = 'c'
+	frpMsgNewWorkConn   byte = 'w'
+	frpMsgReqWorkConn   byte = 'r'
+	frpMsgStartWorkConn byte = 's'
+	frpMsgNewVisitor    byte = 'v'
+	frpMsgNewVisitorRsp byte = '3'
+	frpMsgPing          byte = 'h'
+	frpMsgPong          byte = '4'
+	frpMsgUDPPacket     byte = 'u'
+)
+
+const (
+	frpProtocolVersion = "0.61.0"
+	frpMaxMsgLength    = 10240
+	frpCryptoSalt      = "frp"
+)
+
+var errFrpMsgTooLarge = errors.New("frp message too large")
+
+type frpLogin struct {
+	Version      string            `json:"version,omitempty"`
+	Hostname     string            `json:"hostname,omitempty"`
+	Os           string            `json:"os,omitempty"`
+	Arch         string            `json:"arch,omitempty"`
+	User         string            `json:"user,omitempty"`
+	PrivilegeKey string            `json:"privilege_key,omitempty"`
+	Timestamp    int64             `json:"timestamp,omitempty"`
+	RunID        string            `json:"run_id,omitempty"`
+	Metas        map[string]string `json:"metas,omitempty"`
+	PoolCount    int               `json:"pool_count,omitempty"`
+}
+
+type frpLoginResp struct {
+	Version string `json:"version,omitempty"`
+	RunID   string `json:"run_id,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type frpNewProxy struct {
+	ProxyName      string `json:"proxy_name,omitempty"`
+	ProxyType      string `json:"proxy_type,omitempty"`
+	UseEncryption  bool   `json:"use_encryption,omitempty"`
+	UseCompression bool   `json:"use_compression,omitempty"`
+
+	BandwidthLimit     string `json:"bandwidth_limit,omitempty"`
+	BandwidthLimitMode string `json:"bandwidth_limit_mode,omitempty"`
+	Group              string `json:"group,omitempty"`
+	GroupKey           string `json:"group_key,omitempty"`
+
+	RemotePort int `json:"remote_port,omitempty"`
+
+	CustomDomains []string `json:"custom_domains,omitempty"`
+	SubDomain     string   `json:"subdomain,omitempty"`
+	HTTPUser      string   `json:"http_user,omitempty"`
+	HTTPPwd       string   `json:"http_pwd,omitempty"`
+
+	HostHeaderRewrite string            `json:"host_header_rewrite,omitempty"`
+	Headers           map[string]string `json:"headers,omitempty"`
+	ResponseHeaders   map[string]string `json:"response_headers,omitempty"`
+
+	Sk string `json:"sk,omitempty"`
+}
+
+type frpNewProxyResp struct {
+	ProxyName  string `json:"proxy_name,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type frpCloseProxy struct {
+	ProxyName string `json:"proxy_name,omitempty"`
+}
+
+type frpNewWorkConn struct {
+	RunID        string `json:"run_id,omitempty"`
+	PrivilegeKey string `json:"privilege_key,omitempty"`
+	Timestamp    int64  `json:"timestamp,omitempty"`
+}
+
+type frpReqWorkConn struct{}
+
+type frpStartWorkConn struct {
+	ProxyName string `json:"proxy_name,omitempty"`
+	SrcAddr   string `json:"src_addr,omitempty"`
+	DstAddr   string `json:"dst_addr,omitempty"`
+	SrcPort   uint16 `json:"src_port,omitempty"`
+	DstPort   uint16 `json:"dst_port,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type frpNewVisitorConn struct {
+	RunID          string `json:"run_id,omitempty"`
+	ProxyName      string `json:"proxy_name,omitempty"`
+	SignKey        string `json:"sign_key,omitempty"`
+	Timestamp      int64  `json:"timestamp,omitempty"`
+	UseEncryption  bool   `json:"use_encryption,omitempty"`
+	UseCompression bool   `json:"use_compression,omitempty"`
+}
+
+type frpNewVisitorConnResp struct {
+	ProxyName string `json:"proxy_name,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// frpUDPPacket carries one datagram over a UDP proxy's work connection.
+// Content is base64 in JSON, which is how encoding/json encodes []byte.
+type frpUDPPacket struct {
+	Content    []byte       `json:"c,omitempty"`
+	LocalAddr  *net.UDPAddr `json:"l,omitempty"`
+	RemoteAddr *net.UDPAddr `json:"r,omitempty"`
+}
+
+type frpPing struct {
+	PrivilegeKey string `json:"privilege_key,omitempty"`
+	Timestamp    int64  `json:"timestamp,omitempty"`
+}
+
+type frpPong struct {
+	Error string `json:"error,omitempty"`
+}
+
+func writeFrpMsg(w io.Writer, msgType byte, msg any) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 9+len(body))
+	frame[0] = msgType
+	binary.BigEndian.PutUint64(frame[1:9], uint64(len(body)))
+	copy(frame[9:], body)
+	_, err = w.Write(frame)
+	return err
+}
+
+// readFrpMsg reads one framed message and returns its type and raw JSON body.
+func readFrpMsg(r io.Reader) (byte, []byte, error) {
+	var header [9]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int64(binary.BigEndian.Uint64(header[1:9]))
+	if length < 0 || length > frpMaxMsgLength {
+		return 0, nil, errFrpMsgTooLarge
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+// readFrpMsgInto reads one message and decodes it into out, failing if the
+// message type does not match.
+func readFrpMsgInto(r io.Reader, msgType byte, out any) error {
+	gotType, body, err := readFrpMsg(r)
+	if err != nil {
+		return err
+	}
+	if gotType != msgType {
+		return fmt.Errorf("unexpected frp message type %q (want %q)", gotType, msgType)
+	}
+	return json.Unmarshal(body, out)
+}
+
+// frpAuthKey is the token privilege key frps expects: md5(token + timestamp).
+func frpAuthKey(token string, timestamp int64) string {
+	sum := md5.Sum([]byte(token + strconv.FormatInt(timestamp, 10)))
+	return hex.EncodeToString(sum[:])
+}
+
+// frpCryptoConn wraps a stream with the AES-128-CFB framing frp uses for the
+// control connection. Each direction starts with its own random IV.
+type frpCryptoConn struct {
+	rw  io.ReadWriter
+	key []byte
+
+	dec cipher.Stream
+	enc cipher.Stream
+}
+
+func newFrpCryptoConn(rw io.ReadWriter, token string) (*frpCryptoConn, error) {
+	key, err := pbkdf2.Key(sha1.New, token, []byte(frpCryptoSalt), 64, aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	return &frpCryptoConn{rw: rw, key: key}, nil
+}
+
+func (c *frpCryptoConn) Read(p []byte) (int, error) {
+	if c.dec == nil {
+		iv := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(c.rw, iv); err != nil {
+			return 0, err
+		}
+		block, err := aes.NewCipher(c.key)
+		if err != nil {
+			return 0, err
+		}
+		c.dec = cipher.NewCFBDecrypter(block, iv)
+	}
+	n, err := c.rw.Read(p)
+	if n > 0 {
+		c.dec.XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
+}
+
+func (c *frpCryptoConn) Write(p []byte) (int, error) {
+	var prefix []byte
+	if c.enc == nil {
+		iv := make([]byte, aes.BlockSize)
+		if _, err := rand.Read(iv); err != nil {
+			return 0, err
+		}
+		block, err := aes.NewCipher(c.key)
+		if err != nil {
+			return 0, err
+		}
+		c.enc = cipher.NewCFBEncrypter(block, iv)
+		prefix = iv
+	}
+	out := make([]byte, len(prefix)+len(p))
+	copy(out, prefix)
+	c.enc.XORKeyStream(out[len(prefix):], p)
+	if _, err := c.rw.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// frpEncryptedConn encrypts a work connection the way frpc does for proxies
+// and visitors with transport.useEncryption. The framing is the same as the
+// control connection's.
+type frpEncryptedConn struct {
+	net.Conn
+	crypto *frpCryptoConn
+}
+
+func newFrpEncryptedConn(conn net.Conn, key string) (net.Conn, error) {
+	crypto, err := newFrpCryptoConn(conn, key)
+	if err != nil {
+		return nil, err
+	}
+	return &frpEncryptedConn{Conn: conn, crypto: crypto}, nil
+}
+
+func (c *frpEncryptedConn) Read(p []byte) (int, error) {
+	return c.crypto.Read(p)
+}
+
+func (c *frpEncryptedConn) Write(p []byte) (int, error) {
+	return c.crypto.Write(p)
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// muxSession is a minimal yamux session, the stream multiplexer frp uses when
+// tcpMux is enabled (the frps default). The control connection and every work
+// connection are streams on a single TCP connection to frps.
+const (
+	muxVersion byte = 0
+
+	muxTypeData         byte = 0
+	muxTypeWindowUpdate byte = 1
+	muxTypePing         byte = 2
+	muxTypeGoAway       byte = 3
+
+	muxFlagSYN uint16 = 1
+	muxFlagACK uint16 = 2
+	muxFlagFIN uint16 = 4
+	muxFlagRST uint16 = 8
+
+	muxHeaderSize    = 12
+	muxInitialWindow = 256 * 1024
+	muxMaxFrameSize  = 64 * 1024
+	muxAcceptBacklog = 64
+)
+
+var (
+	errMuxSessionClosed = errors.New("mux session closed")
+	errMuxStreamClosed  = errors.New("mux stream closed")
+	errMuxStreamReset   = errors.New("mux stream reset by peer")
+)
+
+type muxSession struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	streams  map[uint32]*muxStream
+	nextID   uint32
+	accepted chan *muxStream
+	closeErr error
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newMuxSession starts a session over conn. Clients open odd stream IDs and
+// servers even ones, as in yamux.
+func newMuxSession(conn net.Conn, client bool) *muxSession {
+	s := &muxSession{
+		conn:     conn,
+		streams:  make(map[uint32]*muxStream),
+		nextID:   2,
+		accepted: make(chan *muxStream, muxAcceptBacklog),
+		closed:   make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+	go s.recvLoop()
+	return s
+}
+
+func (s *muxSession) Open() (*muxStream, error) {
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return nil, errMuxSessionClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newMuxStream(s, id)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxTypeWindowUpdate, muxFlagSYN, id, 0, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *muxSession) Accept() (*muxStream, error) {
+	select {
+	case stream := <-s.accepted:
+		return stream, nil
+	case <-s.closed:
+		return nil, s.err()
+	}
+}
+
+func (s *muxSession) Close() error {
+	_ = s.writeFrame(muxTypeGoAway, 0, 0, 0, nil)
+	s.closeWithErr(errMuxSessionClosed)
+	return nil
+}
+
+// Done is closed once the underlying connection is gone.
+func (s *muxSession) Done() <-chan struct{} {
+	return s.closed
+}
+
+func (s *muxSession) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *muxSession) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closeErr == nil {
+		return errMuxSessionClosed
+	}
+	return s.closeErr
+}
+
+func (s *muxSession) closeWithErr(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closeErr = err
+		streams := make([]*muxStream, 0, len(s.streams))
+		for _, stream := range s.streams {
+			streams = append(streams, stream)
+		}
+		s.mu.Unlock()
+
+		close(s.closed)
+		_ = s.conn.Close()
+		for _, stream := range streams {
+			stream.notify()
+		}
+	})
+}
+
+func (s *muxSession) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *muxSession) writeFrame(frameType byte, flags uint16, id, length uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderSize+len(payload))
+	frame[0] = muxVersion
+	frame[1] = frameType
+	binary.BigEndian.PutUint16(frame[2:4], flags)
+	binary.BigEndian.PutUint32(frame[4:8], id)
+	binary.BigEndian.PutUint32(frame[8:12], length)
+	copy(frame[muxHeaderSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.isClosed() {
+		return s.err()
+	}
+	if _, err := s.conn.Write(frame); err != nil {
+		s.closeWithErr(err)
+		return err
+	}
+	return nil
+}
+
+func (s *muxSession) recvLoop() {
+	var header [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+			s.closeWithErr(err)
+			return
+		}
+		if header[0] != muxVersion {
+			s.closeWithErr(fmt.Errorf("mux: unsupported protocol version %d", header[0]))
+			return
+		}
+		frameType := header[1]
+		flags := binary.BigEndian.Uint16(header[2:4])
+		id := binary.BigEndian.Uint32(header[4:8])
+		length := binary.BigEndian.Uint32(header[8:12])
+
+		switch frameType {
+		case muxTypeData, muxTypeWindowUpdate:
+			if err := s.handleStreamFrame(frameType, flags, id, length); err != nil {
+				s.closeWithErr(err)
+				return
+			}
+		case muxTypePing:
+			if flags&muxFlagSYN != 0 {
+				go s.writeFrame(muxTypePing, muxFlagACK, 0, length, nil)
+			}
+		case muxTypeGoAway:
+			s.closeWithErr(errMuxSessionClosed)
+			return
+		default:
+			s.closeWithErr(fmt.Errorf("mux: unknown frame type %d", frameType))
+			return
+		}
+	}
+}
+
+func (s *muxSession) handleStreamFrame(frameType byte, flags uint16, id, length uint32) error {
+	s.mu.Lock()
+	stream := s.streams[id]
+	isNew := stream == nil && flags&muxFlagSYN != 0
+	if isNew {
+		stream = newMuxStream(s, id)
+		s.streams[id] = stream
+	}
+	s.mu.Unlock()
+
+	if isNew {
+		select {
+		case s.accepted <- stream:
+			if err := s.writeFrame(muxTypeWindowUpdate, muxFlagACK, id, 0, nil); err != nil {
+				return err
+			}
+		default:
+			s.removeStream(id)
+			stream = nil
+			if err := s.writeFrame(muxTypeWindowUpdate, muxFlagRST, id, 0, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	if stream == nil {
+		// Frames for streams we already closed are drained and dropped.
+		if frameType == muxTypeData && length > 0 {
+			if _, err := io.CopyN(io.Discard, s.conn, int64(length)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if frameType == muxTypeWindowUpdate {
+		stream.growSendWindow(length)
+	} else if length > 0 {
+		if err := stream.receive(s.conn, length); err != nil {
+			return err
+		}
+	}
+	stream.handleFlags(flags)
+	return nil
+}
+
+type muxStream struct {
+	session *muxSession
+	id      uint32
+
+	mu            sync.Mutex
+	recvBuf       []byte
+	recvWindow    uint32
+	sendWindow    uint32
+	remoteClosed  bool
+	localClosed   bool
+	reset         bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	recvNotify chan struct{}
+	sendNotify chan struct{}
+}
+
+func newMuxStream(session *muxSession, id uint32) *muxStream {
+	return &muxStream{
+		session:    session,
+		id:         id,
+		recvWindow: muxInitialWindow,
+		sendWindow: muxInitialWindow,
+		recvNotify: make(chan struct{}, 1),
+		sendNotify: make(chan struct{}, 1),
+	}
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if len(st.recvBuf) > 0 {
+			n := copy(p, st.recvBuf)
+			st.recvBuf = st.recvBuf[n:]
+			// Re-advertise consumed bytes once half the window has been read.
+			var delta uint32
+			pending := muxInitialWindow - st.recvWindow - uint32(len(st.recvBuf))
+			if pending >= muxInitialWindow/2 && !st.remoteClosed {
+				delta = pending
+				st.recvWindow += pending
+			}
+			st.mu.Unlock()
+			if delta > 0 {
+				_ = st.session.writeFrame(muxTypeWindowUpdate, 0, st.id, delta, nil)
+			}
+			return n, nil
+		}
+		switch {
+		case st.reset:
+			st.mu.Unlock()
+			return 0, errMuxStreamReset
+		case st.localClosed:
+			st.mu.Unlock()
+			return 0, errMuxStreamClosed
+		case st.remoteClosed || st.session.isClosed():
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.recvNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.reset:
+			st.mu.Unlock()
+			return written, errMuxStreamReset
+		case st.localClosed:
+			st.mu.Unlock()
+			return written, errMuxStreamClosed
+		case st.session.isClosed():
+			st.mu.Unlock()
+			return written, st.session.err()
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.sendNotify, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(p), int(st.sendWindow), muxMaxFrameSize)
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(muxTypeData, 0, st.id, uint32(n), p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close fully closes the stream: a FIN is sent and further frames from the
+// peer are discarded, matching how frp joins work connections.
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	sendFIN := !st.reset
+	st.mu.Unlock()
+
+	st.notify()
+	st.session.removeStream(st.id)
+	if !sendFIN || st.session.isClosed() {
+		return nil
+	}
+	return st.session.writeFrame(muxTypeWindowUpdate, muxFlagFIN, st.id, 0, nil)
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.session.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.session.conn.RemoteAddr() }
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.writeDeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *muxStream) receive(r io.Reader, length uint32) error {
+	st.mu.Lock()
+	window := st.recvWindow
+	st.mu.Unlock()
+	if length > window {
+		return fmt.Errorf("mux: stream %d exceeded receive window", st.id)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	st.recvWindow -= length
+	st.recvBuf = append(st.recvBuf, buf...)
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *muxStream) growSendWindow(delta uint32) {
+	if delta == 0 {
+		return
+	}
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+	st.notify()
+}
+
+func (st *muxStream) handleFlags(flags uint16) {
+	if flags&(muxFlagFIN|muxFlagRST) == 0 {
+		return
+	}
+	st.mu.Lock()
+	if flags&muxFlagFIN != 0 {
+		st.remoteClosed = true
+	}
+	if flags&muxFlagRST != 0 {
+		st.reset = true
+	}
+	done := st.reset || (st.remoteClosed && st.localClosed)
+	st.mu.Unlock()
+
+	if done {
+		st.session.removeStream(st.id)
+	}
+	st.notify()
+}
+
+func (st *muxStream) notify() {
+	select {
+	case st.recvNotify <- struct{}{}:
+	default:
+	}
+	select {
+	case st.sendNotify <- struct{}{}:
+	default:
+	}
+}
+
+func (st *muxStream) wait(ch <-chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-st.session.closed:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
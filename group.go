@@ -0,0 +1,50 @@
+package main
+
+import "fmt"
+
+// applyGroupFlags applies --group and --group-key to every tcp and http
+// tunnel. Proxies in the same group (and with the same remote port or
+// domain) share the public address; frps spreads connections across them.
+func applyGroupFlags(proxies []ProxyConfig, group, groupKey string) error {
+	if group == "" {
+		if groupKey != "" {
+			return fmt.Errorf("error: --group-key needs --group")
+		}
+		return nil
+	}
+	applied := false
+	for i := range proxies {
+		if proxies[i].Type != "tcp" && proxies[i].Type != "http" {
+			continue
+		}
+		proxies[i].Group = group
+		proxies[i].GroupKey = groupKey
+		applied = true
+	}
+	if !applied {
+		return fmt.Errorf("error: --group needs a tcp or http tunnel")
+	}
+	return nil
+}
+
+// validateProxyGroup checks the load-balancing group of a proxy.
+func validateProxyGroup(proxy ProxyConfig) error {
+	if proxy.Group == "" {
+		if proxy.GroupKey != "" {
+			return fmt.Errorf("error: --group-key needs --group")
+		}
+		return nil
+	}
+	if proxy.Type != "tcp" && proxy.Type != "http" {
+		return fmt.Errorf("error: --group is only supported for tcp and http tunnels")
+	}
+	// Every member must register the same address, so it cannot be picked
+	// by frps or generated by kai.
+	if proxy.Type == "tcp" && proxy.RemotePort == 0 {
+		return fmt.Errorf("error: --group needs a fixed --remote-port for tcp tunnels")
+	}
+	if proxy.Type == "http" && proxy.AutoSubdomain {
+		return fmt.Errorf("error: --group needs a fixed --subdomain or --domain for http tunnels")
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateProxyGroup(t *testing.T) {
+	cases := []struct {
+		proxy   ProxyConfig
+		wantErr string
+	}{
+		{ProxyConfig{Type: "tcp", RemotePort: 6000, Group: "db", GroupKey: "k"}, ""},
+		{ProxyConfig{Type: "http", Subdomain: "web", Group: "web.v2"}, ""},
+		{ProxyConfig{Type: "tcp", Group: "db"}, "--remote-port"},
+		{ProxyConfig{Type: "http", Subdomain: "brave-otter-4821", AutoSubdomain: true, Group: "web"}, "--subdomain"},
+		{ProxyConfig{Type: "udp", RemotePort: 53, Group: "dns"}, "tcp and http"},
+		{ProxyConfig{Type: "tcp", RemotePort: 6000, Group: "db pool", GroupKey: `k"\`}, ""},
+		{ProxyConfig{Type: "tcp", RemotePort: 6000, GroupKey: "k"}, "needs --group"},
+	}
+	for _, tc := range cases {
+		err := validateProxyGroup(tc.proxy)
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Fatalf("validateProxyGroup(%+v) = %v, want %q", tc.proxy, err, tc.wantErr)
+		}
+	}
+
+	proxies := []ProxyConfig{{Type: "tcp"}, {Type: "udp"}}
+	if err := applyGroupFlags(proxies, "db", "k"); err != nil || proxies[0].Group != "db" || proxies[1].Group != "" {
+		t.Fatalf("--group should only apply to tcp and http tunnels: %+v, %v", proxies, err)
+	}
+}
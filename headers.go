@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// applyHTTPHeaderFlags applies --host-header-rewrite, --request-header and
+// --response-header to every http tunnel. frps performs the rewriting, so the
+// local service and the inspector see the rewritten request.
+func applyHTTPHeaderFlags(proxies []ProxyConfig, hostRewrite string, requestHeaders, responseHeaders []string) error {
+	if hostRewrite == "" && len(requestHeaders) == 0 && len(responseHeaders) == 0 {
+		return nil
+	}
+	reqSet, err := parseTunnelHeaders("--request-header", requestHeaders)
+	if err != nil {
+		return err
+	}
+	respSet, err := parseTunnelHeaders("--response-header", responseHeaders)
+	if err != nil {
+		return err
+	}
+
+	applied := false
+	for i := range proxies {
+		if proxies[i].Type != "http" {
+			continue
+		}
+		if hostRewrite != "" {
+			proxies[i].HostHeaderRewrite = hostRewrite
+		}
+		proxies[i].RequestHeaders = mergeHeaderSet(proxies[i].RequestHeaders, reqSet)
+		proxies[i].ResponseHeaders = mergeHeaderSet(proxies[i].ResponseHeaders, respSet)
+		applied = true
+	}
+	if !applied {
+		return fmt.Errorf("error: --host-header-rewrite, --request-header and --response-header need an http tunnel")
+	}
+	return nil
+}
+
+// parseTunnelHeaders parses "Key: Value" flags with the same rules as
+// `kai share --header`.
+func parseTunnelHeaders(flagName string, raw []string) (map[string]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	set := make(map[string]string, len(raw))
+	for _, line := range raw {
+		key, value, err := parseHeaderLine(flagName, line)
+		if err != nil {
+			return nil, fmt.Errorf("error: %w", err)
+		}
+		if !isHeaderToken(key) {
+			return nil, fmt.Errorf("error: invalid header name %q in %s", key, flagName)
+		}
+		if strings.IndexFunc(value, func(r rune) bool { return r < ' ' && r != '\t' || r == 0x7f }) >= 0 {
+			return nil, fmt.Errorf("error: %s value for %q must not contain control characters", flagName, key)
+		}
+		if isHopByHopHeader(key) || strings.EqualFold(key, "Host") {
+			return nil, fmt.Errorf("error: %s cannot set %q (use --host-header-rewrite for Host)", flagName, key)
+		}
+		set[textproto.CanonicalMIMEHeaderKey(key)] = value
+	}
+	return set, nil
+}
+
+// validateHostHeaderRewrite accepts host or host:port.
+func validateHostHeaderRewrite(host string) error {
+	if host == "" || strings.IndexFunc(host, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-.:[]", r))
+	}) >= 0 {
+		return fmt.Errorf("error: invalid --host-header-rewrite %q (use a host such as localhost or localhost:3000)", host)
+	}
+	return nil
+}
+
+// isHeaderToken reports whether name is a valid HTTP header field name.
+func isHeaderToken(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+func mergeHeaderSet(dst, src map[string]string) map[string]string {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = make(map[string]string, len(src))
+	}
+	for key, value := range src {
+		dst[key] = value
+	}
+	return dst
+}
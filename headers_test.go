@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyHTTPHeaderFlags(t *testing.T) {
+	proxies := []ProxyConfig{
+		{Type: "http", Subdomain: "web", LocalPort: 5173},
+		{Type: "tcp", RemotePort: 22022, LocalPort: 22},
+	}
+	err := applyHTTPHeaderFlags(proxies, "localhost:5173",
+		[]string{"x-forwarded-by: kai", "X-Env: dev, preview"},
+		[]string{"Cache-Control: no-store"})
+	if err != nil {
+		t.Fatalf("apply header flags: %v", err)
+	}
+	web := proxies[0]
+	if web.HostHeaderRewrite != "localhost:5173" || web.RequestHeaders["X-Forwarded-By"] != "kai" || web.RequestHeaders["X-Env"] != "dev, preview" {
+		t.Fatalf("unexpected http proxy: %+v", web)
+	}
+	if web.ResponseHeaders["Cache-Control"] != "no-store" {
+		t.Fatalf("unexpected response headers: %+v", web.ResponseHeaders)
+	}
+	if proxies[1].HostHeaderRewrite != "" || proxies[1].RequestHeaders != nil {
+		t.Fatalf("tcp proxy should be untouched: %+v", proxies[1])
+	}
+
+	if err := applyHTTPHeaderFlags([]ProxyConfig{{Type: "tcp"}}, "localhost", nil, nil); err == nil {
+		t.Fatalf("expected error without an http tunnel")
+	}
+	for _, raw := range []string{"X-Env", ": value", "Bad Name: v", "X-Line: a\r\nX-Injected: b", "Connection: close", "Host: example.com"} {
+		if _, err := parseTunnelHeaders("--request-header", []string{raw}); err == nil {
+			t.Fatalf("expected error for %q", raw)
+		}
+	}
+	if set, err := parseTunnelHeaders("--request-header", []string{`X-Quote: "v" \ w`}); err != nil || set["X-Quote"] != `"v" \ w` {
+		t.Fatalf("unexpected quoted header value: %+v, %v", set, err)
+	}
+	if _, err := parseTunnelHeaders("--request-header", []string{"X-Env"}); err == nil || !strings.Contains(err.Error(), "--request-header") {
+		t.Fatalf("error should name the flag, got %v", err)
+	}
+	if err := validateHostHeaderRewrite("http://localhost"); err == nil {
+		t.Fatalf("expected error for a URL in --host-header-rewrite")
+	}
+}
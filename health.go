@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	localCheckTimeout  = 2 * time.Second
+	localCheckInterval = 500 * time.Millisecond
+
+	// While the tunnel runs the local services are checked as often as
+	// frpc checks them, and a service is down after this many failures.
+	localHealthInterval  = 10 * time.Second
+	localHealthMaxFailed = 3
+)
+
+// applyHealthPathFlag applies --health-path to every tunnel kai sees plain
+// HTTP for.
+func applyHealthPathFlag(proxies []ProxyConfig, healthPath string) error {
+	if healthPath == "" {
+		return nil
+	}
+	applied := false
+	for i := range proxies {
+		if isLocalHTTPProxy(proxies[i]) {
+			proxies[i].HealthPath = healthPath
+			applied = true
+		}
+	}
+	if !applied {
+		return fmt.Errorf("error: --health-path needs an http tunnel (or https with --local-tls)")
+	}
+	return nil
+}
+
+// validateHealthPath checks that a health check path is a request path.
+func validateHealthPath(proxy ProxyConfig) error {
+	if proxy.HealthPath == "" {
+		return nil
+	}
+	if proxy.Type == "udp" {
+		return fmt.Errorf("error: health checks are not supported for udp tunnels")
+	}
+	if proxy.Type == "https" && !proxy.LocalTLS {
+		return fmt.Errorf("error: --health-path on https tunnels needs --local-tls")
+	}
+	if _, err := url.ParseRequestURI(proxy.HealthPath); err != nil || !strings.HasPrefix(proxy.HealthPath, "/") {
+		return fmt.Errorf("error: invalid health check path %q (must start with /)", proxy.HealthPath)
+	}
+	return nil
+}
+
+// checkLocalService probes the local service of a proxy the way frpc's health
+// check does: a TCP connect, or an HTTP GET of HealthPath that must return 2xx.
+func checkLocalService(ctx context.Context, proxy ProxyConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, localCheckTimeout)
+	defer cancel()
+	addr := net.JoinHostPort(proxy.LocalIP, strconv.Itoa(proxy.LocalPort))
+
+	if proxy.HealthPath == "" {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+proxy.HealthPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("GET %s returned %s", proxy.HealthPath, resp.Status)
+	}
+	return nil
+}
+
+// waitForLocalServices checks every proxy's local service before the tunnel
+// starts. With wait 0 a failed check is only reported; otherwise the checks
+// are repeated until they pass or wait runs out.
+func waitForLocalServices(ctx context.Context, proxies []ProxyConfig, wait time.Duration) error {
+	var deadline time.Time
+	if wait > 0 {
+		deadline = time.Now().Add(wait)
+	}
+	for _, proxy := range proxies {
+		// UDP has no connection to probe.
+		if proxy.Type == "udp" {
+			continue
+		}
+		addr := net.JoinHostPort(proxy.LocalIP, strconv.Itoa(proxy.LocalPort))
+		waiting := false
+		for {
+			err := checkLocalService(ctx, proxy)
+			if err == nil {
+				if waiting {
+					log.Printf("Local service %s is up", addr)
+				}
+				break
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if wait <= 0 {
+				log.Printf("Warning: local service %s for tunnel %q is not reachable (%v); visitors get an error until it is", addr, proxy.Name, err)
+				break
+			}
+			if time.Now().After(deadline) {
+				return &tunnelError{
+					Code:     "local_unavailable",
+					Message:  fmt.Sprintf("error: local service %s for tunnel %q not reachable after %s: %v", addr, proxy.Name, wait, err),
+					ExitCode: exitCodeTunnelLocalUnavailable,
+					Err:      err,
+					Proxy:    proxy.Name,
+				}
+			}
+			if !waiting {
+				log.Printf("Waiting up to %s for local service %s...", wait, addr)
+				waiting = true
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(localCheckInterval):
+			}
+		}
+	}
+	return nil
+}
+
+// localHealth keeps checking the local services of the TCP-based proxies
+// while the tunnel runs. A service is down after localHealthMaxFailed failed
+// checks in a row and up again after the first check that passes; watchers
+// are told about both changes.
+type localHealth struct {
+	proxies  []ProxyConfig
+	monitor  *tunnelMonitor
+	interval time.Duration
+
+	mu       sync.Mutex
+	down     map[string]bool
+	watchers map[int]func(name string, up bool)
+	nextID   int
+}
+
+func newLocalHealth(proxies []ProxyConfig, monitor *tunnelMonitor) *localHealth {
+	return &localHealth{
+		proxies:  proxies,
+		monitor:  monitor,
+		interval: localHealthInterval,
+		down:     make(map[string]bool),
+		watchers: make(map[int]func(string, bool)),
+	}
+}
+
+// watch calls fn whenever a local service goes down or comes back, until the
+// returned function is called.
+func (h *localHealth) watch(fn func(name string, up bool)) func() {
+	if h == nil {
+		return func() {}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id := h.nextID
+	h.nextID++
+	h.watchers[id] = fn
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.watchers, id)
+	}
+}
+
+// isUp reports whether the named proxy's local service is considered up.
+// Services are up until checks say otherwise.
+func (h *localHealth) isUp(name string) bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.down[name]
+}
+
+// run checks every local service until ctx is done.
+func (h *localHealth) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, proxy := range h.proxies {
+		// UDP has no connection to probe.
+		if proxy.Type == "udp" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.probe(ctx, proxy)
+		}()
+	}
+	wg.Wait()
+}
+
+func (h *localHealth) probe(ctx context.Context, proxy ProxyConfig) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	failed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := checkLocalService(ctx, proxy)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == nil:
+			failed = 0
+			h.set(proxy.Name, true)
+		default:
+			if failed++; failed >= localHealthMaxFailed {
+				h.set(proxy.Name, false)
+			}
+		}
+	}
+}
+
+func (h *localHealth) set(name string, up bool) {
+	h.mu.Lock()
+	if h.down[name] == !up {
+		h.mu.Unlock()
+		return
+	}
+	h.down[name] = !up
+	watchers := make([]func(string, bool), 0, len(h.watchers))
+	for _, fn := range h.watchers {
+		watchers = append(watchers, fn)
+	}
+	h.mu.Unlock()
+
+	if h.monitor != nil {
+		h.monitor.localHealthChanged(name, up)
+	}
+	for _, fn := range watchers {
+		fn(name, up)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateHealthPath(t *testing.T) {
+	cases := []struct {
+		proxy   ProxyConfig
+		wantErr bool
+	}{
+		{ProxyConfig{Type: "http", HealthPath: "/healthz"}, false},
+		{ProxyConfig{Type: "tcp", HealthPath: "/status?full=1"}, false},
+		{ProxyConfig{Type: "https", LocalTLS: true, HealthPath: "/"}, false},
+		{ProxyConfig{Type: "https", HealthPath: "/healthz"}, true},
+		{ProxyConfig{Type: "udp", HealthPath: "/healthz"}, true},
+		{ProxyConfig{Type: "http", HealthPath: "healthz"}, true},
+		{ProxyConfig{Type: "http", HealthPath: `/a"b\c`}, false},
+		{ProxyConfig{Type: "http", HealthPath: "/a\nb"}, true},
+	}
+	for _, tc := range cases {
+		if err := validateHealthPath(tc.proxy); (err != nil) != tc.wantErr {
+			t.Fatalf("validateHealthPath(%+v) = %v, wantErr %v", tc.proxy, err, tc.wantErr)
+		}
+	}
+
+	proxies := []ProxyConfig{{Type: "http"}, {Type: "tcp"}}
+	if err := applyHealthPathFlag(proxies, "/healthz"); err != nil || proxies[0].HealthPath != "/healthz" || proxies[1].HealthPath != "" {
+		t.Fatalf("--health-path should only apply to http tunnels: %+v, %v", proxies, err)
+	}
+	if err := applyHealthPathFlag([]ProxyConfig{{Type: "tcp"}}, "/healthz"); err == nil {
+		t.Fatalf("expected an error without an http tunnel")
+	}
+}
+
+func TestCheckLocalService(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().(*net.TCPAddr)
+	proxy := ProxyConfig{Name: "web", Type: "http", LocalIP: "127.0.0.1", LocalPort: addr.Port}
+
+	if err := checkLocalService(context.Background(), proxy); err != nil {
+		t.Fatalf("tcp check: %v", err)
+	}
+	proxy.HealthPath = "/healthz"
+	if err := checkLocalService(context.Background(), proxy); err != nil {
+		t.Fatalf("http check: %v", err)
+	}
+	proxy.HealthPath = "/other"
+	if err := checkLocalService(context.Background(), proxy); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected a failed http check, got %v", err)
+	}
+}
+
+func TestWaitForLocalServices(t *testing.T) {
+	buf := captureLog(t)
+	port := freeTCPPort(t)
+	proxies := []ProxyConfig{
+		{Name: "web", Type: "http", LocalIP: "127.0.0.1", LocalPort: port},
+		{Name: "dns", Type: "udp", LocalIP: "127.0.0.1", LocalPort: port},
+	}
+
+	if err := waitForLocalServices(context.Background(), proxies, 0); err != nil {
+		t.Fatalf("without --wait-local a down service only warns, got %v", err)
+	}
+	if !strings.Contains(buf.String(), "not reachable") {
+		t.Fatalf("expected a warning, got %q", buf.String())
+	}
+
+	err := waitForLocalServices(context.Background(), proxies, 300*time.Millisecond)
+	var tunnelErr *tunnelError
+	if !errors.As(err, &tunnelErr) || tunnelErr.Code != "local_unavailable" || tunnelErr.ExitCode != exitCodeTunnelLocalUnavailable {
+		t.Fatalf("expected local_unavailable, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { ln.Close() })
+	}()
+	if err := waitForLocalServices(context.Background(), proxies, 5*time.Second); err != nil {
+		t.Fatalf("expected the service to come up, got %v", err)
+	}
+	if !strings.Contains(buf.String(), "is up") {
+		t.Fatalf("expected an up message, got %q", buf.String())
+	}
+}
+
+func TestTunnelMonitorTracksHealthChecks(t *testing.T) {
+	buf := captureLog(t)
+	monitor := newTunnelMonitor(TunnelConfig{ServerAddr: "p.ranax.co", Proxies: []ProxyConfig{{Name: "web", Type: "http", Subdomain: "web"}}})
+
+	_ = monitor.observeFrpcLine("2025-01-01 10:00:00.000 [I] [proxy/proxy_wrapper.go:229] [7c1b] [web] health check failed")
+	if got := monitor.snapshot().ProxyErrors["web"]; got != "local service health check failed" {
+		t.Fatalf("expected a health check error, got %q", got)
+	}
+	_ = monitor.observeFrpcLine("2025-01-01 10:00:10.000 [I] [proxy/proxy_wrapper.go:215] [7c1b] [web] health check success")
+	if got := monitor.snapshot().ProxyErrors["web"]; got != "" {
+		t.Fatalf("expected the error to clear, got %q", got)
+	}
+	if !strings.Contains(buf.String(), "healthy again") {
+		t.Fatalf("expected a recovery message, got %q", buf.String())
+	}
+}
+
+func freeTCPPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	_ "embed"
-	"bufio"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -15,43 +17,213 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"text/template"
 	"time"
 )
 
 const DefaultToken = "@st@r@nje"
 const frpcConfigTemplate = `
-serverAddr = "{{ .ServerAddr }}"
+serverAddr = {{ toml .ServerAddr }}
 serverPort = {{ .ServerPort }}
+{{- with .Transport }}
+
+transport.protocol   = {{ toml (or .Protocol "tcp") }}
+transport.tls.enable = {{ .TLS }}
+{{- if .PoolCount }}
+transport.poolCount  = {{ .PoolCount }}
+{{- end }}
+{{- if .TLSCAFile }}
+transport.tls.trustedCaFile = {{ toml .TLSCAFile }}
+{{- end }}
+{{- if .TLSCertFile }}
+transport.tls.certFile = {{ toml .TLSCertFile }}
+transport.tls.keyFile  = {{ toml .TLSKeyFile }}
+{{- end }}
+{{- if .TLSServerName }}
+transport.tls.serverName = {{ toml .TLSServerName }}
+{{- end }}
+{{- end }}
+{{- with .Admin }}
+
+webServer.addr     = "127.0.0.1"
+webServer.port     = {{ .Port }}
+webServer.user     = {{ toml .User }}
+webServer.password = {{ toml .Password }}
+{{- end }}
 
 [auth]
 method = "token"
-token  = "{{ .Token }}"
+token  = {{ toml .Token }}
+{{- range .Proxies }}
 
 [[proxies]]
-name      = "{{ .ProxyName }}"
-type      = "{{ .Type }}"
-localIP   = "{{ .LocalIP }}"
+name      = {{ toml .Name }}
+type      = {{ toml .Type }}
+localIP   = {{ toml .LocalIP }}
 localPort = {{ .LocalPort }}
-{{- if eq .Type "http" }}
-subdomain = "{{ .Subdomain }}"
+{{- if .Subdomain }}
+subdomain = {{ toml .Subdomain }}
 {{- end }}
-{{- if eq .Type "tcp" }}
+{{- if .CustomDomains }}
+customDomains = [{{ range $i, $domain := .CustomDomains }}{{ if $i }}, {{ end }}{{ toml $domain }}{{ end }}]
+{{- end }}
+{{- if .HTTPUser }}
+httpUser     = {{ toml .HTTPUser }}
+httpPassword = {{ toml .HTTPPassword }}
+{{- end }}
+{{- if .HostHeaderRewrite }}
+hostHeaderRewrite = {{ toml .HostHeaderRewrite }}
+{{- end }}
+{{- range $key, $value := .RequestHeaders }}
+requestHeaders.set.{{ toml $key }} = {{ toml $value }}
+{{- end }}
+{{- range $key, $value := .ResponseHeaders }}
+responseHeaders.set.{{ toml $key }} = {{ toml $value }}
+{{- end }}
+{{- if or (eq .Type "tcp") (eq .Type "udp") }}
 remotePort = {{ .RemotePort }}
 {{- end }}
+{{- if or (eq .Type "stcp") (eq .Type "xtcp") }}
+secretKey = {{ toml .SecretKey }}
+{{- end }}
+{{- if .UseEncryption }}
+transport.useEncryption = true
+{{- end }}
+{{- if .UseCompression }}
+transport.useCompression = true
+{{- end }}
+{{- if .BandwidthLimit }}
+transport.bandwidthLimit     = {{ toml .BandwidthQuantity }}
+transport.bandwidthLimitMode = {{ toml (or .BandwidthLimitMode "client") }}
+{{- end }}
+{{- if .Group }}
+loadBalancer.group    = {{ toml .Group }}
+{{- if .GroupKey }}
+loadBalancer.groupKey = {{ toml .GroupKey }}
+{{- end }}
+{{- end }}
+{{- if .LocalTLS }}
+plugin.type      = "https2http"
+plugin.localAddr = {{ toml (printf "%s:%d" .LocalIP .LocalPort) }}
+plugin.crtPath   = {{ toml .TLSCertFile }}
+plugin.keyPath   = {{ toml .TLSKeyFile }}
+{{- end }}
+{{- if ne .Type "udp" }}
+healthCheck.type            = "tcp"
+healthCheck.intervalSeconds = 10
+healthCheck.maxFailed       = 1
+healthCheck.timeoutSeconds  = 3
+{{- end }}
+{{- end }}
+{{- range .Visitors }}
+
+[[visitors]]
+name       = {{ toml .Name }}
+type       = {{ toml .Type }}
+serverName = {{ toml .ServerName }}
+secretKey  = {{ toml .SecretKey }}
+bindAddr   = {{ toml .BindAddr }}
+bindPort   = {{ .BindPort }}
+{{- if .UseEncryption }}
+transport.useEncryption = true
+{{- end }}
+{{- if .UseCompression }}
+transport.useCompression = true
+{{- end }}
+{{- end }}
 `
 
 type TunnelConfig struct {
 	ServerAddr string
 	ServerPort int
 	Token      string
+	Engine     string
+	Output     string
+
+	// MaxRestarts is the restart budget for the supervisor: 0 disables
+	// restarts and a negative value restarts forever.
+	MaxRestarts int
 
-	ProxyName  string
+	Transport TransportConfig
+
+	Inspect InspectConfig
+
+	// WaitLocal is how long to wait for the local services before starting
+	// the tunnel. 0 checks once and only warns.
+	WaitLocal time.Duration
+
+	// Tunnels are the `kai up` profile names, used by `kai ls` and
+	// `kai stop` to find the process.
+	Tunnels []string
+
+	// Admin enables frpc's admin API, which kai queries for details frpc
+	// does not log, such as server-assigned remote ports.
+	Admin *frpcAdmin
+
+	// Traffic counts the bytes of every TCP-based proxy for `kai status`.
+	// Health keeps checking the local services while the tunnel runs.
+	Traffic trafficStats
+	Health  *localHealth
+
+	Proxies  []ProxyConfig
+	Visitors []VisitorConfig
+}
+
+type ProxyConfig struct {
+	Name       string
 	Type       string
 	LocalIP    string
 	LocalPort  int
 	Subdomain  string
 	RemotePort int
+	SecretKey  string
+
+	// AutoSubdomain marks a Subdomain kai generated, which is replaced if
+	// frps reports it as taken.
+	AutoSubdomain bool
+
+	// CustomDomains are full host names (CNAMEd to the frps host) served
+	// by an http/https proxy in addition to, or instead of, Subdomain.
+	CustomDomains []string
+
+	// LocalTLS terminates TLS in kai for https proxies and forwards plain
+	// HTTP to the local service. Without a cert/key pair a self-signed
+	// certificate is generated.
+	LocalTLS    bool
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// HTTPUser/HTTPPassword make frps require HTTP basic auth. AccessToken
+	// makes kai's local front require ?kai_token=... or its cookie instead.
+	HTTPUser     string
+	HTTPPassword string
+	AccessToken  string
+
+	// HostHeaderRewrite, RequestHeaders and ResponseHeaders are applied by
+	// frps on http proxies. The header maps set (replace) values.
+	HostHeaderRewrite string
+	RequestHeaders    map[string]string
+	ResponseHeaders   map[string]string
+
+	// UseEncryption and UseCompression encrypt (with the token) and
+	// snappy-compress the traffic between kai and frps.
+	UseEncryption  bool
+	UseCompression bool
+
+	// BandwidthLimit caps the proxy's traffic in bytes per second. It is
+	// enforced by the client ("client" mode, the default) or by frps.
+	BandwidthLimit     int64
+	BandwidthLimitMode string
+
+	// Group and GroupKey put the proxy into an frps load-balancing group
+	// with the proxies of other clients that use the same address.
+	Group    string
+	GroupKey string
+
+	// HealthPath switches the local service check from a TCP connect to an
+	// HTTP GET. The proxy is withdrawn from frps while the check fails.
+	HealthPath string
 }
 
 type tunnelDefaults struct {
@@ -59,6 +231,16 @@ type tunnelDefaults struct {
 	ServerPort int
 	Token      string
 	LocalHost  string
+	Engine     string
+	Profiles   []tunnelProfile
+
+	Transport       TransportConfig
+	hasTransportTLS bool
+	UseEncryption   bool
+	UseCompression  bool
+
+	MaxRestarts    int
+	hasMaxRestarts bool
 }
 
 func main() {
@@ -66,19 +248,81 @@ func main() {
 		os.Exit(runShare(os.Args[2:]))
 	}
 
-	if err := runTunnel(os.Args[1:]); err != nil {
+	run := runTunnel
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "up":
+			run = runUp
+			args = args[1:]
+		case "connect":
+			run = runConnect
+			args = args[1:]
+		case "replay":
+			run = runReplay
+			args = args[1:]
+		case "status":
+			run = runStatus
+			args = args[1:]
+		case "ls":
+			run = runLs
+			args = args[1:]
+		case "stop":
+			run = runStop
+			args = args[1:]
+		case "serve":
+			run = runServe
+			args = args[1:]
+		case "receive":
+			run = runReceive
+			args = args[1:]
+		case "webhook":
+			run = runWebhook
+			args = args[1:]
+		case "run":
+			run = runRun
+			args = args[1:]
+		}
+	}
+
+	if err := run(args); err != nil {
 		if errors.Is(err, flag.ErrHelp) {
 			return
 		}
+		var tunnelErr *tunnelError
+		if errors.As(err, &tunnelErr) {
+			log.Print(err)
+			os.Exit(tunnelErr.ExitCode)
+		}
+		// The command's own output already explains its failure.
+		var exitErr *commandExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		log.Fatal(err)
 	}
 }
 
 func runTunnel(args []string) error {
-	defaults, err := loadTunnelDefaults()
+	return runTunnelContext(context.Background(), args)
+}
+
+// runTunnelContext is runTunnel for commands that run the tunnel next to
+// something else. Cancelling ctx stops the tunnel like Ctrl+C.
+func runTunnelContext(ctx context.Context, args []string) error {
+	cfg, err := parseTunnelArgs(args)
 	if err != nil {
 		return err
 	}
+	return startTunnelContext(ctx, cfg)
+}
+
+// parseTunnelArgs builds the tunnel config from the flags of `kai`.
+func parseTunnelArgs(args []string) (TunnelConfig, error) {
+	defaults, err := loadTunnelDefaults()
+	if err != nil {
+		return TunnelConfig{}, err
+	}
 
 	fs := flag.NewFlagSet("kai", flag.ContinueOnError)
 	fs.SetOutput(os.Stderr)
@@ -86,39 +330,358 @@ func runTunnel(args []string) error {
 		printMainUsage(fs)
 	}
 
-	sub := fs.String("subdomain", "", "Subdomain (required for http tunnel)")
+	var httpSpecs repeatableValue
+	var tcpSpecs repeatableValue
+	var udpSpecs repeatableValue
+	var domains repeatableValue
+	var requestHeaders repeatableValue
+	var responseHeaders repeatableValue
+
+	sub := fs.String("subdomain", "", "Subdomain for http/https tunnels (random if omitted)")
+	subFromGit := fs.Bool("subdomain-from-git", false, "Derive missing subdomains from the git repository and branch")
 	port := fs.Int("p", 0, "Local port")
-	ttype := fs.String("type", "http", "Tunnel type: http or tcp")
-	server := fs.String("server", defaults.Server, "FRPS server")
-	serverPort := fs.Int("server-port", defaults.ServerPort, "FRPS port")
-	token := fs.String("token", defaults.Token, "Auth token")
-	localHost := fs.String("local-host", defaults.LocalHost, "Local host")
-	remotePort := fs.Int("remote-port", 0, "Remote port (TCP only)")
+	ttype := fs.String("type", "http", "Tunnel type: http, https, tcp, udp, stcp or xtcp")
+	conn := registerConnectionFlags(fs, defaults)
+	inspect := registerInspectFlags(fs)
+	remotePort := fs.Int("remote-port", 0, "Remote port for TCP/UDP tunnels (0 or omitted: assigned by the server)")
+	name := fs.String("name", "", "Proxy name (visitors connect to stcp/xtcp tunnels by this name)")
+	secret := fs.String("secret", "", "Shared secret key (stcp/xtcp only)")
+	localTLS := fs.Bool("local-tls", false, "Terminate TLS in kai for https tunnels and forward plain HTTP locally")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file for --local-tls (self-signed if omitted)")
+	tlsKey := fs.String("tls-key", "", "TLS private key file for --local-tls")
+	basicAuth := fs.String("basic-auth", "", "Require HTTP basic auth on http tunnels (user:pass)")
+	accessToken := fs.String("access-token", "", "Require ?kai_token=<token> (then a cookie) on http tunnels")
+	hostRewrite := fs.String("host-header-rewrite", "", "Rewrite the Host header of http tunnel requests (e.g. localhost:3000)")
+	healthPath := fs.String("health-path", "", "Check the local service with GET <path> instead of a TCP connect; frpc withdraws the tunnel while it fails")
+	waitLocal := fs.Duration("wait-local", 0, "Wait up to this long for the local service before starting the tunnel (e.g. 60s)")
+	bandwidthLimit := fs.String("bandwidth-limit", "", "Limit each tunnel's traffic per second (e.g. 512KB, 2MB)")
+	bandwidthMode := fs.String("bandwidth-limit-mode", "", "Where the bandwidth limit is enforced: client (default) or server")
+	group := fs.String("group", "", "Join a load-balancing group with other clients using the same remote port or subdomain")
+	groupKey := fs.String("group-key", "", "Shared key that members of --group must present")
+
+	fs.Var(&domains, "domain", "Custom domain for the http/https tunnel, repeatable (CNAME it to the FRPS host)")
+	fs.Var(&httpSpecs, "http", "HTTP tunnel, repeatable (subdomain:port or domain:port)")
+	fs.Var(&tcpSpecs, "tcp", "TCP tunnel, repeatable (remote-port:local-port)")
+	fs.Var(&udpSpecs, "udp", "UDP tunnel, repeatable (remote-port:local-port)")
+	fs.Var(&requestHeaders, "request-header", "Set a request header on http tunnels, repeatable (\"Key: Value\")")
+	fs.Var(&responseHeaders, "response-header", "Set a response header on http tunnels, repeatable (\"Key: Value\")")
 
 	if err := fs.Parse(args); err != nil {
+		return TunnelConfig{}, err
+	}
+
+	var proxies []ProxyConfig
+	if *port != 0 {
+		proxies = append(proxies, ProxyConfig{
+			Name:          *name,
+			Type:          *ttype,
+			LocalIP:       *conn.localHost,
+			LocalPort:     *port,
+			Subdomain:     *sub,
+			CustomDomains: domains,
+			RemotePort:    *remotePort,
+			SecretKey:     *secret,
+			LocalTLS:      *localTLS,
+			TLSCertFile:   *tlsCert,
+			TLSKeyFile:    *tlsKey,
+		})
+	} else if len(domains) > 0 {
+		return TunnelConfig{}, fmt.Errorf("error: --domain applies to the -p tunnel (use --http domain:port for multiple tunnels)")
+	}
+	for _, spec := range httpSpecs {
+		proxy, err := parseProxySpec("http", spec, *conn.localHost)
+		if err != nil {
+			return TunnelConfig{}, err
+		}
+		proxies = append(proxies, proxy)
+	}
+	for _, spec := range tcpSpecs {
+		proxy, err := parseProxySpec("tcp", spec, *conn.localHost)
+		if err != nil {
+			return TunnelConfig{}, err
+		}
+		proxies = append(proxies, proxy)
+	}
+	for _, spec := range udpSpecs {
+		proxy, err := parseProxySpec("udp", spec, *conn.localHost)
+		if err != nil {
+			return TunnelConfig{}, err
+		}
+		proxies = append(proxies, proxy)
+	}
+
+	if len(proxies) == 0 {
+		return TunnelConfig{}, fmt.Errorf("error: -p is required (or use --http / --tcp / --udp)")
+	}
+	if err := applyHTTPAuthFlags(proxies, *basicAuth, *accessToken); err != nil {
+		return TunnelConfig{}, err
+	}
+	if err := applyHTTPHeaderFlags(proxies, *hostRewrite, requestHeaders, responseHeaders); err != nil {
+		return TunnelConfig{}, err
+	}
+	if err := applyHealthPathFlag(proxies, *healthPath); err != nil {
+		return TunnelConfig{}, err
+	}
+	if err := applyBandwidthFlags(proxies, *bandwidthLimit, *bandwidthMode); err != nil {
+		return TunnelConfig{}, err
+	}
+	if err := applyGroupFlags(proxies, *group, *groupKey); err != nil {
+		return TunnelConfig{}, err
+	}
+	if err := assignSubdomains(proxies, *subFromGit); err != nil {
+		return TunnelConfig{}, err
+	}
+	for _, proxy := range proxies {
+		if err := validateProxy(proxy); err != nil {
+			return TunnelConfig{}, err
+		}
+	}
+	assignProxyNames(proxies, time.Now().Unix())
+
+	cfg := conn.tunnelConfig(proxies)
+	cfg.WaitLocal = *waitLocal
+	if cfg.Inspect, err = inspect.config(); err != nil {
+		return TunnelConfig{}, err
+	}
+	return cfg, nil
+}
+
+type connectionFlags struct {
+	server     *string
+	serverPort *int
+	token      *string
+	localHost  *string
+	engine     *string
+	output     *string
+
+	maxRestarts *int
+
+	protocol       *string
+	poolCount      *int
+	tls            *bool
+	tlsCA          *string
+	tlsClientCert  *string
+	tlsClientKey   *string
+	tlsServerName  *string
+	useEncryption  *bool
+	useCompression *bool
+}
+
+// registerConnectionFlags adds the FRPS/local flags shared by every tunnel command.
+func registerConnectionFlags(fs *flag.FlagSet, defaults tunnelDefaults) connectionFlags {
+	return connectionFlags{
+		server:     fs.String("server", defaults.Server, "FRPS server"),
+		serverPort: fs.Int("server-port", defaults.ServerPort, "FRPS port"),
+		token:      fs.String("token", defaults.Token, "Auth token"),
+		localHost:  fs.String("local-host", defaults.LocalHost, "Local host"),
+		engine:     fs.String("engine", defaults.Engine, "Tunnel engine: auto, frpc (embedded binary) or native (in-process)"),
+		output:     fs.String("output", "text", "Output format: text or json (newline-delimited events on stdout)"),
+
+		maxRestarts: fs.Int("max-restarts", defaults.MaxRestarts, "Restarts before giving up when the tunnel exits (0 disables, -1 unlimited)"),
+
+		protocol:       fs.String("protocol", defaults.Transport.Protocol, "Protocol to FRPS: tcp, kcp, quic, websocket or wss (default tcp)"),
+		poolCount:      fs.Int("pool-count", defaults.Transport.PoolCount, "Work connections to open in advance"),
+		tls:            fs.Bool("tls", defaults.Transport.TLS, "Use TLS for the connection to FRPS"),
+		tlsCA:          fs.String("tls-ca", defaults.Transport.TLSCAFile, "CA file to verify the FRPS certificate (unverified if omitted)"),
+		tlsClientCert:  fs.String("tls-client-cert", defaults.Transport.TLSCertFile, "Client certificate for mutual TLS with FRPS"),
+		tlsClientKey:   fs.String("tls-client-key", defaults.Transport.TLSKeyFile, "Client key for mutual TLS with FRPS"),
+		tlsServerName:  fs.String("tls-server-name", defaults.Transport.TLSServerName, "Server name to verify the FRPS certificate against (default --server)"),
+		useEncryption:  fs.Bool("use-encryption", defaults.UseEncryption, "Encrypt tunnel traffic between kai and FRPS with the token"),
+		useCompression: fs.Bool("use-compression", defaults.UseCompression, "Compress tunnel traffic between kai and FRPS (frpc engine)"),
+	}
+}
+
+func (c connectionFlags) tunnelConfig(proxies []ProxyConfig) TunnelConfig {
+	token := *c.token
+	if token == "" {
+		token = DefaultToken
+	}
+	for i := range proxies {
+		proxies[i].UseEncryption = proxies[i].UseEncryption || *c.useEncryption
+		proxies[i].UseCompression = proxies[i].UseCompression || *c.useCompression
+	}
+	return TunnelConfig{
+		ServerAddr: *c.server,
+		ServerPort: *c.serverPort,
+		Token:      token,
+		Engine:     *c.engine,
+		Output:     *c.output,
+		Proxies:    proxies,
+
+		MaxRestarts: *c.maxRestarts,
+
+		Transport: TransportConfig{
+			Protocol:      *c.protocol,
+			PoolCount:     *c.poolCount,
+			TLS:           *c.tls,
+			TLSCAFile:     *c.tlsCA,
+			TLSCertFile:   *c.tlsClientCert,
+			TLSKeyFile:    *c.tlsClientKey,
+			TLSServerName: *c.tlsServerName,
+		},
+	}
+}
+
+func startTunnel(cfg TunnelConfig) error {
+	return startTunnelContext(context.Background(), cfg)
+}
+
+func startTunnelContext(ctx context.Context, cfg TunnelConfig) error {
+	if cfg.Output != "text" && cfg.Output != "json" {
+		return fmt.Errorf("error: --output must be text or json")
+	}
+	if err := validateTransport(&cfg.Transport); err != nil {
+		return err
+	}
+	engine, err := resolveEngine(cfg.Engine)
+	if err != nil {
 		return err
 	}
 
-	if *token == "" {
-		*token = DefaultToken
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Println("Starting tunnel...")
+	server := net.JoinHostPort(cfg.ServerAddr, strconv.Itoa(cfg.ServerPort))
+	monitor := newTunnelMonitor(cfg)
+	monitor.events.emit(tunnelEvent{Event: "starting", Engine: engine, Server: server})
+
+	var insp *inspector
+	if cfg.Inspect.Enabled {
+		if insp, err = startInspector(cfg.Inspect); err != nil {
+			return err
+		}
+		defer insp.Close()
+		log.Printf("Inspector running at %s", insp.URL())
+		monitor.events.emit(tunnelEvent{Event: "inspector_ready", URL: insp.URL()})
 	}
 
-	if *port == 0 {
-		return fmt.Errorf("error: -p is required")
+	cfg.Traffic = newTrafficStats(cfg.Proxies)
+	cfg.Health = newLocalHealth(cfg.Proxies, monitor)
+
+	// The engine sees the local fronts' addresses instead of the configured
+	// local services when kai handles HTTP itself. frpc also goes through
+	// the traffic relays, which count what it forwards.
+	fronts, engineCfg, err := startLocalFronts(cfg, insp)
+	if err != nil {
+		return err
+	}
+	defer fronts.Close()
+	// A relay that fails ends the tunnel with its error as the cause.
+	ctx, fail := context.WithCancelCause(ctx)
+	defer fail(nil)
+	if engine == "frpc" {
+		var relays *trafficRelays
+		if relays, engineCfg, err = startTrafficRelays(engineCfg, fail); err != nil {
+			return fmt.Errorf("error: traffic relay listen: %w", err)
+		}
+		defer relays.Close()
+	}
+
+	// The frpc binary is extracted into a temp dir that is recorded in the run
+	// state, so `kai stop` can remove it if this process has to be killed.
+	var tmp string
+	if engine == "frpc" {
+		if tmp, err = os.MkdirTemp("", frpcTempPrefix); err != nil {
+			return fmt.Errorf("temp dir error: %w", err)
+		}
+		if engineCfg.Admin, err = newFrpcAdmin(); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
 	}
-	if *ttype == "http" && *sub == "" {
-		return fmt.Errorf("error: --subdomain is required for HTTP tunnels")
+
+	status := &statusServer{
+		state:   newRunState(cfg, engine, server, tmp),
+		cfg:     cfg,
+		monitor: monitor,
+		admin:   engineCfg.Admin,
+		stop:    stop,
 	}
-	if *ttype == "tcp" && *remotePort == 0 {
-		return fmt.Errorf("error: --remote-port is required for TCP tunnels")
+	if insp != nil {
+		status.inspector = insp.URL()
 	}
+	if err := status.start(); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	// The state file goes last: `kai stop` waits for it to disappear.
+	defer status.Close()
+	if tmp != "" {
+		defer os.RemoveAll(tmp)
+	}
+
+	// Visitors should not be sent to a local service that is not there.
+	if err := waitForLocalServices(ctx, cfg.Proxies, cfg.WaitLocal); err != nil {
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		monitor.events.emitError(err)
+		return err
+	}
+	go cfg.Health.run(ctx)
+
+	for retries := 0; ; retries++ {
+		if engine == "native" {
+			err = superviseTunnel(ctx, defaultRestartPolicy(cfg.MaxRestarts), "native client", monitor.events, func(ctx context.Context) error {
+				monitor.reset()
+				err := runNativeTunnel(ctx, engineCfg, monitor)
+				monitor.runExited(err)
+				return err
+			})
+		} else {
+			err = runFrpcTunnel(ctx, engineCfg, tmp, monitor)
+		}
 
-	tmp, err := os.MkdirTemp("", "pclient-")
+		// A generated subdomain that is already taken is replaced and the
+		// tunnel started again.
+		var tunnelErr *tunnelError
+		if retries >= maxSubdomainRetries || !errors.As(err, &tunnelErr) || tunnelErr.Code != "subdomain_in_use" {
+			break
+		}
+		oldName, newName, ok := retrySubdomain(tunnelErr.Proxy, &cfg, &engineCfg)
+		if !ok {
+			break
+		}
+		log.Printf("Subdomain %q is taken, retrying as %q", oldName, newName)
+		monitor.setSubdomain(tunnelErr.Proxy, newName)
+		status.updateURLs(cfg)
+	}
+	var relayErr *tunnelError
+	if cause := context.Cause(ctx); err == nil && errors.As(cause, &relayErr) {
+		err = relayErr
+	}
 	if err != nil {
-		return fmt.Errorf("temp dir error: %w", err)
+		monitor.events.emitError(err)
+		return err
 	}
-	defer os.RemoveAll(tmp)
+	monitor.events.emit(tunnelEvent{Event: "stopped"})
+	return nil
+}
 
+// resolveEngine picks how the tunnel is run. "auto" prefers the embedded frpc
+// binary and falls back to the native client in builds without one.
+func resolveEngine(engine string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(engine)) {
+	case "", "auto":
+		if len(frpcBinary) == 0 {
+			return "native", nil
+		}
+		return "frpc", nil
+	case "frpc":
+		if len(frpcBinary) == 0 {
+			return "", fmt.Errorf("error: this kai build has no embedded frpc (use --engine native)")
+		}
+		return "frpc", nil
+	case "native":
+		return "native", nil
+	default:
+		return "", fmt.Errorf("error: --engine must be auto, frpc or native")
+	}
+}
+
+// runFrpcTunnel extracts frpc into tmp and supervises it.
+func runFrpcTunnel(ctx context.Context, cfg TunnelConfig, tmp string, monitor *tunnelMonitor) error {
 	frpcName := "frpc"
 	if runtime.GOOS == "windows" {
 		frpcName = "frpc.exe"
@@ -129,62 +692,398 @@ func runTunnel(args []string) error {
 		return fmt.Errorf("write frpc error: %w", err)
 	}
 
-	cfg := TunnelConfig{
-		ServerAddr: *server,
-		ServerPort: *serverPort,
-		Token:      *token,
-		ProxyName:  fmt.Sprintf("%s-%d-%d", *ttype, *port, time.Now().Unix()),
-		Type:       *ttype,
-		LocalIP:    *localHost,
-		LocalPort:  *port,
-		Subdomain:  *sub,
-		RemotePort: *remotePort,
+	proxies, err := writeLocalTLSFiles(tmp, cfg)
+	if err != nil {
+		return err
+	}
+	cfg.Proxies = proxies
+	if cfg.Admin == nil {
+		if cfg.Admin, err = newFrpcAdmin(); err != nil {
+			return err
+		}
 	}
 
-	var buf bytes.Buffer
-	tmpl := template.Must(template.New("cfg").Parse(frpcConfigTemplate))
-	if err := tmpl.Execute(&buf, cfg); err != nil {
-		return fmt.Errorf("render config error: %w", err)
+	rendered, err := renderFrpcConfig(cfg)
+	if err != nil {
+		return err
 	}
 
 	configPath := filepath.Join(tmp, "frpc.toml")
-	if err := os.WriteFile(configPath, buf.Bytes(), 0600); err != nil {
+	if err := os.WriteFile(configPath, rendered, 0600); err != nil {
 		return fmt.Errorf("write config error: %w", err)
 	}
 
-	cmd := exec.Command(frpcPath, "-c", configPath)
-	cmd.Stdout = os.Stdout
+	// The extracted binary and rendered config are reused across restarts.
+	return superviseTunnel(ctx, defaultRestartPolicy(cfg.MaxRestarts), "frpc", monitor.events, func(ctx context.Context) error {
+		monitor.reset()
+		err := runFrpcProcess(ctx, frpcPath, configPath, cfg.Admin, monitor)
+		monitor.runExited(err)
+		return err
+	})
+}
+
+// runFrpcProcess runs frpc once, passing its output through while watching it
+// for login and proxy registration results. A permanent failure stops frpc and
+// is returned as a tunnelError.
+func runFrpcProcess(ctx context.Context, frpcPath, configPath string, admin *frpcAdmin, monitor *tunnelMonitor) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, frpcPath, "-c", configPath)
 	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("frpc output error: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start frpc error: %w", err)
+	}
 
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt)
-	defer signal.Stop(sig)
-	go func() {
-		<-sig
-		if cmd.Process != nil {
-			_ = cmd.Process.Kill()
+	var fatal error
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Fprintln(monitor.events.engineOutput(), line)
+		// frpc does not log server-assigned ports, so they are read from the
+		// admin API before the proxy is announced.
+		if match := frpcProxySuccessPattern.FindStringSubmatch(line); match != nil && monitor.needsRemotePort(match[1]) {
+			if port, err := admin.waitRemotePort(ctx, match[1]); err != nil {
+				log.Printf("Could not read the remote port of %q: %v", match[1], err)
+			} else {
+				monitor.assignRemotePort(match[1], port)
+			}
+		}
+		if fatal == nil {
+			if fatal = monitor.observeFrpcLine(line); fatal != nil {
+				cancel()
+			}
 		}
-	}()
+	}
 
-	log.Println("Starting tunnel...")
-	if *ttype == "http" {
-		log.Printf("Tunnel is running! Access it at %s.p.ranax.co\nPress Cmd+C to stop client.", *sub)
+	err = cmd.Wait()
+	if fatal != nil {
+		return fatal
+	}
+	if err != nil {
+		return fmt.Errorf("frpc exited: %w", err)
+	}
+	return nil
+}
+
+func logTunnelStarted(cfg TunnelConfig) {
+	if len(cfg.Proxies) > 0 {
+		log.Println("Tunnel is running! Access it at:")
+	}
+	for _, proxy := range cfg.Proxies {
+		if isSecretProxyType(proxy.Type) {
+			log.Printf("  %s %q -> %s:%d (visitors: kai connect %s --type %s --secret <key> --bind 127.0.0.1:<port>)",
+				proxy.Type, proxy.Name, proxy.LocalIP, proxy.LocalPort, proxy.Name, proxy.Type)
+			continue
+		}
+		for _, addr := range publicAddresses(cfg.ServerAddr, proxy) {
+			if proxy.AccessToken != "" {
+				log.Printf("  %s -> %s:%d (share: %s)", addr, proxy.LocalIP, proxy.LocalPort, withAccessToken(addr, proxy.AccessToken))
+				continue
+			}
+			log.Printf("  %s -> %s:%d", addr, proxy.LocalIP, proxy.LocalPort)
+		}
+	}
+	for _, visitor := range cfg.Visitors {
+		log.Printf("Visitor is running! Connect to %s:%d for %s %q", visitor.BindAddr, visitor.BindPort, visitor.Type, visitor.ServerName)
+	}
+	log.Println("Press Ctrl+C to stop client.")
+}
+
+// parseProxySpec parses a --http (subdomain:port or domain:port) or
+// --tcp/--udp (remote:local) value. A --http name containing a dot is a
+// custom domain, since subdomains cannot contain one.
+func parseProxySpec(proxyType, spec, localHost string) (ProxyConfig, error) {
+	left, right, ok := strings.Cut(strings.TrimSpace(spec), ":")
+	if !ok {
+		if proxyType == "http" {
+			return ProxyConfig{}, fmt.Errorf("error: invalid --http value %q (use subdomain:port)", spec)
+		}
+		return ProxyConfig{}, fmt.Errorf("error: invalid --%s value %q (use remote-port:local-port)", proxyType, spec)
+	}
+
+	localPort, err := strconv.Atoi(strings.TrimSpace(right))
+	if err != nil {
+		return ProxyConfig{}, fmt.Errorf("error: invalid local port in --%s %q", proxyType, spec)
+	}
+
+	proxy := ProxyConfig{
+		Type:      proxyType,
+		LocalIP:   localHost,
+		LocalPort: localPort,
+	}
+	if proxyType == "http" {
+		host := strings.TrimSpace(left)
+		if strings.Contains(host, ".") {
+			proxy.CustomDomains = []string{host}
+		} else {
+			proxy.Subdomain = host
+		}
 	} else {
-		log.Printf("Tunnel is running! Access it at p.ranax.co:%d\nPress Cmd+C to stop client.", *remotePort)
+		// An empty remote port (":22") lets the server pick one.
+		remotePort := 0
+		if strings.TrimSpace(left) != "" {
+			remotePort, err = strconv.Atoi(strings.TrimSpace(left))
+		}
+		if err != nil {
+			return ProxyConfig{}, fmt.Errorf("error: invalid remote port in --%s %q", proxyType, spec)
+		}
+		proxy.RemotePort = remotePort
 	}
+	return proxy, nil
+}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("frpc exited: %w", err)
+func validateProxy(proxy ProxyConfig) error {
+	if proxy.LocalPort <= 0 {
+		return fmt.Errorf("error: -p is required")
+	}
+	switch proxy.Type {
+	case "http", "https":
+		if proxy.Subdomain == "" && len(proxy.CustomDomains) == 0 {
+			return fmt.Errorf("error: --subdomain or --domain is required for %s tunnels", strings.ToUpper(proxy.Type))
+		}
+		for _, domain := range proxy.CustomDomains {
+			if err := validateCustomDomain(domain); err != nil {
+				return err
+			}
+		}
+	case "tcp", "udp":
+		if proxy.RemotePort < 0 || proxy.RemotePort > 65535 {
+			return fmt.Errorf("error: --remote-port must be between 0 (assigned by the server) and 65535")
+		}
+	case "stcp", "xtcp":
+		if proxy.SecretKey == "" {
+			return fmt.Errorf("error: --secret is required for %s tunnels", proxy.Type)
+		}
+	default:
+		return fmt.Errorf("error: unsupported tunnel type %q (use http, https, tcp, udp, stcp or xtcp)", proxy.Type)
+	}
+	if len(proxy.CustomDomains) > 0 && proxy.Type != "http" && proxy.Type != "https" {
+		return fmt.Errorf("error: --domain is only supported for http and https tunnels")
+	}
+	if proxy.LocalTLS && proxy.Type != "https" {
+		return fmt.Errorf("error: --local-tls is only supported for https tunnels")
+	}
+	if (proxy.TLSCertFile == "") != (proxy.TLSKeyFile == "") {
+		return fmt.Errorf("error: --tls-cert and --tls-key must be used together")
+	}
+	if proxy.TLSCertFile != "" && !proxy.LocalTLS {
+		return fmt.Errorf("error: --tls-cert/--tls-key require --local-tls")
+	}
+	if proxy.HTTPUser != "" && proxy.Type != "http" {
+		return fmt.Errorf("error: --basic-auth is only supported for http tunnels")
+	}
+	if proxy.AccessToken != "" && !isLocalHTTPProxy(proxy) {
+		return fmt.Errorf("error: --access-token is only supported for http tunnels and https tunnels with --local-tls")
+	}
+	if (proxy.HostHeaderRewrite != "" || len(proxy.RequestHeaders) > 0 || len(proxy.ResponseHeaders) > 0) && proxy.Type != "http" {
+		return fmt.Errorf("error: header rewriting is only supported for http tunnels")
+	}
+	if proxy.HostHeaderRewrite != "" {
+		if err := validateHostHeaderRewrite(proxy.HostHeaderRewrite); err != nil {
+			return err
+		}
+	}
+	if err := validateBandwidthLimit(proxy); err != nil {
+		return err
+	}
+	if err := validateProxyGroup(proxy); err != nil {
+		return err
+	}
+	return validateHealthPath(proxy)
+}
+
+// validateCustomDomain accepts plain host names and frps wildcard domains
+// (*.example.com). Schemes, ports and paths are rejected because frps matches
+// on the bare Host header.
+func validateCustomDomain(domain string) error {
+	host := strings.TrimPrefix(domain, "*.")
+	if host == "" || !strings.Contains(host, ".") || strings.HasPrefix(host, ".") || strings.HasSuffix(host, ".") {
+		return fmt.Errorf("error: invalid --domain %q (use a host name like demo.example.com)", domain)
+	}
+	for _, r := range host {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.') {
+			return fmt.Errorf("error: invalid --domain %q (use a host name like demo.example.com)", domain)
+		}
 	}
 	return nil
 }
 
+// applyHTTPAuthFlags applies --basic-auth and --access-token to every tunnel
+// they can protect.
+func applyHTTPAuthFlags(proxies []ProxyConfig, basicAuth, accessToken string) error {
+	var user, password string
+	if basicAuth != "" {
+		var err error
+		if user, password, err = parseBasicAuth(basicAuth); err != nil {
+			return err
+		}
+	}
+
+	applied := false
+	for i := range proxies {
+		if user != "" && proxies[i].Type == "http" {
+			proxies[i].HTTPUser, proxies[i].HTTPPassword = user, password
+			applied = true
+		}
+		if accessToken != "" && isLocalHTTPProxy(proxies[i]) {
+			proxies[i].AccessToken = accessToken
+			applied = true
+		}
+	}
+	if (basicAuth != "" || accessToken != "") && !applied {
+		return fmt.Errorf("error: --basic-auth and --access-token need an http tunnel")
+	}
+	return nil
+}
+
+// parseBasicAuth splits "user:pass" at the first colon.
+func parseBasicAuth(raw string) (string, string, error) {
+	user, password, ok := strings.Cut(raw, ":")
+	if !ok || user == "" || password == "" {
+		return "", "", fmt.Errorf("error: --basic-auth must be user:pass")
+	}
+	return user, password, nil
+}
+
+// assignProxyNames gives every proxy a unique name so frps can tell them apart.
+// Secret proxies get a stable name because visitors address them by it.
+func assignProxyNames(proxies []ProxyConfig, now int64) {
+	seen := make(map[string]int, len(proxies))
+	for i := range proxies {
+		if proxies[i].Name != "" {
+			seen[proxies[i].Name]++
+			continue
+		}
+		name := fmt.Sprintf("%s-%d-%d", proxies[i].Type, proxies[i].LocalPort, now)
+		if isSecretProxyType(proxies[i].Type) {
+			name = fmt.Sprintf("%s-%d", proxies[i].Type, proxies[i].LocalPort)
+		}
+		seen[name]++
+		if seen[name] > 1 {
+			name = fmt.Sprintf("%s-%d", name, seen[name])
+		}
+		proxies[i].Name = name
+	}
+}
+
+func renderFrpcConfig(cfg TunnelConfig) ([]byte, error) {
+	var buf bytes.Buffer
+	tmpl := template.Must(template.New("cfg").Funcs(template.FuncMap{"toml": tomlQuote}).Parse(frpcConfigTemplate))
+	if err := tmpl.Execute(&buf, cfg); err != nil {
+		return nil, fmt.Errorf("render config error: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// tomlQuote renders s as a TOML basic string, escaping quotes, backslashes
+// and control characters.
+func tomlQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// publicAddress is the primary address of a proxy: the subdomain for HTTP
+// tunnels, or the first custom domain when there is none.
+func publicAddress(serverAddr string, proxy ProxyConfig) string {
+	switch proxy.Type {
+	case "http", "https":
+		if addrs := publicAddresses(serverAddr, proxy); len(addrs) > 0 {
+			return addrs[0]
+		}
+		return ""
+	case "udp":
+		return fmt.Sprintf("%s:%d/udp", serverAddr, proxy.RemotePort)
+	case "stcp", "xtcp":
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", serverAddr, proxy.RemotePort)
+}
+
+// publicAddresses lists every address a proxy is reachable at. HTTP tunnels
+// can answer on a subdomain and any number of custom domains.
+func publicAddresses(serverAddr string, proxy ProxyConfig) []string {
+	if proxy.Type != "http" && proxy.Type != "https" {
+		if addr := publicAddress(serverAddr, proxy); addr != "" {
+			return []string{addr}
+		}
+		return nil
+	}
+	prefix := ""
+	if proxy.Type == "https" {
+		prefix = "https://"
+	}
+	var addrs []string
+	if proxy.Subdomain != "" {
+		addrs = append(addrs, fmt.Sprintf("%s%s.%s", prefix, proxy.Subdomain, serverAddr))
+	}
+	for _, domain := range proxy.CustomDomains {
+		addrs = append(addrs, prefix+domain)
+	}
+	return addrs
+}
+
+func isSecretProxyType(proxyType string) bool {
+	return proxyType == "stcp" || proxyType == "xtcp"
+}
+
 func printMainUsage(fs *flag.FlagSet) {
 	fmt.Fprintln(os.Stderr, "Usage:")
 	fmt.Fprintln(os.Stderr, "  kai [flags]")
+	fmt.Fprintln(os.Stderr, "  kai --http <subdomain:port> --tcp <remote:local> --udp <remote:local> [flags]")
+	fmt.Fprintln(os.Stderr, "  kai up <name...>|--all [flags]")
+	fmt.Fprintln(os.Stderr, "  kai connect <name> --secret <key> --bind <addr:port> [flags]")
+	fmt.Fprintln(os.Stderr, "  kai replay <id> [flags]")
+	fmt.Fprintln(os.Stderr, "  kai status [flags]")
+	fmt.Fprintln(os.Stderr, "  kai ls [flags]")
+	fmt.Fprintln(os.Stderr, "  kai stop <name|id|pid...>|--all [flags]")
+	fmt.Fprintln(os.Stderr, "  kai serve [dir] [flags]")
+	fmt.Fprintln(os.Stderr, "  kai receive --dir <dir> [flags]")
+	fmt.Fprintln(os.Stderr, "  kai webhook [flags]")
+	fmt.Fprintln(os.Stderr, "  kai run [flags] -- <command> [args...]")
 	fmt.Fprintln(os.Stderr, "  kai share <source> <provider> [flags]")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  up       Start named tunnels from [tunnels.<name>] sections in config.toml (-d runs them in the background)")
+	fmt.Fprintln(os.Stderr, "  connect  Reach a secret (stcp/xtcp) tunnel through a local port")
+	fmt.Fprintln(os.Stderr, "  replay   Re-send a request captured by --inspect and diff the response")
+	fmt.Fprintln(os.Stderr, "  status   Show the proxies, errors and traffic of running tunnels")
+	fmt.Fprintln(os.Stderr, "  ls       List running tunnels")
+	fmt.Fprintln(os.Stderr, "  stop     Stop running tunnels")
+	fmt.Fprintln(os.Stderr, "  serve    Serve a directory through an http tunnel")
+	fmt.Fprintln(os.Stderr, "  receive  Receive file uploads through an http tunnel")
+	fmt.Fprintln(os.Stderr, "  webhook  Catch and record webhooks with a built-in endpoint")
+	fmt.Fprintln(os.Stderr, "  run      Start a command and tunnel its port while it runs")
 	fmt.Fprintln(os.Stderr, "  share    Upload a URL or local file to a provider and print a share URL")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "Tunnel Flags:")
@@ -197,6 +1096,12 @@ func loadTunnelDefaults() (tunnelDefaults, error) {
 		ServerPort: 7000,
 		Token:      "",
 		LocalHost:  "127.0.0.1",
+		Engine:     "auto",
+
+		MaxRestarts: defaultMaxRestarts,
+
+		// frpc enables TLS to frps by default; so does kai.
+		Transport: TransportConfig{TLS: true},
 	}
 
 	configPath, err := resolveConfigPath()
@@ -223,6 +1128,31 @@ func loadTunnelDefaults() (tunnelDefaults, error) {
 	if loaded.LocalHost != "" {
 		defaults.LocalHost = loaded.LocalHost
 	}
+	if loaded.Engine != "" {
+		defaults.Engine = loaded.Engine
+	}
+	if loaded.hasMaxRestarts {
+		defaults.MaxRestarts = loaded.MaxRestarts
+	}
+	tls := defaults.Transport.TLS
+	if loaded.hasTransportTLS {
+		tls = loaded.Transport.TLS
+	}
+	defaults.Transport = loaded.Transport
+	defaults.Transport.TLS = tls
+	// TLS files in config.toml are relative to the config file.
+	paths := []*string{&defaults.Transport.TLSCAFile, &defaults.Transport.TLSCertFile, &defaults.Transport.TLSKeyFile}
+	for i := range loaded.Profiles {
+		paths = append(paths, &loaded.Profiles[i].Proxy.TLSCertFile, &loaded.Profiles[i].Proxy.TLSKeyFile)
+	}
+	for _, path := range paths {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(filepath.Dir(configPath), *path)
+		}
+	}
+	defaults.UseEncryption = loaded.UseEncryption
+	defaults.UseCompression = loaded.UseCompression
+	defaults.Profiles = loaded.Profiles
 	return defaults, nil
 }
 
@@ -266,6 +1196,7 @@ func parseTunnelDefaultsFromConfig(configPath string) (tunnelDefaults, error) {
 
 	var out tunnelDefaults
 	section := ""
+	profileIndex := make(map[string]int)
 	scanner := bufio.NewScanner(file)
 	lineNo := 0
 
@@ -308,6 +1239,23 @@ func parseTunnelDefaultsFromConfig(configPath string) (tunnelDefaults, error) {
 					return tunnelDefaults{}, fmt.Errorf("line %d: %w", lineNo, err)
 				}
 				out.LocalHost = str
+			case "engine":
+				str, err := parseTomlString(value)
+				if err != nil {
+					return tunnelDefaults{}, fmt.Errorf("line %d: %w", lineNo, err)
+				}
+				out.Engine = str
+			case "max_restarts":
+				num, err := parseTomlInt(value)
+				if err != nil {
+					return tunnelDefaults{}, fmt.Errorf("line %d: %w", lineNo, err)
+				}
+				out.MaxRestarts = num
+				out.hasMaxRestarts = true
+			}
+		case "transport":
+			if err := applyTransportKey(&out, key, value); err != nil {
+				return tunnelDefaults{}, fmt.Errorf("line %d: %w", lineNo, err)
 			}
 		case "auth":
 			if key == "token" {
@@ -317,6 +1265,21 @@ func parseTunnelDefaultsFromConfig(configPath string) (tunnelDefaults, error) {
 				}
 				out.Token = str
 			}
+		default:
+			name, ok := strings.CutPrefix(section, "tunnels.")
+			if !ok {
+				continue
+			}
+			name = strings.Trim(strings.TrimSpace(name), "\"'")
+			idx, exists := profileIndex[name]
+			if !exists {
+				idx = len(out.Profiles)
+				profileIndex[name] = idx
+				out.Profiles = append(out.Profiles, tunnelProfile{Name: name})
+			}
+			if err := applyProfileKey(&out.Profiles[idx], key, value); err != nil {
+				return tunnelDefaults{}, fmt.Errorf("line %d: %w", lineNo, err)
+			}
 		}
 	}
 
@@ -347,6 +1310,66 @@ func parseTomlString(raw string) (string, error) {
 	return strings.TrimSpace(raw), nil
 }
 
+// parseTomlStringList reads a single string or a one-line array of strings.
+// Commas inside quoted items are kept.
+func parseTomlStringList(raw string) ([]string, error) {
+	raw = strings.TrimSpace(raw)
+	inner, ok := strings.CutPrefix(raw, "[")
+	if !ok {
+		str, err := parseTomlString(raw)
+		if err != nil {
+			return nil, err
+		}
+		return []string{str}, nil
+	}
+	inner, ok = strings.CutSuffix(inner, "]")
+	if !ok {
+		return nil, errors.New("unterminated array")
+	}
+
+	var out []string
+	var quote rune
+	start := 0
+	flush := func(end int) error {
+		item := strings.TrimSpace(inner[start:end])
+		if item == "" {
+			return nil
+		}
+		str, err := parseTomlString(item)
+		if err != nil {
+			return err
+		}
+		out = append(out, str)
+		return nil
+	}
+	for i, r := range inner {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ',':
+			if err := flush(i); err != nil {
+				return nil, err
+			}
+			start = i + 1
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated string in array")
+	}
+	if err := flush(len(inner)); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func parseTomlBool(raw string) (bool, error) {
+	return strconv.ParseBool(strings.TrimSpace(raw))
+}
+
 func parseTomlInt(raw string) (int, error) {
 	raw = strings.TrimSpace(raw)
 	value, err := strconv.Atoi(raw)
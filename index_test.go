@@ -168,3 +168,142 @@ func TestRunTunnelHelpIncludesShareCommand(t *testing.T) {
 		t.Fatalf("expected share command in help output, got %q", output)
 	}
 }
+
+func TestParseProxySpec(t *testing.T) {
+	httpProxy, err := parseProxySpec("http", "web:3000", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("parse http spec: %v", err)
+	}
+	if httpProxy.Subdomain != "web" || httpProxy.LocalPort != 3000 || httpProxy.LocalIP != "127.0.0.1" {
+		t.Fatalf("unexpected http proxy: %+v", httpProxy)
+	}
+
+	domainProxy, err := parseProxySpec("http", "demo.customer.com:3000", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("parse http domain spec: %v", err)
+	}
+	if domainProxy.Subdomain != "" || len(domainProxy.CustomDomains) != 1 || domainProxy.CustomDomains[0] != "demo.customer.com" {
+		t.Fatalf("unexpected http domain proxy: %+v", domainProxy)
+	}
+
+	tcpProxy, err := parseProxySpec("tcp", "22022:22", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("parse tcp spec: %v", err)
+	}
+	if tcpProxy.RemotePort != 22022 || tcpProxy.LocalPort != 22 {
+		t.Fatalf("unexpected tcp proxy: %+v", tcpProxy)
+	}
+
+	udpProxy, err := parseProxySpec("udp", "5353:53", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("parse udp spec: %v", err)
+	}
+	if udpProxy.Type != "udp" || udpProxy.RemotePort != 5353 || udpProxy.LocalPort != 53 {
+		t.Fatalf("unexpected udp proxy: %+v", udpProxy)
+	}
+
+	if _, err := parseProxySpec("tcp", "ssh:22", "127.0.0.1"); err == nil {
+		t.Fatalf("expected error for non-numeric remote port")
+	}
+	anyPort, err := parseProxySpec("tcp", ":22", "127.0.0.1")
+	if err != nil || anyPort.RemotePort != 0 || validateProxy(anyPort) != nil {
+		t.Fatalf("expected \":22\" to ask the server for a port: %+v %v", anyPort, err)
+	}
+	if _, err := parseProxySpec("http", "3000", "127.0.0.1"); err == nil {
+		t.Fatalf("expected error for missing subdomain")
+	}
+}
+
+func TestRenderFrpcConfigMultipleProxies(t *testing.T) {
+	proxies := []ProxyConfig{
+		{Type: "http", LocalIP: "127.0.0.1", LocalPort: 3000, Subdomain: "web", HostHeaderRewrite: "localhost:3000",
+			RequestHeaders: map[string]string{"X-From": "kai"}, ResponseHeaders: map[string]string{"Cache-Control": "no-store"}},
+		{Type: "http", LocalIP: "127.0.0.1", LocalPort: 3000, Subdomain: "web2", HTTPUser: "admin", HTTPPassword: "hunter2", HealthPath: "/healthz"},
+		{Type: "tcp", LocalIP: "127.0.0.1", LocalPort: 22, RemotePort: 22022},
+		{Type: "udp", LocalIP: "127.0.0.1", LocalPort: 53, RemotePort: 5353},
+		{Type: "http", LocalIP: "127.0.0.1", LocalPort: 8080, CustomDomains: []string{"demo.customer.com", "*.preview.customer.com"}},
+	}
+	assignProxyNames(proxies, 42)
+
+	rendered, err := renderFrpcConfig(TunnelConfig{
+		ServerAddr: "p.ranax.co",
+		ServerPort: 7000,
+		Token:      "abc",
+		Admin:      &frpcAdmin{Port: 7400, User: "kai", Password: "pw"},
+		Proxies:    proxies,
+	})
+	if err != nil {
+		t.Fatalf("render config: %v", err)
+	}
+
+	text := string(rendered)
+	if admin, auth := strings.Index(text, "webServer.port     = 7400"), strings.Index(text, "[auth]"); admin < 0 || admin > auth {
+		t.Fatalf("expected the admin API before [auth], got %q", text)
+	}
+	if got := strings.Count(text, "[[proxies]]"); got != 5 {
+		t.Fatalf("expected 5 proxies, got %d in %q", got, text)
+	}
+	if got := strings.Count(text, `healthCheck.type            = "tcp"`); got != 4 {
+		t.Fatalf("expected a tcp health check on every proxy but udp, got %d in %q", got, text)
+	}
+	if got := strings.Count(text, "subdomain = "); got != 2 {
+		t.Fatalf("expected subdomain only where set, got %d in %q", got, text)
+	}
+	for _, want := range []string{
+		`name      = "http-3000-42"`,
+		`name      = "http-3000-42-2"`,
+		`subdomain = "web2"`,
+		`httpUser     = "admin"`,
+		`httpPassword = "hunter2"`,
+		`remotePort = 22022`,
+		`type      = "udp"`,
+		`remotePort = 5353`,
+		`customDomains = ["demo.customer.com", "*.preview.customer.com"]`,
+		`hostHeaderRewrite = "localhost:3000"`,
+		`requestHeaders.set."X-From" = "kai"`,
+		`responseHeaders.set."Cache-Control" = "no-store"`,
+		`healthCheck.maxFailed       = 1`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("expected %q in rendered config, got %q", want, text)
+		}
+	}
+}
+
+func TestValidateProxyCustomDomains(t *testing.T) {
+	valid := []ProxyConfig{
+		{Type: "http", LocalPort: 3000, CustomDomains: []string{"demo.customer.com"}},
+		{Type: "https", LocalPort: 3000, Subdomain: "web", CustomDomains: []string{"*.customer.com"}},
+	}
+	for _, proxy := range valid {
+		if err := validateProxy(proxy); err != nil {
+			t.Fatalf("validate %+v: %v", proxy, err)
+		}
+	}
+
+	invalid := []ProxyConfig{
+		{Type: "http", LocalPort: 3000},
+		{Type: "http", LocalPort: 3000, CustomDomains: []string{"https://demo.customer.com"}},
+		{Type: "http", LocalPort: 3000, CustomDomains: []string{"demo.customer.com:8080"}},
+		{Type: "http", LocalPort: 3000, CustomDomains: []string{"localhost"}},
+		{Type: "tcp", LocalPort: 22, RemotePort: 22022, CustomDomains: []string{"demo.customer.com"}},
+	}
+	for _, proxy := range invalid {
+		if err := validateProxy(proxy); err == nil {
+			t.Fatalf("expected error for %+v", proxy)
+		}
+	}
+}
+
+func TestPublicAddressesIncludeCustomDomains(t *testing.T) {
+	proxy := ProxyConfig{Type: "https", Subdomain: "web", CustomDomains: []string{"demo.customer.com"}}
+	got := publicAddresses("p.ranax.co", proxy)
+	if len(got) != 2 || got[0] != "https://web.p.ranax.co" || got[1] != "https://demo.customer.com" {
+		t.Fatalf("unexpected addresses: %q", got)
+	}
+
+	ev := proxyReadyEvent("p.ranax.co", ProxyConfig{Type: "http", CustomDomains: []string{"a.customer.com", "b.customer.com"}})
+	if ev.URL != "http://a.customer.com" || len(ev.URLs) != 2 || ev.URLs[1] != "http://b.customer.com" {
+		t.Fatalf("unexpected proxy_ready event: %+v", ev)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultInspectAddr      = "127.0.0.1:4040"
+	defaultInspectBodyLimit = "1MB"
+	inspectorMaxExchanges   = 500
+)
+
+// InspectConfig enables the local request inspector for HTTP tunnels.
+type InspectConfig struct {
+	Enabled   bool
+	Addr      string
+	BodyLimit int64
+}
+
+type inspectFlags struct {
+	enabled   *bool
+	addr      *string
+	bodyLimit *string
+}
+
+func registerInspectFlags(fs *flag.FlagSet) inspectFlags {
+	return inspectFlags{
+		enabled:   fs.Bool("inspect", false, "Record HTTP requests and serve them in a local inspector UI"),
+		addr:      fs.String("inspect-addr", defaultInspectAddr, "Listen address of the inspector UI and API"),
+		bodyLimit: fs.String("inspect-body-limit", defaultInspectBodyLimit, "Bytes of each request/response body to record (e.g. 256KB, 1MB)"),
+	}
+}
+
+func (f inspectFlags) config() (InspectConfig, error) {
+	if !*f.enabled {
+		return InspectConfig{}, nil
+	}
+	limit, err := parseSize(*f.bodyLimit)
+	if err != nil {
+		return InspectConfig{}, fmt.Errorf("error: invalid --inspect-body-limit %q: %v", *f.bodyLimit, err)
+	}
+	return InspectConfig{Enabled: true, Addr: *f.addr, BodyLimit: limit}, nil
+}
+
+// capturedBody is a request or response body recorded up to the body limit.
+type capturedBody struct {
+	Data      []byte
+	Size      int64
+	Truncated bool
+}
+
+func (b capturedBody) MarshalJSON() ([]byte, error) {
+	out := struct {
+		Size      int64  `json:"size"`
+		Truncated bool   `json:"truncated"`
+		Encoding  string `json:"encoding"`
+		Data      string `json:"data"`
+	}{Size: b.Size, Truncated: b.Truncated, Encoding: "utf8", Data: string(b.Data)}
+	if !utf8.Valid(b.Data) {
+		out.Encoding = "base64"
+		out.Data = base64.StdEncoding.EncodeToString(b.Data)
+	}
+	return json.Marshal(out)
+}
+
+func (b *capturedBody) UnmarshalJSON(raw []byte) error {
+	var in struct {
+		Size      int64  `json:"size"`
+		Truncated bool   `json:"truncated"`
+		Encoding  string `json:"encoding"`
+		Data      string `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &in); err != nil {
+		return err
+	}
+	b.Size, b.Truncated, b.Data = in.Size, in.Truncated, []byte(in.Data)
+	if in.Encoding == "base64" {
+		data, err := base64.StdEncoding.DecodeString(in.Data)
+		if err != nil {
+			return err
+		}
+		b.Data = data
+	}
+	return nil
+}
+
+// bodyCapture records the first limit bytes written to it and counts the rest.
+type bodyCapture struct {
+	limit int64
+	body  capturedBody
+}
+
+func (c *bodyCapture) Write(p []byte) (int, error) {
+	c.body.Size += int64(len(p))
+	if room := c.limit - int64(len(c.body.Data)); room > 0 {
+		if int64(len(p)) > room {
+			c.body.Data = append(c.body.Data, p[:room]...)
+			c.body.Truncated = true
+		} else {
+			c.body.Data = append(c.body.Data, p...)
+		}
+	} else if len(p) > 0 {
+		c.body.Truncated = true
+	}
+	return len(p), nil
+}
+
+type captureReadCloser struct {
+	io.ReadCloser
+	capture *bodyCapture
+}
+
+func (r *captureReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	_, _ = r.capture.Write(p[:n])
+	return n, err
+}
+
+// inspectedExchange is one recorded request/response pair.
+type inspectedExchange struct {
+	ID              string       `json:"id"`
+	Proxy           string       `json:"proxy"`
+	Target          string       `json:"target"`
+	ReplayOf        string       `json:"replay_of,omitempty"`
+	Time            time.Time    `json:"time"`
+	DurationMS      int64        `json:"duration_ms"`
+	Method          string       `json:"method"`
+	Host            string       `json:"host"`
+	Path            string       `json:"path"`
+	RemoteAddr      string       `json:"remote_addr,omitempty"`
+	RequestHeaders  http.Header  `json:"request_headers"`
+	RequestBody     capturedBody `json:"request_body"`
+	Status          int          `json:"status"`
+	ResponseHeaders http.Header  `json:"response_headers"`
+	ResponseBody    capturedBody `json:"response_body"`
+	Error           string       `json:"error,omitempty"`
+}
+
+type inspectedSummary struct {
+	ID         string    `json:"id"`
+	Proxy      string    `json:"proxy"`
+	ReplayOf   string    `json:"replay_of,omitempty"`
+	Time       time.Time `json:"time"`
+	DurationMS int64     `json:"duration_ms"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (e *inspectedExchange) summary() inspectedSummary {
+	return inspectedSummary{
+		ID:         e.ID,
+		Proxy:      e.Proxy,
+		ReplayOf:   e.ReplayOf,
+		Time:       e.Time,
+		DurationMS: e.DurationMS,
+		Method:     e.Method,
+		Host:       e.Host,
+		Path:       e.Path,
+		Status:     e.Status,
+		Error:      e.Error,
+	}
+}
+
+// inspectorStore keeps the most recent exchanges in memory.
+type inspectorStore struct {
+	mu        sync.Mutex
+	nextID    int
+	exchanges []*inspectedExchange
+}
+
+func (s *inspectorStore) add(exchange *inspectedExchange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	exchange.ID = strconv.Itoa(s.nextID)
+	s.exchanges = append(s.exchanges, exchange)
+	if len(s.exchanges) > inspectorMaxExchanges {
+		s.exchanges = s.exchanges[len(s.exchanges)-inspectorMaxExchanges:]
+	}
+}
+
+func (s *inspectorStore) get(id string) *inspectedExchange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, exchange := range s.exchanges {
+		if exchange.ID == id {
+			return exchange
+		}
+	}
+	return nil
+}
+
+// list returns summaries, newest first.
+func (s *inspectorStore) list() []inspectedSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]inspectedSummary, 0, len(s.exchanges))
+	for i := len(s.exchanges) - 1; i >= 0; i-- {
+		out = append(out, s.exchanges[i].summary())
+	}
+	return out
+}
+
+func (s *inspectorStore) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exchanges = nil
+}
+
+// inspector records the HTTP exchanges of the local fronts (see front.go) and
+// serves them through a small web UI and JSON API.
+type inspector struct {
+	cfg   InspectConfig
+	store inspectorStore
+
+	listener net.Listener
+	server   *http.Server
+}
+
+// startInspector starts the UI/API server, falling back to a random port when
+// the configured address is taken.
+func startInspector(cfg InspectConfig) (*inspector, error) {
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		log.Printf("inspector: %s unavailable (%v), using a random port", cfg.Addr, err)
+		host, _, splitErr := net.SplitHostPort(cfg.Addr)
+		if splitErr != nil {
+			host = "127.0.0.1"
+		}
+		ln, err = net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return nil, fmt.Errorf("error: inspector listen: %w", err)
+		}
+	}
+
+	insp := &inspector{cfg: cfg, listener: ln}
+	insp.server = &http.Server{Handler: insp.apiHandler(), ReadHeaderTimeout: 30 * time.Second}
+	go func() {
+		if err := insp.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("inspector: %v", err)
+		}
+	}()
+	return insp, nil
+}
+
+func (i *inspector) URL() string {
+	return "http://" + i.listener.Addr().String()
+}
+
+func (i *inspector) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return i.server.Shutdown(ctx)
+}
+
+// recordingHandler records every exchange that next (the reverse proxy to
+// target) handles for the named proxy.
+func (i *inspector) recordingHandler(proxyName, target string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		exchange := &inspectedExchange{
+			Proxy:          proxyName,
+			Target:         target,
+			Time:           start.UTC(),
+			Method:         r.Method,
+			Host:           r.Host,
+			Path:           r.URL.RequestURI(),
+			RemoteAddr:     r.Header.Get("X-Forwarded-For"),
+			RequestHeaders: r.Header.Clone(),
+		}
+
+		reqCapture := &bodyCapture{limit: i.cfg.BodyLimit}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &captureReadCloser{ReadCloser: r.Body, capture: reqCapture}
+		}
+		rec := &recordingResponseWriter{ResponseWriter: w, capture: &bodyCapture{limit: i.cfg.BodyLimit}}
+
+		next.ServeHTTP(rec, r)
+
+		exchange.DurationMS = time.Since(start).Milliseconds()
+		exchange.RequestBody = reqCapture.body
+		exchange.Status = rec.status
+		if exchange.Status == 0 {
+			exchange.Status = http.StatusOK
+		}
+		exchange.ResponseHeaders = rec.Header().Clone()
+		exchange.ResponseBody = rec.capture.body
+		if rec.proxyErr != nil {
+			exchange.Error = rec.proxyErr.Error()
+		}
+		i.store.add(exchange)
+	})
+}
+
+// recordingResponseWriter captures the status and body written by the
+// reverse proxy. Unwrap lets http.ResponseController reach the underlying
+// writer for flushing and protocol upgrades.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	capture  *bodyCapture
+	proxyErr error
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	_, _ = w.capture.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (i *inspector) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(inspectorUI))
+	})
+	mux.HandleFunc("GET /api/requests", func(w http.ResponseWriter, r *http.Request) {
+		writeInspectorJSON(w, http.StatusOK, map[string]any{"requests": i.store.list()})
+	})
+	mux.HandleFunc("DELETE /api/requests", func(w http.ResponseWriter, r *http.Request) {
+		i.store.clear()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /api/requests/{id}", func(w http.ResponseWriter, r *http.Request) {
+		exchange := i.store.get(r.PathValue("id"))
+		if exchange == nil {
+			writeInspectorJSON(w, http.StatusNotFound, map[string]any{"error": "request not found"})
+			return
+		}
+		writeInspectorJSON(w, http.StatusOK, exchange)
+	})
+	mux.HandleFunc("POST /api/requests/{id}/replay", i.handleReplay)
+	return i.guardAPI(mux)
+}
+
+// guardAPI keeps other web pages away from the inspector. The Host must name
+// the inspector, which defeats DNS rebinding; cross-origin requests are
+// refused; and requests that change something must be JSON, which a page
+// cannot send to another origin without a CORS preflight.
+func (i *inspector) guardAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !i.isInspectorHost(r.Host) {
+			writeInspectorJSON(w, http.StatusForbidden, map[string]any{"error": "unexpected Host " + strconv.Quote(r.Host)})
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && !strings.EqualFold(origin, "http://"+r.Host) {
+			writeInspectorJSON(w, http.StatusForbidden, map[string]any{"error": "cross-origin requests are not allowed"})
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+				writeInspectorJSON(w, http.StatusUnsupportedMediaType, map[string]any{"error": "Content-Type must be application/json"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isInspectorHost reports whether a Host header addresses the inspector:
+// localhost or a loopback IP, or the IP it listens on, with its port.
+func (i *inspector) isInspectorHost(host string) bool {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return false
+	}
+	listenAddr, ok := i.listener.Addr().(*net.TCPAddr)
+	if !ok || port != strconv.Itoa(listenAddr.Port) {
+		return false
+	}
+	if strings.EqualFold(name, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(name)
+	return ip != nil && (ip.IsLoopback() || ip.Equal(listenAddr.IP))
+}
+
+func writeInspectorJSON(w http.ResponseWriter, status int, payload any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(payload)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startTestInspector(t *testing.T, local *httptest.Server, bodyLimit int64) (*inspector, TunnelConfig) {
+	t.Helper()
+	localURL, _ := url.Parse(local.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+	cfg := TunnelConfig{
+		Inspect: InspectConfig{Enabled: true, Addr: "127.0.0.1:0", BodyLimit: bodyLimit},
+		Proxies: []ProxyConfig{
+			{Name: "web", Type: "http", LocalIP: "127.0.0.1", LocalPort: port, Subdomain: "web"},
+			{Name: "ssh", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: 22, RemotePort: 22022},
+		},
+	}
+	insp, err := startInspector(cfg.Inspect)
+	if err != nil {
+		t.Fatalf("start inspector: %v", err)
+	}
+	t.Cleanup(func() { insp.Close() })
+	fronts, engineCfg, err := startLocalFronts(cfg, insp)
+	if err != nil {
+		t.Fatalf("start local fronts: %v", err)
+	}
+	t.Cleanup(func() { fronts.Close() })
+	return insp, engineCfg
+}
+
+// waitForExchanges waits for the recording handler to finish, which happens
+// just after the client has seen the response.
+func waitForExchanges(t *testing.T, insp *inspector, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(insp.store.list()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d recorded exchanges", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func getInspectorJSON(t *testing.T, rawURL string, out any) int {
+	t.Helper()
+	resp, err := http.Get(rawURL)
+	if err != nil {
+		t.Fatalf("GET %s: %v", rawURL, err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		t.Fatalf("decode %s: %v", rawURL, err)
+	}
+	return resp.StatusCode
+}
+
+func TestInspectorRecordsExchanges(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Seen-Host", r.Host)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"echo":%q}`, body)
+	}))
+	defer local.Close()
+
+	insp, engineCfg := startTestInspector(t, local, 1024)
+	if engineCfg.Proxies[0].LocalPort == 0 || engineCfg.Proxies[0].LocalIP != "127.0.0.1" {
+		t.Fatalf("http proxy not redirected: %+v", engineCfg.Proxies[0])
+	}
+	if engineCfg.Proxies[1].LocalPort != 22 {
+		t.Fatalf("tcp proxy should not be inspected: %+v", engineCfg.Proxies[1])
+	}
+
+	proxyURL := fmt.Sprintf("http://127.0.0.1:%d/hooks/stripe?x=1", engineCfg.Proxies[0].LocalPort)
+	req, _ := http.NewRequest(http.MethodPost, proxyURL, strings.NewReader(`{"type":"charge.succeeded"}`))
+	req.Host = "web.p.ranax.co"
+	req.Header.Set("Stripe-Signature", "t=1,v1=abc")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request through inspector: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("X-Seen-Host") != "web.p.ranax.co" {
+		t.Fatalf("unexpected proxied response: %d host=%q", resp.StatusCode, resp.Header.Get("X-Seen-Host"))
+	}
+
+	waitForExchanges(t, insp, 1)
+	var list struct {
+		Requests []inspectedSummary `json:"requests"`
+	}
+	getInspectorJSON(t, insp.URL()+"/api/requests", &list)
+	if len(list.Requests) != 1 || list.Requests[0].Path != "/hooks/stripe?x=1" || list.Requests[0].Status != http.StatusCreated {
+		t.Fatalf("unexpected request list: %+v", list.Requests)
+	}
+
+	var exchange inspectedExchange
+	getInspectorJSON(t, insp.URL()+"/api/requests/"+list.Requests[0].ID, &exchange)
+	if exchange.Method != http.MethodPost || exchange.Proxy != "web" {
+		t.Fatalf("unexpected exchange: %+v", exchange)
+	}
+	if string(exchange.RequestBody.Data) != `{"type":"charge.succeeded"}` {
+		t.Fatalf("unexpected request body %q", exchange.RequestBody.Data)
+	}
+	if exchange.RequestHeaders.Get("Stripe-Signature") != "t=1,v1=abc" {
+		t.Fatalf("request headers not recorded: %v", exchange.RequestHeaders)
+	}
+	if !strings.Contains(string(exchange.ResponseBody.Data), "charge.succeeded") {
+		t.Fatalf("unexpected response body %q", exchange.ResponseBody.Data)
+	}
+
+	var missing map[string]any
+	if status := getInspectorJSON(t, insp.URL()+"/api/requests/999", &missing); status != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown id, got %d", status)
+	}
+}
+
+func TestInspectorTruncatesBodiesAndRecordsErrors(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	insp, engineCfg := startTestInspector(t, local, 10)
+	proxyURL := fmt.Sprintf("http://127.0.0.1:%d/", engineCfg.Proxies[0].LocalPort)
+
+	resp, err := http.Get(proxyURL)
+	if err != nil {
+		t.Fatalf("request through inspector: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(body) != 100 {
+		t.Fatalf("client should receive the full body, got %d bytes", len(body))
+	}
+
+	local.Close()
+	resp, err = http.Get(proxyURL)
+	if err != nil {
+		t.Fatalf("request through inspector: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502 when the local service is down, got %d", resp.StatusCode)
+	}
+
+	waitForExchanges(t, insp, 2)
+	first := insp.store.get("1")
+	if first == nil || !first.ResponseBody.Truncated || len(first.ResponseBody.Data) != 10 || first.ResponseBody.Size != 100 {
+		t.Fatalf("unexpected truncated body: %+v", first)
+	}
+	second := insp.store.get("2")
+	if second == nil || second.Error == "" || second.Status != http.StatusBadGateway {
+		t.Fatalf("expected recorded proxy error, got %+v", second)
+	}
+}
+
+func TestCapturedBodyJSONRoundTrip(t *testing.T) {
+	for _, data := range [][]byte{[]byte("plain text"), {0xff, 0x00, 0xfe}} {
+		raw, err := json.Marshal(capturedBody{Data: data, Size: int64(len(data))})
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		var got capturedBody
+		if err := json.Unmarshal(raw, &got); err != nil {
+			t.Fatalf("unmarshal %s: %v", raw, err)
+		}
+		if string(got.Data) != string(data) {
+			t.Fatalf("round trip mismatch: %q != %q", got.Data, data)
+		}
+	}
+}
+
+func TestInspectorAPIRejectsOtherSites(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer local.Close()
+	insp, _ := startTestInspector(t, local, 1024)
+	port := insp.listener.Addr().(*net.TCPAddr).Port
+
+	cases := []struct {
+		method, host, origin, contentType string
+		want                              int
+	}{
+		{http.MethodGet, "", "", "", http.StatusOK},
+		{http.MethodGet, fmt.Sprintf("localhost:%d", port), "", "", http.StatusOK},
+		{http.MethodGet, fmt.Sprintf("rebind.attacker.example:%d", port), "", "", http.StatusForbidden},
+		{http.MethodGet, "127.0.0.1:1", "", "", http.StatusForbidden},
+		{http.MethodDelete, "", "", "application/json", http.StatusNoContent},
+		{http.MethodDelete, "", "", "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodDelete, "", "", "", http.StatusUnsupportedMediaType},
+		{http.MethodDelete, "", "https://attacker.example", "application/json", http.StatusForbidden},
+		{http.MethodDelete, "", "http://" + insp.listener.Addr().String(), "application/json", http.StatusNoContent},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest(tc.method, insp.URL()+"/api/requests", nil)
+		if tc.host != "" {
+			req.Host = tc.host
+		}
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s with Host %q: %v", tc.method, tc.host, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Fatalf("%s with Host %q, Origin %q, Content-Type %q: got %d, want %d", tc.method, tc.host, tc.origin, tc.contentType, resp.StatusCode, tc.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+// inspectorUI is the single-page inspector served at the root of the
+// inspector address. It only talks to the JSON API below /api.
+const inspectorUI = `<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>kai inspector</title>
+<style>
+  body { margin: 0; font: 13px/1.4 -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; color: #1f2328; display: flex; height: 100vh; }
+  #list { width: 42%; overflow-y: auto; border-right: 1px solid #d0d7de; }
+  #detail { flex: 1; overflow-y: auto; padding: 12px 16px; }
+  header { display: flex; justify-content: space-between; align-items: center; padding: 8px 12px; border-bottom: 1px solid #d0d7de; position: sticky; top: 0; background: #f6f8fa; }
+  table { width: 100%; border-collapse: collapse; }
+  td { padding: 6px 12px; border-bottom: 1px solid #eaeef2; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; max-width: 320px; }
+  tr { cursor: pointer; }
+  tr.selected { background: #ddf4ff; }
+  .s2 { color: #1a7f37; } .s3 { color: #9a6700; } .s4, .s5, .err { color: #cf222e; }
+  pre { background: #f6f8fa; padding: 8px; overflow-x: auto; white-space: pre-wrap; word-break: break-all; }
+  h3 { margin: 16px 0 4px; }
+  button { font: inherit; }
+  textarea { width: 100%; min-height: 60px; font: 12px monospace; box-sizing: border-box; }
+  .add { color: #1a7f37; } .del { color: #cf222e; }
+</style>
+</head>
+<body>
+<div id="list">
+  <header><strong>kai inspector</strong><button id="clear">Clear</button></header>
+  <table><tbody id="rows"></tbody></table>
+</div>
+<div id="detail"><p>Select a request.</p></div>
+<script>
+let selected = null;
+
+function esc(s) {
+  return String(s).replace(/[&<>"]/g, c => ({"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c]));
+}
+
+function headers(h) {
+  return Object.keys(h || {}).sort().map(k => h[k].map(v => k + ": " + v).join("\n")).join("\n");
+}
+
+function body(b) {
+  if (!b || b.size === 0) return "(empty)";
+  let text = b.encoding === "base64" ? "(binary, base64)\n" + b.data : b.data;
+  try { if (b.encoding !== "base64") text = JSON.stringify(JSON.parse(b.data), null, 2); } catch (e) {}
+  if (b.truncated) text += "\n… truncated (" + b.size + " bytes total)";
+  return text;
+}
+
+async function refresh() {
+  const res = await fetch("/api/requests");
+  const data = await res.json();
+  document.getElementById("rows").innerHTML = data.requests.map(r =>
+    '<tr data-id="' + esc(r.id) + '"' + (r.id === selected ? ' class="selected"' : "") + '>' +
+    "<td>#" + esc(r.id) + "</td><td>" + esc(r.method) + "</td><td>" + esc(r.path) + "</td>" +
+    '<td class="' + (r.error ? "err" : "s" + String(r.status)[0]) + '">' + (r.error ? "ERR" : r.status) + "</td>" +
+    "<td>" + r.duration_ms + "ms</td></tr>").join("");
+}
+
+async function show(id) {
+  selected = id;
+  const res = await fetch("/api/requests/" + encodeURIComponent(id));
+  if (!res.ok) return;
+  const r = await res.json();
+  document.getElementById("detail").innerHTML =
+    "<h2>#" + esc(r.id) + " " + esc(r.method) + " " + esc(r.path) + "</h2>" +
+    "<p>" + esc(r.host) + " → " + esc(r.target) + " · " + (r.error ? '<span class="err">' + esc(r.error) + "</span>" : r.status) +
+    " · " + r.duration_ms + "ms · " + esc(new Date(r.time).toLocaleString()) + "</p>" +
+    '<p><button id="replay">Replay</button> <label><input type="checkbox" id="edit"> edit before replaying</label></p>' +
+    '<div id="edits" hidden><h3>Header overrides <small>(Key: Value per line, empty value removes)</small></h3>' +
+    '<textarea id="edit-headers"></textarea><h3>Body</h3><textarea id="edit-body">' +
+    esc(r.request_body.encoding === "base64" ? "" : r.request_body.data) + "</textarea></div>" +
+    '<div id="replay-result"></div>' +
+    "<h3>Request headers</h3><pre>" + esc(headers(r.request_headers)) + "</pre>" +
+    "<h3>Request body</h3><pre>" + esc(body(r.request_body)) + "</pre>" +
+    "<h3>Response headers</h3><pre>" + esc(headers(r.response_headers)) + "</pre>" +
+    "<h3>Response body</h3><pre>" + esc(body(r.response_body)) + "</pre>";
+  document.getElementById("edit").addEventListener("change", e => {
+    document.getElementById("edits").hidden = !e.target.checked;
+  });
+  document.getElementById("replay").addEventListener("click", () => replay(r.id));
+  refresh();
+}
+
+async function replay(id) {
+  const edits = {};
+  if (document.getElementById("edit").checked) {
+    edits.headers = document.getElementById("edit-headers").value.split("\n").filter(l => l.trim() !== "");
+    edits.body = document.getElementById("edit-body").value;
+  }
+  const res = await fetch("/api/requests/" + encodeURIComponent(id) + "/replay", {method: "POST", headers: {"Content-Type": "application/json"}, body: JSON.stringify(edits)});
+  const data = await res.json();
+  const out = document.getElementById("replay-result");
+  if (!res.ok) {
+    out.innerHTML = '<p class="err">' + esc(data.error) + "</p>";
+    return;
+  }
+  const d = data.diff;
+  let lines = [];
+  if (d.status_from !== d.status_to) lines.push('<span class="del">-status ' + d.status_from + '</span>', '<span class="add">+status ' + d.status_to + "</span>");
+  for (const h of d.headers) {
+    if (h.from) lines.push('<span class="del">-' + esc(h.key + ": " + h.from) + "</span>");
+    if (h.to) lines.push('<span class="add">+' + esc(h.key + ": " + h.to) + "</span>");
+  }
+  for (const l of d.body || []) {
+    lines.push(l[0] === "+" ? '<span class="add">' + esc(l) + "</span>" : l[0] === "-" ? '<span class="del">' + esc(l) + "</span>" : esc(l));
+  }
+  out.innerHTML = "<h3>Replayed as #" + esc(data.replay.id) + " (" + (data.replay.error ? esc(data.replay.error) : data.replay.status) + ", " +
+    data.replay.duration_ms + "ms)</h3><pre>" + (lines.length ? lines.join("\n") : "Response unchanged.") + "</pre>";
+  refresh();
+}
+
+document.getElementById("rows").addEventListener("click", e => {
+  const row = e.target.closest("tr");
+  if (row) show(row.dataset.id);
+});
+document.getElementById("clear").addEventListener("click", async () => {
+  await fetch("/api/requests", {method: "DELETE", headers: {"Content-Type": "application/json"}});
+  selected = null;
+  document.getElementById("detail").innerHTML = "<p>Select a request.</p>";
+  refresh();
+});
+
+refresh();
+setInterval(refresh, 1500);
+</script>
+</body>
+</html>
+`
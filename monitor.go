@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Exit statuses for tunnel failures that restarting would not fix. They start
+// above the kai share exit codes so scripts can tell the two apart.
+const (
+	exitCodeTunnelAuth           = 10
+	exitCodeTunnelSubdomainInUse = 11
+	exitCodeTunnelPortNotAllowed = 12
+	exitCodeTunnelPortInUse      = 13
+	exitCodeTunnelProxyConflict  = 14
+	exitCodeTunnelProxyFailed    = 15
+	exitCodeTunnelExited         = 16
+
+	exitCodeTunnelLocalUnavailable = 17
+	exitCodeTunnelRelayUnavailable = 18
+)
+
+// tunnelError is a tunnel failure with a stable code. The supervisor does not
+// restart the engine after one.
+type tunnelError struct {
+	Code     string
+	Message  string
+	ExitCode int
+	Err      error
+
+	// Proxy names the proxy frps rejected, if the failure is about one.
+	Proxy string
+}
+
+func (e *tunnelError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return e.Code
+}
+
+func (e *tunnelError) Unwrap() error {
+	return e.Err
+}
+
+// classifyFrpError maps an error reported by frps to a code and exit status.
+func classifyFrpError(reason string) (string, int) {
+	lower := strings.ToLower(reason)
+	switch {
+	case strings.Contains(lower, "authorization failed"), strings.Contains(lower, "token"):
+		return "auth_failed", exitCodeTunnelAuth
+	case strings.Contains(lower, "router config conflict"),
+		strings.Contains(lower, "subdomain") && (strings.Contains(lower, "already") || strings.Contains(lower, "in use")):
+		return "subdomain_in_use", exitCodeTunnelSubdomainInUse
+	case strings.Contains(lower, "port not allowed"):
+		return "port_not_allowed", exitCodeTunnelPortNotAllowed
+	case strings.Contains(lower, "port unavailable"), strings.Contains(lower, "address already in use"):
+		return "port_in_use", exitCodeTunnelPortInUse
+	case strings.Contains(lower, "already exists"):
+		return "proxy_conflict", exitCodeTunnelProxyConflict
+	default:
+		return "proxy_failed", exitCodeTunnelProxyFailed
+	}
+}
+
+var (
+	frpcLoginSuccessPattern = regexp.MustCompile(`login to server success`)
+	frpcLoginFailedPattern  = regexp.MustCompile(`login to the server failed: (.*?)(?:\. With loginFailExit.*)?$`)
+	frpcProxySuccessPattern = regexp.MustCompile(`\[([^\[\]]+)\] start proxy success`)
+	frpcProxyErrorPattern   = regexp.MustCompile(`\[([^\[\]]+)\] start error: (.*)$`)
+	frpcHealthCheckPattern  = regexp.MustCompile(`\[([^\[\]]+)\] health check (success|failed)`)
+)
+
+// tunnelMonitor tracks login and proxy registration so the public URLs are
+// only announced once frps has accepted every proxy.
+type tunnelMonitor struct {
+	cfg    TunnelConfig
+	events *tunnelEvents
+
+	// assignedPorts are the tcp/udp proxies that asked frps for a port
+	// (remote port 0); their RemotePort in cfg is filled in once known.
+	assignedPorts map[string]bool
+
+	mu        sync.Mutex
+	loggedIn  bool
+	ready     map[string]bool
+	runReady  bool
+	announced bool
+
+	// For `kai status`: engine runs so far, why the last one ended, and
+	// the latest error frps reported per proxy.
+	runs        int
+	lastError   string
+	proxyErrors map[string]string
+}
+
+func newTunnelMonitor(cfg TunnelConfig) *tunnelMonitor {
+	m := &tunnelMonitor{
+		cfg:           cfg,
+		events:        newTunnelEvents(cfg.Output, os.Stdout),
+		ready:         make(map[string]bool),
+		assignedPorts: make(map[string]bool),
+		proxyErrors:   make(map[string]string),
+	}
+	for _, proxy := range cfg.Proxies {
+		if (proxy.Type == "tcp" || proxy.Type == "udp") && proxy.RemotePort == 0 {
+			m.assignedPorts[proxy.Name] = true
+		}
+	}
+	return m
+}
+
+// reset forgets the state of the previous engine run.
+func (m *tunnelMonitor) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loggedIn = false
+	m.ready = make(map[string]bool)
+	m.runReady = false
+	m.runs++
+}
+
+// runExited records why an engine run ended.
+func (m *tunnelMonitor) runExited(err error) {
+	if err == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastError = err.Error()
+}
+
+// tunnelSnapshot is the monitor state reported by `kai status`.
+type tunnelSnapshot struct {
+	Connected   bool
+	Restarts    int
+	LastError   string
+	Proxies     []ProxyConfig
+	Ready       map[string]bool
+	ProxyErrors map[string]string
+}
+
+func (m *tunnelMonitor) snapshot() tunnelSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := tunnelSnapshot{
+		Connected:   m.loggedIn,
+		Restarts:    max(m.runs-1, 0),
+		LastError:   m.lastError,
+		Proxies:     append([]ProxyConfig(nil), m.cfg.Proxies...),
+		Ready:       make(map[string]bool, len(m.ready)),
+		ProxyErrors: make(map[string]string, len(m.proxyErrors)),
+	}
+	for name, ready := range m.ready {
+		snap.Ready[name] = ready
+	}
+	for name, reason := range m.proxyErrors {
+		snap.ProxyErrors[name] = reason
+	}
+	return snap
+}
+
+func (m *tunnelMonitor) loginSucceeded() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.loggedIn {
+		m.events.emit(tunnelEvent{Event: "connected", Server: m.cfg.ServerAddr})
+	}
+	m.loggedIn = true
+	m.announceIfReady()
+}
+
+// loginFailed returns a tunnelError when the failure is permanent, such as a
+// rejected token, and nil when a retry may succeed.
+func (m *tunnelMonitor) loginFailed(reason string) error {
+	code, exitCode := classifyFrpError(reason)
+	if code != "auth_failed" {
+		return nil
+	}
+	return &tunnelError{
+		Code:     code,
+		Message:  fmt.Sprintf("error: login to %s rejected: %s", m.cfg.ServerAddr, reason),
+		ExitCode: exitCode,
+	}
+}
+
+func (m *tunnelMonitor) proxyStarted(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.ready[name] {
+		for _, proxy := range m.cfg.Proxies {
+			if proxy.Name == name {
+				m.events.emit(proxyReadyEvent(m.cfg.ServerAddr, proxy))
+			}
+		}
+	}
+	m.ready[name] = true
+	delete(m.proxyErrors, name)
+	m.announceIfReady()
+}
+
+// setSubdomain records a subdomain that replaced a taken one. The proxies are
+// copied so the slice handed out by earlier snapshots stays unchanged.
+func (m *tunnelMonitor) setSubdomain(name, subdomain string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	proxies := slices.Clone(m.cfg.Proxies)
+	for i := range proxies {
+		if proxies[i].Name == name {
+			proxies[i].Subdomain = subdomain
+		}
+	}
+	m.cfg.Proxies = proxies
+}
+
+// needsRemotePort reports whether frps picks the remote port of the proxy.
+func (m *tunnelMonitor) needsRemotePort(name string) bool {
+	return m.assignedPorts[name]
+}
+
+// assignRemotePort records the port frps assigned. It must be called before
+// proxyStarted so the announcement shows the real address. Ports are assigned
+// again after a restart, which can move the tunnel. Like setSubdomain it
+// works on a copy of the proxies.
+func (m *tunnelMonitor) assignRemotePort(name string, port int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	proxies := slices.Clone(m.cfg.Proxies)
+	for i := range proxies {
+		proxy := &proxies[i]
+		if proxy.Name != name {
+			continue
+		}
+		previous := proxy.RemotePort
+		proxy.RemotePort = port
+		if m.announced && previous != port {
+			log.Printf("Tunnel %q moved to %s", name, publicAddress(m.cfg.ServerAddr, *proxy))
+		}
+	}
+	m.cfg.Proxies = proxies
+}
+
+func (m *tunnelMonitor) proxyFailed(name, reason string) error {
+	m.mu.Lock()
+	m.proxyErrors[name] = reason
+	m.mu.Unlock()
+	code, exitCode := classifyFrpError(reason)
+	return &tunnelError{
+		Code:     code,
+		Message:  fmt.Sprintf("error: tunnel %s failed to start: %s", m.describeProxy(name), reason),
+		ExitCode: exitCode,
+		Proxy:    name,
+	}
+}
+
+// localHealthChanged records whether the local service of a proxy passes its
+// health check. While it fails the proxy is withdrawn from frps.
+func (m *tunnelMonitor) localHealthChanged(name string, healthy bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	const reason = "local service health check failed"
+	if healthy {
+		if m.proxyErrors[name] == reason {
+			delete(m.proxyErrors, name)
+			log.Printf("Local service of tunnel %q is healthy again", name)
+		}
+		return
+	}
+	if m.proxyErrors[name] != reason {
+		m.proxyErrors[name] = reason
+		log.Printf("Local service of tunnel %q is failing its health check; the tunnel is withdrawn until it recovers", name)
+	}
+}
+
+// observeFrpcLine feeds one line of frpc output to the monitor and returns a
+// tunnelError when it reports a permanent failure.
+func (m *tunnelMonitor) observeFrpcLine(line string) error {
+	if match := frpcProxyErrorPattern.FindStringSubmatch(line); match != nil {
+		return m.proxyFailed(match[1], strings.TrimSpace(match[2]))
+	}
+	if match := frpcProxySuccessPattern.FindStringSubmatch(line); match != nil {
+		m.proxyStarted(match[1])
+		return nil
+	}
+	if match := frpcHealthCheckPattern.FindStringSubmatch(line); match != nil {
+		m.localHealthChanged(match[1], match[2] == "success")
+		return nil
+	}
+	if frpcLoginSuccessPattern.MatchString(line) {
+		m.loginSucceeded()
+		return nil
+	}
+	if match := frpcLoginFailedPattern.FindStringSubmatch(line); match != nil {
+		return m.loginFailed(strings.TrimSpace(match[1]))
+	}
+	return nil
+}
+
+// announceIfReady must be called with m.mu held.
+func (m *tunnelMonitor) announceIfReady() {
+	if !m.loggedIn || m.runReady {
+		return
+	}
+	for _, proxy := range m.cfg.Proxies {
+		if !m.ready[proxy.Name] {
+			return
+		}
+	}
+	m.runReady = true
+	if m.announced {
+		log.Println("Tunnel reconnected.")
+		return
+	}
+	m.announced = true
+	logTunnelStarted(m.cfg)
+}
+
+func (m *tunnelMonitor) describeProxy(name string) string {
+	for _, proxy := range m.cfg.Proxies {
+		if proxy.Name != name {
+			continue
+		}
+		if addr := publicAddress(m.cfg.ServerAddr, proxy); addr != "" {
+			return fmt.Sprintf("%q (%s)", name, addr)
+		}
+	}
+	return fmt.Sprintf("%q", name)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestClassifyFrpError(t *testing.T) {
+	cases := []struct {
+		reason   string
+		code     string
+		exitCode int
+	}{
+		{"authorization failed", "auth_failed", exitCodeTunnelAuth},
+		{"token in login doesn't match token from configuration", "auth_failed", exitCodeTunnelAuth},
+		{"router config conflict", "subdomain_in_use", exitCodeTunnelSubdomainInUse},
+		{"subdomain [web] is already in use", "subdomain_in_use", exitCodeTunnelSubdomainInUse},
+		{"port not allowed", "port_not_allowed", exitCodeTunnelPortNotAllowed},
+		{"port unavailable", "port_in_use", exitCodeTunnelPortInUse},
+		{"proxy [web] already exists", "proxy_conflict", exitCodeTunnelProxyConflict},
+		{"something unexpected", "proxy_failed", exitCodeTunnelProxyFailed},
+	}
+	for _, tc := range cases {
+		code, exitCode := classifyFrpError(tc.reason)
+		if code != tc.code || exitCode != tc.exitCode {
+			t.Fatalf("classify %q: got %s/%d, want %s/%d", tc.reason, code, exitCode, tc.code, tc.exitCode)
+		}
+	}
+}
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prevOutput, prevFlags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(prevOutput)
+		log.SetFlags(prevFlags)
+	})
+	return &buf
+}
+
+func TestTunnelMonitorAnnouncesAfterAllProxiesStart(t *testing.T) {
+	logs := captureLog(t)
+	monitor := newTunnelMonitor(TunnelConfig{
+		ServerAddr: "p.ranax.co",
+		Proxies: []ProxyConfig{
+			{Name: "web", Type: "http", Subdomain: "web", LocalIP: "127.0.0.1", LocalPort: 3000},
+			{Name: "ssh", Type: "tcp", RemotePort: 22022, LocalIP: "127.0.0.1", LocalPort: 22},
+		},
+	})
+
+	lines := []string{
+		"2025-01-01 10:00:00.000 [I] [client/service.go:301] [7c1b] login to server success, get run id [7c1b]",
+		"2025-01-01 10:00:00.010 [I] [client/control.go:168] [7c1b] [web] start proxy success",
+	}
+	for _, line := range lines {
+		if err := monitor.observeFrpcLine(line); err != nil {
+			t.Fatalf("unexpected error for %q: %v", line, err)
+		}
+	}
+	if strings.Contains(logs.String(), "Tunnel is running") {
+		t.Fatalf("announced before every proxy started: %q", logs.String())
+	}
+
+	if err := monitor.observeFrpcLine("2025-01-01 10:00:00.020 [I] [client/control.go:168] [7c1b] [ssh] start proxy success"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(logs.String(), "Tunnel is running") || !strings.Contains(logs.String(), "web.p.ranax.co") {
+		t.Fatalf("expected announcement, got %q", logs.String())
+	}
+
+	monitor.reset()
+	monitor.loginSucceeded()
+	monitor.proxyStarted("web")
+	monitor.proxyStarted("ssh")
+	if got := strings.Count(logs.String(), "Tunnel is running"); got != 1 {
+		t.Fatalf("expected a single announcement, got %d", got)
+	}
+	if !strings.Contains(logs.String(), "Tunnel reconnected.") {
+		t.Fatalf("expected reconnect message, got %q", logs.String())
+	}
+}
+
+func TestTunnelMonitorReportsFrpcFailures(t *testing.T) {
+	monitor := newTunnelMonitor(TunnelConfig{
+		ServerAddr: "p.ranax.co",
+		Proxies:    []ProxyConfig{{Name: "web", Type: "http", Subdomain: "web"}},
+	})
+
+	err := monitor.observeFrpcLine("2025-01-01 10:00:00.010 [W] [client/control.go:170] [7c1b] [web] start error: router config conflict")
+	var tunnelErr *tunnelError
+	if !errors.As(err, &tunnelErr) || tunnelErr.Code != "subdomain_in_use" {
+		t.Fatalf("expected subdomain_in_use, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "web.p.ranax.co") {
+		t.Fatalf("expected public address in error, got %q", err.Error())
+	}
+
+	err = monitor.observeFrpcLine("2025-01-01 10:00:00.000 [E] [client/service.go:295] login to the server failed: authorization failed. With loginFailExit enabled, no additional retries will be attempted")
+	if !errors.As(err, &tunnelErr) || tunnelErr.ExitCode != exitCodeTunnelAuth {
+		t.Fatalf("expected auth failure, got %v", err)
+	}
+
+	err = monitor.observeFrpcLine("2025-01-01 10:00:00.000 [E] [client/service.go:295] login to the server failed: dial tcp 1.2.3.4:7000: connect: connection refused")
+	if err != nil {
+		t.Fatalf("connection errors should be retried, got %v", err)
+	}
+}
+
+func TestTunnelMonitorUsesAssignedRemotePort(t *testing.T) {
+	logs := captureLog(t)
+	proxies := []ProxyConfig{
+		{Name: "ssh", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: 22},
+		{Name: "dns", Type: "udp", LocalIP: "127.0.0.1", LocalPort: 53, RemotePort: 5353},
+	}
+	monitor := newTunnelMonitor(TunnelConfig{ServerAddr: "p.ranax.co", Proxies: proxies})
+	if !monitor.needsRemotePort("ssh") || monitor.needsRemotePort("dns") {
+		t.Fatalf("only the proxy without a remote port needs one assigned")
+	}
+
+	monitor.loginSucceeded()
+	monitor.assignRemotePort("ssh", 39123)
+	monitor.proxyStarted("ssh")
+	monitor.proxyStarted("dns")
+	if !strings.Contains(logs.String(), "p.ranax.co:39123 -> 127.0.0.1:22") {
+		t.Fatalf("expected the assigned port in the announcement, got %q", logs.String())
+	}
+
+	monitor.reset()
+	monitor.assignRemotePort("ssh", 40000)
+	if !strings.Contains(logs.String(), `Tunnel "ssh" moved to p.ranax.co:40000`) {
+		t.Fatalf("expected a notice when the port changes, got %q", logs.String())
+	}
+	if proxies[0].RemotePort != 0 {
+		t.Fatalf("the caller's proxies should not be written to, got %+v", proxies[0])
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	nativeDialTimeout       = 10 * time.Second
+	nativeLoginTimeout      = 10 * time.Second
+	nativeHeartbeatInterval = 30 * time.Second
+	nativeHeartbeatTimeout  = 90 * time.Second
+	nativePoolCount         = 1
+)
+
+// nativeClient speaks the frp client protocol in-process so a tunnel is a
+// goroutine instead of an extracted frpc child process.
+type nativeClient struct {
+	cfg        TunnelConfig
+	proxies    map[string]ProxyConfig
+	tlsConfigs map[string]*tls.Config
+	limiters   map[string]*bandwidthLimiter
+	traffic    trafficStats
+	health     *localHealth
+	monitor    *tunnelMonitor
+
+	session  *muxSession
+	runID    string
+	ctlMu    sync.Mutex
+	ctl      io.ReadWriter
+	lastPong atomic.Int64
+
+	// registered are the proxies frps currently has. Proxies are closed
+	// while their local service is down.
+	registerMu sync.Mutex
+	registered map[string]bool
+}
+
+func newNativeClient(cfg TunnelConfig) (*nativeClient, error) {
+	client := &nativeClient{
+		cfg:        cfg,
+		proxies:    make(map[string]ProxyConfig, len(cfg.Proxies)),
+		tlsConfigs: make(map[string]*tls.Config),
+		limiters:   make(map[string]*bandwidthLimiter),
+		traffic:    cfg.Traffic,
+		health:     cfg.Health,
+		registered: make(map[string]bool),
+	}
+	for _, proxy := range cfg.Proxies {
+		client.proxies[proxy.Name] = proxy
+		// In server mode frps enforces the limit.
+		if proxy.BandwidthLimit > 0 && proxy.BandwidthLimitMode != "server" {
+			client.limiters[proxy.Name] = newBandwidthLimiter(proxy.BandwidthLimit)
+		}
+		if proxy.LocalTLS {
+			tlsConfig, err := localTLSConfig(cfg.ServerAddr, proxy)
+			if err != nil {
+				return nil, err
+			}
+			client.tlsConfigs[proxy.Name] = tlsConfig
+		}
+	}
+	return client, nil
+}
+
+func runNativeTunnel(ctx context.Context, cfg TunnelConfig, monitor *tunnelMonitor) error {
+	for _, proxy := range cfg.Proxies {
+		if proxy.Type == "xtcp" {
+			return fmt.Errorf("error: xtcp tunnels need NAT hole punching; use --engine frpc")
+		}
+	}
+	for _, visitor := range cfg.Visitors {
+		if visitor.Type == "xtcp" {
+			return fmt.Errorf("error: xtcp visitors need NAT hole punching; use --engine frpc")
+		}
+	}
+	if cfg.Transport.Protocol != "" && cfg.Transport.Protocol != "tcp" {
+		return fmt.Errorf("error: the native engine only connects over tcp; use --engine frpc for --protocol %s", cfg.Transport.Protocol)
+	}
+	for _, proxy := range cfg.Proxies {
+		if proxy.UseCompression {
+			return fmt.Errorf("error: --use-compression needs --engine frpc")
+		}
+	}
+	for _, visitor := range cfg.Visitors {
+		if visitor.UseCompression {
+			return fmt.Errorf("error: --use-compression needs --engine frpc")
+		}
+	}
+
+	client, err := newNativeClient(cfg)
+	if err != nil {
+		return err
+	}
+	client.monitor = monitor
+	if err := client.login(ctx); err != nil {
+		return err
+	}
+	return client.serve(ctx)
+}
+
+// login dials frps, opens the control stream and authenticates with the token.
+func (c *nativeClient) login(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: nativeDialTimeout}
+	serverAddr := net.JoinHostPort(c.cfg.ServerAddr, strconv.Itoa(c.cfg.ServerPort))
+	conn, err := dialer.DialContext(ctx, "tcp", serverAddr)
+	if err != nil {
+		return fmt.Errorf("connect to server error: %w", err)
+	}
+	if c.cfg.Transport.TLS {
+		tlsConfig, err := c.cfg.Transport.clientTLSConfig(c.cfg.ServerAddr)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		handshakeCtx, cancel := context.WithTimeout(ctx, nativeDialTimeout)
+		err = tlsConn.HandshakeContext(handshakeCtx)
+		cancel()
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("connect to server error: tls handshake: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	session := newMuxSession(conn, true)
+	stream, err := session.Open()
+	if err != nil {
+		session.Close()
+		return fmt.Errorf("open control stream: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now().Unix()
+	login := frpLogin{
+		Version:      frpProtocolVersion,
+		Hostname:     hostname,
+		Os:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		PrivilegeKey: frpAuthKey(c.cfg.Token, now),
+		Timestamp:    now,
+		PoolCount:    max(c.cfg.Transport.PoolCount, nativePoolCount),
+	}
+	if err := writeFrpMsg(stream, frpMsgLogin, login); err != nil {
+		session.Close()
+		return fmt.Errorf("send login: %w", err)
+	}
+
+	var resp frpLoginResp
+	_ = stream.SetReadDeadline(time.Now().Add(nativeLoginTimeout))
+	if err := readFrpMsgInto(stream, frpMsgLoginResp, &resp); err != nil {
+		session.Close()
+		return fmt.Errorf("read login response: %w", err)
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+	if resp.Error != "" {
+		session.Close()
+		if err := c.monitor.loginFailed(resp.Error); err != nil {
+			return err
+		}
+		return fmt.Errorf("login to server failed: %s", resp.Error)
+	}
+
+	ctl, err := newFrpCryptoConn(stream, c.cfg.Token)
+	if err != nil {
+		session.Close()
+		return err
+	}
+
+	c.session = session
+	c.runID = resp.RunID
+	c.ctl = ctl
+	c.lastPong.Store(time.Now().UnixNano())
+	log.Printf("login to server success, get run id [%s]", resp.RunID)
+	return nil
+}
+
+// serve registers every proxy and handles control messages until the context
+// is canceled or the control connection is lost.
+func (c *nativeClient) serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer c.session.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		c.session.Close()
+	})
+	defer stop()
+
+	// A proxy whose local service is down is registered once it is back.
+	// A failed write also breaks the control loop below.
+	stopWatch := c.health.watch(func(name string, up bool) {
+		_ = c.syncProxy(name)
+	})
+	defer stopWatch()
+	for _, proxy := range c.cfg.Proxies {
+		if err := c.syncProxy(proxy.Name); err != nil {
+			return fmt.Errorf("register proxy %s: %w", proxy.Name, err)
+		}
+	}
+	for _, visitor := range c.cfg.Visitors {
+		ln, err := net.Listen("tcp", net.JoinHostPort(visitor.BindAddr, strconv.Itoa(visitor.BindPort)))
+		if err != nil {
+			return fmt.Errorf("visitor %s: %w", visitor.Name, err)
+		}
+		defer ln.Close()
+		go c.acceptVisitorConns(visitor, ln)
+	}
+	c.monitor.loginSucceeded()
+
+	go c.heartbeat(ctx)
+
+	for {
+		msgType, body, err := readFrpMsg(c.ctl)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("control connection lost: %w", err)
+		}
+
+		switch msgType {
+		case frpMsgReqWorkConn:
+			go c.handleWorkConn()
+		case frpMsgNewProxyResp:
+			var resp frpNewProxyResp
+			if err := json.Unmarshal(body, &resp); err != nil {
+				return fmt.Errorf("decode proxy response: %w", err)
+			}
+			if resp.Error != "" {
+				log.Printf("[%s] start error: %s", resp.ProxyName, resp.Error)
+				return c.monitor.proxyFailed(resp.ProxyName, resp.Error)
+			}
+			log.Printf("[%s] start proxy success", resp.ProxyName)
+			if port, ok := remoteAddrPort(resp.RemoteAddr); ok && c.monitor.needsRemotePort(resp.ProxyName) {
+				c.monitor.assignRemotePort(resp.ProxyName, port)
+			}
+			c.monitor.proxyStarted(resp.ProxyName)
+		case frpMsgPong:
+			var pong frpPong
+			if err := json.Unmarshal(body, &pong); err != nil {
+				return fmt.Errorf("decode pong: %w", err)
+			}
+			if pong.Error != "" {
+				return fmt.Errorf("heartbeat rejected: %s", pong.Error)
+			}
+			c.lastPong.Store(time.Now().UnixNano())
+		}
+	}
+}
+
+// syncProxy registers the named proxy with frps while its local service is
+// up and closes it while the service is down.
+func (c *nativeClient) syncProxy(name string) error {
+	c.registerMu.Lock()
+	defer c.registerMu.Unlock()
+	up := c.health.isUp(name)
+	if c.registered[name] == up {
+		return nil
+	}
+	var err error
+	if up {
+		err = c.writeControl(frpMsgNewProxy, newFrpProxyMsg(c.proxies[name]))
+	} else {
+		err = c.writeControl(frpMsgCloseProxy, frpCloseProxy{ProxyName: name})
+	}
+	if err != nil {
+		return err
+	}
+	c.registered[name] = up
+	return nil
+}
+
+func (c *nativeClient) writeControl(msgType byte, msg any) error {
+	c.ctlMu.Lock()
+	defer c.ctlMu.Unlock()
+	return writeFrpMsg(c.ctl, msgType, msg)
+}
+
+func (c *nativeClient) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(nativeHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, c.lastPong.Load())) > nativeHeartbeatTimeout {
+				log.Println("heartbeat timeout, closing control connection")
+				c.session.Close()
+				return
+			}
+			now := time.Now().Unix()
+			ping := frpPing{PrivilegeKey: frpAuthKey(c.cfg.Token, now), Timestamp: now}
+			if err := c.writeControl(frpMsgPing, ping); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleWorkConn answers a ReqWorkConn: it opens a new stream, registers it as
+// a work connection and, once frps assigns a user connection to it, joins it
+// with the local service.
+func (c *nativeClient) handleWorkConn() {
+	stream, err := c.session.Open()
+	if err != nil {
+		return
+	}
+
+	now := time.Now().Unix()
+	workMsg := frpNewWorkConn{
+		RunID:        c.runID,
+		PrivilegeKey: frpAuthKey(c.cfg.Token, now),
+		Timestamp:    now,
+	}
+	if err := writeFrpMsg(stream, frpMsgNewWorkConn, workMsg); err != nil {
+		stream.Close()
+		return
+	}
+
+	var start frpStartWorkConn
+	if err := readFrpMsgInto(stream, frpMsgStartWorkConn, &start); err != nil {
+		stream.Close()
+		return
+	}
+	if start.Error != "" {
+		log.Printf("[%s] work connection rejected: %s", start.ProxyName, start.Error)
+		stream.Close()
+		return
+	}
+
+	proxy, ok := c.proxies[start.ProxyName]
+	if !ok {
+		stream.Close()
+		return
+	}
+
+	// frps encrypts work connections with the token.
+	var workConn net.Conn = stream
+	if proxy.UseEncryption {
+		if workConn, err = newFrpEncryptedConn(stream, c.cfg.Token); err != nil {
+			stream.Close()
+			return
+		}
+	}
+
+	localAddr := net.JoinHostPort(proxy.LocalIP, strconv.Itoa(proxy.LocalPort))
+	if proxy.Type == "udp" {
+		udpAddr, err := net.ResolveUDPAddr("udp", localAddr)
+		if err != nil {
+			log.Printf("[%s] resolve local service [%s] error: %v", proxy.Name, localAddr, err)
+			workConn.Close()
+			return
+		}
+		serveUDPWorkConn(workConn, udpAddr)
+		return
+	}
+
+	if tlsConfig := c.tlsConfigs[proxy.Name]; tlsConfig != nil {
+		workConn = tls.Server(workConn, tlsConfig)
+	}
+
+	local, err := net.DialTimeout("tcp", localAddr, nativeDialTimeout)
+	if err != nil {
+		log.Printf("[%s] connect to local service [%s] error: %v", proxy.Name, localAddr, err)
+		workConn.Close()
+		return
+	}
+	if limiter := c.limiters[proxy.Name]; limiter != nil {
+		local = &limitedConn{Conn: local, limiter: limiter}
+	}
+	if counter := c.traffic.counter(proxy.Name); counter != nil {
+		counter.join(workConn, local)
+		return
+	}
+	joinConns(workConn, local)
+}
+
+func newFrpProxyMsg(proxy ProxyConfig) frpNewProxy {
+	msg := frpNewProxy{
+		ProxyName:      proxy.Name,
+		ProxyType:      proxy.Type,
+		UseEncryption:  proxy.UseEncryption,
+		UseCompression: proxy.UseCompression,
+	}
+	if proxy.BandwidthLimit > 0 {
+		msg.BandwidthLimit = proxy.BandwidthQuantity()
+		msg.BandwidthLimitMode = cmp.Or(proxy.BandwidthLimitMode, "client")
+	}
+	switch proxy.Type {
+	case "http", "https":
+		msg.SubDomain = proxy.Subdomain
+		msg.CustomDomains = proxy.CustomDomains
+		msg.HTTPUser = proxy.HTTPUser
+		msg.HTTPPwd = proxy.HTTPPassword
+		msg.HostHeaderRewrite = proxy.HostHeaderRewrite
+		msg.Headers = proxy.RequestHeaders
+		msg.ResponseHeaders = proxy.ResponseHeaders
+		msg.Group = proxy.Group
+		msg.GroupKey = proxy.GroupKey
+	case "tcp", "udp":
+		msg.RemotePort = proxy.RemotePort
+		msg.Group = proxy.Group
+		msg.GroupKey = proxy.GroupKey
+	case "stcp":
+		msg.Sk = proxy.SecretKey
+	}
+	return msg
+}
+
+func (c *nativeClient) acceptVisitorConns(visitor VisitorConfig, ln net.Listener) {
+	for {
+		userConn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go c.handleVisitorConn(visitor, userConn)
+	}
+}
+
+// handleVisitorConn asks frps to connect a local visitor connection to the
+// named secret proxy, signing the request with the shared secret.
+func (c *nativeClient) handleVisitorConn(visitor VisitorConfig, userConn net.Conn) {
+	stream, err := c.session.Open()
+	if err != nil {
+		userConn.Close()
+		return
+	}
+
+	now := time.Now().Unix()
+	visitorMsg := frpNewVisitorConn{
+		RunID:     c.runID,
+		ProxyName: visitor.ServerName,
+		SignKey:   frpAuthKey(visitor.SecretKey, now),
+		Timestamp: now,
+
+		UseEncryption:  visitor.UseEncryption,
+		UseCompression: visitor.UseCompression,
+	}
+	if err := writeFrpMsg(stream, frpMsgNewVisitor, visitorMsg); err != nil {
+		stream.Close()
+		userConn.Close()
+		return
+	}
+
+	var resp frpNewVisitorConnResp
+	_ = stream.SetReadDeadline(time.Now().Add(nativeLoginTimeout))
+	if err := readFrpMsgInto(stream, frpMsgNewVisitorRsp, &resp); err != nil {
+		stream.Close()
+		userConn.Close()
+		return
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+	if resp.Error != "" {
+		log.Printf("[%s] visitor connection rejected: %s", visitor.Name, resp.Error)
+		stream.Close()
+		userConn.Close()
+		return
+	}
+	// frps encrypts visitor connections with the secret key.
+	var remote net.Conn = stream
+	if visitor.UseEncryption {
+		if remote, err = newFrpEncryptedConn(stream, visitor.SecretKey); err != nil {
+			stream.Close()
+			userConn.Close()
+			return
+		}
+	}
+	joinConns(remote, userConn)
+}
+
+// joinConns copies in both directions and closes both sides as soon as either
+// direction finishes.
+func joinConns(a, b io.ReadWriteCloser) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(a, b)
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(b, a)
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+}
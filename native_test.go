@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveFrpsStandIn plays the frps side for one client: it checks the login
+// token, accepts the proxy registration, requests a work connection and pushes
+// payload through it, expecting the local service to echo it back. The session
+// stays open until done is closed so the client can shut down on its own.
+// With encrypted set the work connection is encrypted with the token.
+func serveFrpsStandIn(ln net.Listener, token string, payload []byte, done <-chan struct{}, encrypted bool) error {
+	session, ctl, err := acceptFrpsLogin(ln, token)
+	if err != nil || ctl == nil {
+		return err
+	}
+	go func() {
+		<-done
+		session.Close()
+	}()
+
+	var newProxy frpNewProxy
+	if err := readFrpMsgInto(ctl, frpMsgNewProxy, &newProxy); err != nil {
+		return fmt.Errorf("read new proxy: %w", err)
+	}
+	if newProxy.ProxyType != "tcp" || newProxy.RemotePort != 6000 || newProxy.UseEncryption != encrypted {
+		return fmt.Errorf("unexpected proxy registration: %+v", newProxy)
+	}
+	if err := writeFrpMsg(ctl, frpMsgNewProxyResp, frpNewProxyResp{ProxyName: newProxy.ProxyName, RemoteAddr: ":6000"}); err != nil {
+		return err
+	}
+	if err := writeFrpMsg(ctl, frpMsgReqWorkConn, frpReqWorkConn{}); err != nil {
+		return err
+	}
+
+	stream, err := session.Accept()
+	if err != nil {
+		return fmt.Errorf("accept work stream: %w", err)
+	}
+	var workStream net.Conn = stream
+	var workConn frpNewWorkConn
+	if err := readFrpMsgInto(workStream, frpMsgNewWorkConn, &workConn); err != nil {
+		return fmt.Errorf("read new work conn: %w", err)
+	}
+	if workConn.RunID != "run-1" {
+		return fmt.Errorf("unexpected run id %q", workConn.RunID)
+	}
+	if err := writeFrpMsg(workStream, frpMsgStartWorkConn, frpStartWorkConn{ProxyName: newProxy.ProxyName}); err != nil {
+		return err
+	}
+	if encrypted {
+		if workStream, err = newFrpEncryptedConn(stream, token); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		_, _ = workStream.Write(payload)
+	}()
+	echoed := make([]byte, len(payload))
+	if _, err := io.ReadFull(workStream, echoed); err != nil {
+		return fmt.Errorf("read echoed payload: %w", err)
+	}
+	if !bytes.Equal(echoed, payload) {
+		return errors.New("echoed payload mismatch")
+	}
+	return nil
+}
+
+// acceptFrpsLogin accepts one client session and answers its login. A nil
+// control connection means the login was rejected.
+func acceptFrpsLogin(ln net.Listener, token string) (*muxSession, *frpCryptoConn, error) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	session := newMuxSession(conn, false)
+
+	ctlStream, err := session.Accept()
+	if err != nil {
+		session.Close()
+		return nil, nil, fmt.Errorf("accept control stream: %w", err)
+	}
+	var login frpLogin
+	if err := readFrpMsgInto(ctlStream, frpMsgLogin, &login); err != nil {
+		session.Close()
+		return nil, nil, fmt.Errorf("read login: %w", err)
+	}
+	if login.PrivilegeKey != frpAuthKey(token, login.Timestamp) {
+		err := writeFrpMsg(ctlStream, frpMsgLoginResp, frpLoginResp{Error: "authorization failed"})
+		return session, nil, err
+	}
+	if err := writeFrpMsg(ctlStream, frpMsgLoginResp, frpLoginResp{Version: frpProtocolVersion, RunID: "run-1"}); err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	ctl, err := newFrpCryptoConn(ctlStream, token)
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	return session, ctl, nil
+}
+
+func startEchoServer(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen echo: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestNativeClientAgainstFrpsStandIn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen stand-in: %v", err)
+	}
+	defer ln.Close()
+	testNativeRoundTrip(t, ln, TransportConfig{}, false)
+}
+
+func TestNativeClientWithTLSAndEncryption(t *testing.T) {
+	certPEM, keyPEM, err := generateSelfSignedCert("frps.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen stand-in: %v", err)
+	}
+	ln := tls.NewListener(inner, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer ln.Close()
+	testNativeRoundTrip(t, ln, TransportConfig{TLS: true, TLSCAFile: caFile, TLSServerName: "frps.test"}, true)
+}
+
+// testNativeRoundTrip runs a native tcp tunnel against the stand-in on ln and
+// checks that data makes it through and the client stops cleanly.
+func testNativeRoundTrip(t *testing.T, ln net.Listener, transport TransportConfig, encrypted bool) {
+	t.Helper()
+	echoPort := startEchoServer(t)
+
+	payload := make([]byte, 600*1024)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("random payload: %v", err)
+	}
+	stopServer := make(chan struct{})
+	defer close(stopServer)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- serveFrpsStandIn(ln, "secret", payload, stopServer, encrypted)
+	}()
+
+	cfg := TunnelConfig{
+		ServerAddr: "127.0.0.1",
+		ServerPort: ln.Addr().(*net.TCPAddr).Port,
+		Token:      "secret",
+		Transport:  transport,
+		Proxies: []ProxyConfig{
+			{Name: "db", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: echoPort, RemotePort: 6000, UseEncryption: encrypted},
+		},
+	}
+	cfg.Traffic = newTrafficStats(cfg.Proxies)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- runNativeTunnel(ctx, cfg, newTunnelMonitor(cfg))
+	}()
+
+	select {
+	case err := <-serverErr:
+		if err != nil {
+			t.Fatalf("stand-in: %v", err)
+		}
+	case err := <-clientErr:
+		t.Fatalf("client exited early: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for tunnel round trip")
+	}
+	if counter := cfg.Traffic.counter("db"); counter.BytesIn.Load() != int64(len(payload)) || counter.BytesOut.Load() != int64(len(payload)) {
+		t.Fatalf("expected the native client to count %d bytes each way, got %d in, %d out", len(payload), counter.BytesIn.Load(), counter.BytesOut.Load())
+	}
+
+	cancel()
+	select {
+	case err := <-clientErr:
+		if err != nil {
+			t.Fatalf("expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client did not stop after cancel")
+	}
+}
+
+func TestNativeClientRejectsBadToken(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen stand-in: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		_ = serveFrpsStandIn(ln, "right-token", nil, nil, false)
+	}()
+
+	cfg := TunnelConfig{
+		ServerAddr: "127.0.0.1",
+		ServerPort: ln.Addr().(*net.TCPAddr).Port,
+		Token:      "wrong-token",
+		Proxies:    []ProxyConfig{{Name: "db", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: 1, RemotePort: 6000}},
+	}
+	err = runNativeTunnel(context.Background(), cfg, newTunnelMonitor(cfg))
+	var tunnelErr *tunnelError
+	if !errors.As(err, &tunnelErr) || tunnelErr.Code != "auth_failed" || !strings.Contains(err.Error(), "authorization failed") {
+		t.Fatalf("expected authorization failure, got %v", err)
+	}
+}
+
+func TestNativeVisitorAgainstFrpsStandIn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen stand-in: %v", err)
+	}
+	defer ln.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		session, ctl, err := acceptFrpsLogin(ln, "secret")
+		if err != nil || ctl == nil {
+			serverErr <- fmt.Errorf("login failed: %v", err)
+			return
+		}
+		defer session.Close()
+
+		stream, err := session.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		var visit frpNewVisitorConn
+		if err := readFrpMsgInto(stream, frpMsgNewVisitor, &visit); err != nil {
+			serverErr <- err
+			return
+		}
+		if visit.ProxyName != "postgres" || visit.SignKey != frpAuthKey("db-key", visit.Timestamp) {
+			serverErr <- fmt.Errorf("unexpected visitor request: %+v", visit)
+			return
+		}
+		if err := writeFrpMsg(stream, frpMsgNewVisitorRsp, frpNewVisitorConnResp{ProxyName: visit.ProxyName}); err != nil {
+			serverErr <- err
+			return
+		}
+		_, err = io.Copy(stream, stream)
+		serverErr <- err
+	}()
+
+	bindLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("reserve bind port: %v", err)
+	}
+	bindPort := bindLn.Addr().(*net.TCPAddr).Port
+	bindLn.Close()
+
+	cfg := TunnelConfig{
+		ServerAddr: "127.0.0.1",
+		ServerPort: ln.Addr().(*net.TCPAddr).Port,
+		Token:      "secret",
+		Visitors: []VisitorConfig{
+			{Name: "postgres-visitor", Type: "stcp", ServerName: "postgres", SecretKey: "db-key", BindAddr: "127.0.0.1", BindPort: bindPort},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = runNativeTunnel(ctx, cfg, newTunnelMonitor(cfg))
+	}()
+
+	var conn net.Conn
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", bindPort))
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial visitor port: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("SELECT 1")); err != nil {
+		t.Fatalf("write through visitor: %v", err)
+	}
+	reply := make([]byte, len("SELECT 1"))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read through visitor: %v", err)
+	}
+	if string(reply) != "SELECT 1" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+}
+
+func TestNativeUDPProxyAgainstFrpsStandIn(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp echo: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, udpPacketSize)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen stand-in: %v", err)
+	}
+	defer ln.Close()
+
+	peer := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+	serverErr := make(chan error, 1)
+	go func() {
+		session, ctl, err := acceptFrpsLogin(ln, "secret")
+		if err != nil || ctl == nil {
+			serverErr <- fmt.Errorf("login failed: %v", err)
+			return
+		}
+		defer session.Close()
+
+		var newProxy frpNewProxy
+		if err := readFrpMsgInto(ctl, frpMsgNewProxy, &newProxy); err != nil {
+			serverErr <- err
+			return
+		}
+		if newProxy.ProxyType != "udp" || newProxy.RemotePort != 5353 {
+			serverErr <- fmt.Errorf("unexpected proxy registration: %+v", newProxy)
+			return
+		}
+		if err := writeFrpMsg(ctl, frpMsgReqWorkConn, frpReqWorkConn{}); err != nil {
+			serverErr <- err
+			return
+		}
+		workStream, err := session.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		var workConn frpNewWorkConn
+		if err := readFrpMsgInto(workStream, frpMsgNewWorkConn, &workConn); err != nil {
+			serverErr <- err
+			return
+		}
+		if err := writeFrpMsg(workStream, frpMsgStartWorkConn, frpStartWorkConn{ProxyName: newProxy.ProxyName}); err != nil {
+			serverErr <- err
+			return
+		}
+		if err := writeFrpMsg(workStream, frpMsgUDPPacket, frpUDPPacket{Content: []byte("dns query"), RemoteAddr: peer}); err != nil {
+			serverErr <- err
+			return
+		}
+		var reply frpUDPPacket
+		if err := readFrpMsgInto(workStream, frpMsgUDPPacket, &reply); err != nil {
+			serverErr <- err
+			return
+		}
+		if string(reply.Content) != "dns query" || reply.RemoteAddr.String() != peer.String() {
+			serverErr <- fmt.Errorf("unexpected udp reply: %+v", reply)
+			return
+		}
+		serverErr <- nil
+	}()
+
+	cfg := TunnelConfig{
+		ServerAddr: "127.0.0.1",
+		ServerPort: ln.Addr().(*net.TCPAddr).Port,
+		Token:      "secret",
+		Proxies: []ProxyConfig{
+			{Name: "dns", Type: "udp", LocalIP: "127.0.0.1", LocalPort: echo.LocalAddr().(*net.UDPAddr).Port, RemotePort: 5353},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = runNativeTunnel(ctx, cfg, newTunnelMonitor(cfg))
+	}()
+
+	select {
+	case err := <-serverErr:
+		if err != nil {
+			t.Fatalf("stand-in: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for udp round trip")
+	}
+}
+
+func TestNativeClientWithdrawsProxyWhileLocalServiceIsDown(t *testing.T) {
+	captureLog(t)
+	echo := listenEcho(t, "127.0.0.1:0")
+	echoAddr := echo.Addr().String()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen stand-in: %v", err)
+	}
+	defer ln.Close()
+
+	// The stand-in accepts every registration and reports the proxy
+	// messages it receives.
+	type proxyMsg struct {
+		msgType byte
+		name    string
+	}
+	received := make(chan proxyMsg, 10)
+	go func() {
+		session, ctl, err := acceptFrpsLogin(ln, "secret")
+		if err != nil || ctl == nil {
+			return
+		}
+		defer session.Close()
+		for {
+			msgType, body, err := readFrpMsg(ctl)
+			if err != nil {
+				return
+			}
+			switch msgType {
+			case frpMsgNewProxy:
+				var msg frpNewProxy
+				_ = json.Unmarshal(body, &msg)
+				received <- proxyMsg{msgType, msg.ProxyName}
+				_ = writeFrpMsg(ctl, frpMsgNewProxyResp, frpNewProxyResp{ProxyName: msg.ProxyName, RemoteAddr: ":6000"})
+			case frpMsgCloseProxy:
+				var msg frpCloseProxy
+				_ = json.Unmarshal(body, &msg)
+				received <- proxyMsg{msgType, msg.ProxyName}
+			}
+		}
+	}()
+
+	cfg := TunnelConfig{
+		ServerAddr: "127.0.0.1",
+		ServerPort: ln.Addr().(*net.TCPAddr).Port,
+		Token:      "secret",
+		Proxies: []ProxyConfig{
+			{Name: "db", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: echo.Addr().(*net.TCPAddr).Port, RemotePort: 6000},
+		},
+	}
+	monitor := newTunnelMonitor(cfg)
+	cfg.Health = newLocalHealth(cfg.Proxies, monitor)
+	cfg.Health.interval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cfg.Health.run(ctx)
+	go func() {
+		_ = runNativeTunnel(ctx, cfg, monitor)
+	}()
+
+	expect := func(msgType byte, what string) {
+		t.Helper()
+		select {
+		case msg := <-received:
+			if msg.msgType != msgType || msg.name != "db" {
+				t.Fatalf("expected %s, got %q for %q", what, msg.msgType, msg.name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+	expect(frpMsgNewProxy, "the proxy to be registered")
+	echo.Close()
+	expect(frpMsgCloseProxy, "the proxy to be closed while the service is down")
+	if got := monitor.snapshot().ProxyErrors["db"]; got != "local service health check failed" {
+		t.Fatalf("expected the failing check in the status, got %q", got)
+	}
+	echo = listenEcho(t, echoAddr)
+	defer echo.Close()
+	expect(frpMsgNewProxy, "the proxy to be registered again")
+}
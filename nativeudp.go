@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	udpPacketSize        = 1500
+	udpIdleTimeout       = 60 * time.Second
+	udpWorkConnHeartbeat = 30 * time.Second
+)
+
+// serveUDPWorkConn relays datagrams between a UDP proxy's work connection and
+// the local service. Every remote peer gets its own local socket so replies
+// can be routed back to the right sender.
+func serveUDPWorkConn(workConn io.ReadWriteCloser, localAddr *net.UDPAddr) {
+	defer workConn.Close()
+
+	var writeMu sync.Mutex
+	send := func(msgType byte, msg any) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return writeFrpMsg(workConn, msgType, msg)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(udpWorkConnHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := send(frpMsgPing, frpPing{}); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	peers := make(map[string]*net.UDPConn)
+	defer func() {
+		mu.Lock()
+		for _, conn := range peers {
+			conn.Close()
+		}
+		mu.Unlock()
+	}()
+
+	for {
+		msgType, body, err := readFrpMsg(workConn)
+		if err != nil {
+			return
+		}
+		if msgType != frpMsgUDPPacket {
+			continue
+		}
+		var packet frpUDPPacket
+		if err := json.Unmarshal(body, &packet); err != nil || packet.RemoteAddr == nil {
+			continue
+		}
+
+		key := packet.RemoteAddr.String()
+		mu.Lock()
+		conn := peers[key]
+		if conn == nil {
+			conn, err = net.DialUDP("udp", nil, localAddr)
+			if err != nil {
+				mu.Unlock()
+				continue
+			}
+			peers[key] = conn
+			go relayUDPReplies(conn, localAddr, packet.RemoteAddr, send, func() {
+				mu.Lock()
+				if peers[key] == conn {
+					delete(peers, key)
+				}
+				mu.Unlock()
+			})
+		}
+		mu.Unlock()
+
+		_, _ = conn.Write(packet.Content)
+	}
+}
+
+// relayUDPReplies forwards datagrams from the local service back to remote
+// until the peer has been idle for udpIdleTimeout.
+func relayUDPReplies(conn *net.UDPConn, localAddr, remote *net.UDPAddr, send func(byte, any) error, onClose func()) {
+	defer onClose()
+	defer conn.Close()
+
+	buf := make([]byte, udpPacketSize)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		packet := frpUDPPacket{
+			Content:    append([]byte(nil), buf[:n]...),
+			LocalAddr:  localAddr,
+			RemoteAddr: remote,
+		}
+		if err := send(frpMsgUDPPacket, packet); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// tunnelProfile is a named tunnel declared as [tunnels.<name>] in config.toml.
+type tunnelProfile struct {
+	Name  string
+	Proxy ProxyConfig
+}
+
+func runUp(args []string) error {
+	defaults, err := loadTunnelDefaults()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(args))
+	normalizedArgs := args
+	for len(normalizedArgs) > 0 && !strings.HasPrefix(normalizedArgs[0], "-") {
+		names = append(names, normalizedArgs[0])
+		normalizedArgs = normalizedArgs[1:]
+	}
+
+	fs := flag.NewFlagSet("up", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		printUpUsage(fs, defaults.Profiles)
+	}
+
+	all := fs.Bool("all", false, "Start every tunnel defined in config.toml")
+	subFromGit := fs.Bool("subdomain-from-git", false, "Derive missing subdomains from the git repository and branch")
+	waitLocal := fs.Duration("wait-local", 0, "Wait up to this long for the local services before starting the tunnels (e.g. 60s)")
+	var detach bool
+	fs.BoolVar(&detach, "d", false, "Run the tunnels in the background (shorthand for --detach)")
+	fs.BoolVar(&detach, "detach", false, "Run the tunnels in the background; see kai ls and kai stop")
+	conn := registerConnectionFlags(fs, defaults)
+	inspect := registerInspectFlags(fs)
+
+	// Names may also follow flags, as in `kai up -d web --server ...`.
+	for {
+		if err := fs.Parse(normalizedArgs); err != nil {
+			return err
+		}
+		// The flag package stops at a bare "-" without consuming it.
+		if len(fs.Args()) > 0 && len(fs.Args()) == len(normalizedArgs) {
+			fs.Usage()
+			return fmt.Errorf("error: unexpected argument %q", fs.Arg(0))
+		}
+		normalizedArgs = fs.Args()
+		for len(normalizedArgs) > 0 && !strings.HasPrefix(normalizedArgs[0], "-") {
+			names = append(names, normalizedArgs[0])
+			normalizedArgs = normalizedArgs[1:]
+		}
+		if len(normalizedArgs) == 0 {
+			break
+		}
+	}
+
+	profiles, err := selectProfiles(defaults.Profiles, names, *all)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	proxies := make([]ProxyConfig, 0, len(profiles))
+	for _, profile := range profiles {
+		proxy := profile.Proxy
+		if proxy.Type == "" {
+			proxy.Type = "http"
+		}
+		if proxy.LocalIP == "" {
+			proxy.LocalIP = *conn.localHost
+		}
+		proxy.Name = fmt.Sprintf("%s-%d", profile.Name, now)
+		if isSecretProxyType(proxy.Type) {
+			proxy.Name = profile.Name
+		}
+		proxies = append(proxies, proxy)
+	}
+	if err := assignSubdomains(proxies, *subFromGit); err != nil {
+		return err
+	}
+	for i, proxy := range proxies {
+		if err := validateProxy(proxy); err != nil {
+			return fmt.Errorf("tunnel %q: %w", profiles[i].Name, err)
+		}
+	}
+
+	cfg := conn.tunnelConfig(proxies)
+	cfg.WaitLocal = *waitLocal
+	if cfg.Inspect, err = inspect.config(); err != nil {
+		return err
+	}
+	if detach {
+		return startDetached(append([]string{"up"}, stripDetachFlag(args)...))
+	}
+	for _, profile := range profiles {
+		cfg.Tunnels = append(cfg.Tunnels, profile.Name)
+	}
+	return startTunnel(cfg)
+}
+
+func printUpUsage(fs *flag.FlagSet, profiles []tunnelProfile) {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  kai up <name...> [flags]")
+	fmt.Fprintln(os.Stderr, "  kai up --all [flags]")
+	fmt.Fprintln(os.Stderr, "  kai up -d <name...> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Configured tunnels:")
+	if len(profiles) == 0 {
+		fmt.Fprintln(os.Stderr, "  (none; add [tunnels.<name>] sections to config.toml)")
+	}
+	for _, profile := range profiles {
+		fmt.Fprintf(os.Stderr, "  %s\n", profile.Name)
+	}
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Flags:")
+	fs.PrintDefaults()
+}
+
+// selectProfiles returns the requested profiles in the order they were named,
+// or every profile in config order when all is set.
+func selectProfiles(profiles []tunnelProfile, names []string, all bool) ([]tunnelProfile, error) {
+	if all {
+		if len(names) > 0 {
+			return nil, fmt.Errorf("error: use either tunnel names or --all, not both")
+		}
+		if len(profiles) == 0 {
+			return nil, fmt.Errorf("error: no [tunnels.<name>] sections found in config")
+		}
+		return profiles, nil
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("error: tunnel name is required (or use --all)")
+	}
+
+	byName := make(map[string]tunnelProfile, len(profiles))
+	for _, profile := range profiles {
+		byName[profile.Name] = profile
+	}
+
+	selected := make([]tunnelProfile, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		key := strings.ToLower(name)
+		profile, ok := byName[key]
+		if !ok {
+			return nil, fmt.Errorf("error: unknown tunnel %q", name)
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		selected = append(selected, profile)
+	}
+	return selected, nil
+}
+
+// applyProfileKey sets a single key from a [tunnels.<name>] section.
+// Unknown keys are ignored, matching the rest of the config parser.
+func applyProfileKey(profile *tunnelProfile, key, value string) error {
+	proxy := &profile.Proxy
+	switch key {
+	case "type":
+		str, err := parseTomlString(value)
+		if err != nil {
+			return err
+		}
+		proxy.Type = strings.ToLower(str)
+	case "port", "local_port":
+		num, err := parseTomlInt(value)
+		if err != nil {
+			return err
+		}
+		proxy.LocalPort = num
+	case "local_host", "local_ip":
+		str, err := parseTomlString(value)
+		if err != nil {
+			return err
+		}
+		proxy.LocalIP = str
+	case "subdomain":
+		str, err := parseTomlString(value)
+		if err != nil {
+			return err
+		}
+		proxy.Subdomain = str
+	case "domain", "domains", "custom_domains":
+		domains, err := parseTomlStringList(value)
+		if err != nil {
+			return err
+		}
+		proxy.CustomDomains = append(proxy.CustomDomains, domains...)
+	case "remote_port":
+		num, err := parseTomlInt(value)
+		if err != nil {
+			return err
+		}
+		proxy.RemotePort = num
+	case "secret", "secret_key":
+		str, err := parseTomlString(value)
+		if err != nil {
+			return err
+		}
+		proxy.SecretKey = str
+	case "local_tls":
+		enabled, err := parseTomlBool(value)
+		if err != nil {
+			return err
+		}
+		proxy.LocalTLS = enabled
+	case "tls_cert":
+		str, err := parseTomlString(value)
+		if err != nil {
+			return err
+		}
+		proxy.TLSCertFile = str
+	case "tls_key":
+		str, err := parseTomlString(value)
+		if err != nil {
+			return err
+		}
+		proxy.TLSKeyFile = str
+	case "basic_auth":
+		str, err := parseTomlString(value)
+		if err != nil {
+			return err
+		}
+		if proxy.HTTPUser, proxy.HTTPPassword, err = parseBasicAuth(str); err != nil {
+			return err
+		}
+	case "host_header_rewrite":
+		str, err := parseTomlString(value)
+		if err != nil {
+			return err
+		}
+		proxy.HostHeaderRewrite = str
+	case "request_headers", "response_headers":
+		lines, err := parseTomlStringList(value)
+		if err != nil {
+			return err
+		}
+		flagName := "--" + strings.ReplaceAll(strings.TrimSuffix(key, "s"), "_", "-")
+		set, err := parseTunnelHeaders(flagName, lines)
+		if err != nil {
+			return err
+		}
+		if key == "request_headers" {
+			proxy.RequestHeaders = mergeHeaderSet(proxy.RequestHeaders, set)
+		} else {
+			proxy.ResponseHeaders = mergeHeaderSet(proxy.ResponseHeaders, set)
+		}
+	case "access_token":
+		str, err := parseTomlString(value)
+		if err != nil {
+			return err
+		}
+		proxy.AccessToken = str
+	case "health_path":
+		str, err := parseTomlString(value)
+		if err != nil {
+			return err
+		}
+		proxy.HealthPath = str
+	case "bandwidth_limit":
+		str, err := parseTomlString(value)
+		if err != nil {
+			return err
+		}
+		if proxy.BandwidthLimit, err = parseBandwidthLimit(str); err != nil {
+			return err
+		}
+	case "bandwidth_limit_mode":
+		str, err := parseTomlString(value)
+		if err != nil {
+			return err
+		}
+		proxy.BandwidthLimitMode = strings.ToLower(str)
+	case "group", "group_key":
+		str, err := parseTomlString(value)
+		if err != nil {
+			return err
+		}
+		if key == "group" {
+			proxy.Group = str
+		} else {
+			proxy.GroupKey = str
+		}
+	case "use_encryption", "use_compression":
+		enabled, err := parseTomlBool(value)
+		if err != nil {
+			return err
+		}
+		if key == "use_encryption" {
+			proxy.UseEncryption = enabled
+		} else {
+			proxy.UseCompression = enabled
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTunnelProfilesFromConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfgPath := filepath.Join(tmpDir, "config.toml")
+	content := `
+[forwarding]
+server = "frp.example.com"
+
+[tunnels.web]
+type = "http"
+port = 3000
+subdomain = "web"
+basic_auth = "admin:hunter2"
+access_token = "tok"
+domains = ["demo.customer.com", "www.customer.com"]
+host_header_rewrite = "localhost:3000"
+request_headers = ["X-Env: dev, preview", 'X-From: kai']
+health_path = "/healthz"
+
+[tunnels."ssh"]
+type = "tcp"
+local_port = 22
+remote_port = 22022
+local_host = "10.0.0.5"
+`
+	if err := os.WriteFile(cfgPath, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	got, err := parseTunnelDefaultsFromConfig(cfgPath)
+	if err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+	if got.Server != "frp.example.com" {
+		t.Fatalf("server mismatch: got %q", got.Server)
+	}
+	if len(got.Profiles) != 2 {
+		t.Fatalf("expected 2 profiles, got %d", len(got.Profiles))
+	}
+
+	web := got.Profiles[0]
+	if web.Name != "web" || web.Proxy.Type != "http" || web.Proxy.LocalPort != 3000 || web.Proxy.Subdomain != "web" {
+		t.Fatalf("unexpected web profile: %+v", web)
+	}
+	if web.Proxy.HTTPUser != "admin" || web.Proxy.HTTPPassword != "hunter2" || web.Proxy.AccessToken != "tok" {
+		t.Fatalf("unexpected web profile auth: %+v", web.Proxy)
+	}
+	if len(web.Proxy.CustomDomains) != 2 || web.Proxy.CustomDomains[1] != "www.customer.com" {
+		t.Fatalf("unexpected web profile domains: %+v", web.Proxy.CustomDomains)
+	}
+	if web.Proxy.HostHeaderRewrite != "localhost:3000" || web.Proxy.RequestHeaders["X-Env"] != "dev, preview" || web.Proxy.RequestHeaders["X-From"] != "kai" {
+		t.Fatalf("unexpected web profile headers: %+v", web.Proxy)
+	}
+	if web.Proxy.HealthPath != "/healthz" {
+		t.Fatalf("unexpected web profile health path: %q", web.Proxy.HealthPath)
+	}
+	ssh := got.Profiles[1]
+	if ssh.Name != "ssh" || ssh.Proxy.RemotePort != 22022 || ssh.Proxy.LocalPort != 22 || ssh.Proxy.LocalIP != "10.0.0.5" {
+		t.Fatalf("unexpected ssh profile: %+v", ssh)
+	}
+}
+
+func TestSelectProfiles(t *testing.T) {
+	profiles := []tunnelProfile{{Name: "web"}, {Name: "api"}, {Name: "ssh"}}
+
+	all, err := selectProfiles(profiles, nil, true)
+	if err != nil || len(all) != 3 {
+		t.Fatalf("expected all profiles, got %v (err=%v)", all, err)
+	}
+
+	picked, err := selectProfiles(profiles, []string{"ssh", "web", "ssh"}, false)
+	if err != nil {
+		t.Fatalf("select profiles: %v", err)
+	}
+	if len(picked) != 2 || picked[0].Name != "ssh" || picked[1].Name != "web" {
+		t.Fatalf("unexpected selection: %v", picked)
+	}
+
+	if _, err := selectProfiles(profiles, []string{"nope"}, false); err == nil {
+		t.Fatalf("expected error for unknown profile")
+	}
+	if _, err := selectProfiles(profiles, nil, false); err == nil {
+		t.Fatalf("expected error when no name is given")
+	}
+}
+
+func TestProfileTLSFilesRelativeToConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfgPath := filepath.Join(tmpDir, "config.toml")
+	content := `
+[tunnels.web]
+type = "https"
+port = 3000
+local_tls = true
+tls_cert = "certs/web.crt"
+tls_key = "/etc/kai/web.key"
+`
+	if err := os.WriteFile(cfgPath, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	t.Setenv("KAI_CONFIG", cfgPath)
+
+	got, err := loadTunnelDefaults()
+	if err != nil {
+		t.Fatalf("load defaults: %v", err)
+	}
+	web := got.Profiles[0].Proxy
+	if web.TLSCertFile != filepath.Join(tmpDir, "certs", "web.crt") || web.TLSKeyFile != "/etc/kai/web.key" {
+		t.Fatalf("unexpected profile TLS files: %q %q", web.TLSCertFile, web.TLSKeyFile)
+	}
+}
+
+func TestRunUpRejectsBareDash(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(cfgPath, []byte("[tunnels.web]\nport = 3000\n"), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	t.Setenv("KAI_CONFIG", cfgPath)
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runUp([]string{"web", "-"})
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), `unexpected argument "-"`) {
+			t.Fatalf("expected a usage error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("kai up web - did not return")
+	}
+}
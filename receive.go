@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	receiveProgressInterval = time.Second
+	// receiveCloseDelay lets the response to the last upload reach the
+	// sender before the tunnel closes.
+	receiveCloseDelay = time.Second
+	// defaultReceiveTTL closes a drop that was left running, so the link
+	// stops working even without --max-uploads.
+	defaultReceiveTTL = time.Hour
+)
+
+var errUploadLimitReached = errors.New("upload limit reached")
+
+// receivedFile is the JSON response for each stored upload.
+type receivedFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// runReceive starts an upload page on an ephemeral loopback port and tunnels
+// it like `kai -p <port> --access-token <token>`. The tunnel closes after
+// --max-uploads files or when --ttl (an hour by default) expires.
+func runReceive(args []string) error {
+	fs := flag.NewFlagSet("receive", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  kai receive [flags] [tunnel flags]")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Receives files through an http tunnel protected by an access token generated for this run.")
+		fmt.Fprintln(os.Stderr, "Tunnel flags such as --subdomain and --access-token are listed by `kai -h`.")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Flags:")
+		fs.PrintDefaults()
+	}
+	dir := fs.String("dir", ".", "Directory to store received files in (created if missing)")
+	maxSize := fs.String("max-size", "1GB", "Maximum size of each file")
+	maxUploads := fs.Int("max-uploads", 0, "Close the tunnel after this many files (0: no limit)")
+	ttl := fs.Duration("ttl", defaultReceiveTTL, "Close the tunnel after this long (e.g. 30m; 0: no limit)")
+
+	receiveArgs, tunnelArgs, err := splitTunnelArgs(args, []string{"h", "help"}, []string{"dir", "max-size", "max-uploads", "ttl"})
+	if err != nil {
+		return err
+	}
+	if err := fs.Parse(receiveArgs); err != nil {
+		return err
+	}
+	limit, err := parseSize(*maxSize)
+	if err != nil || limit <= 0 {
+		return fmt.Errorf("error: invalid --max-size %q", *maxSize)
+	}
+	if *maxUploads < 0 || *ttl < 0 {
+		return fmt.Errorf("error: --max-uploads and --ttl must not be negative")
+	}
+	absDir, err := filepath.Abs(*dir)
+	if err != nil {
+		return fmt.Errorf("error: --dir: %w", err)
+	}
+	if err := os.MkdirAll(absDir, 0o755); err != nil {
+		return fmt.Errorf("error: --dir: %w", err)
+	}
+
+	// The upload page is only reachable with the access token, which is new
+	// for every run unless one is given. It works until the tunnel closes.
+	if !hasTunnelFlag(tunnelArgs, "access-token") {
+		token, err := newUploadToken()
+		if err != nil {
+			return err
+		}
+		tunnelArgs = append(tunnelArgs, "--access-token", token)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rc := &receiver{dir: absDir, maxSize: limit, maxUploads: *maxUploads, done: func() {
+		log.Printf("receive: received %d files, closing the tunnel", *maxUploads)
+		time.AfterFunc(receiveCloseDelay, cancel)
+	}}
+	if *ttl > 0 {
+		timer := time.AfterFunc(*ttl, func() {
+			log.Printf("receive: --ttl %s reached, closing the tunnel", *ttl)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("error: upload server listen: %w", err)
+	}
+	srv := &http.Server{Handler: rc, ReadHeaderTimeout: 30 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("upload server: %v", err)
+		}
+	}()
+	defer srv.Close()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	log.Printf("Receiving files into %s (max %s each)", absDir, formatSize(limit))
+	return runTunnelContext(ctx, append([]string{"-local-host", "127.0.0.1", "-p", strconv.Itoa(port)}, tunnelArgs...))
+}
+
+func newUploadToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error: generate access token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// receiver serves the upload page and stores files sent with a multipart
+// POST to / or a PUT to /<name>. Existing files are never overwritten.
+type receiver struct {
+	dir        string
+	maxSize    int64
+	maxUploads int
+	// done is called once maxUploads files have been stored.
+	done func()
+
+	mu       sync.Mutex
+	reserved int
+	stored   int
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/", r.Method == http.MethodHead && r.URL.Path == "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, receiveUI)
+	case r.Method == http.MethodPost && r.URL.Path == "/":
+		rc.receiveMultipart(w, r)
+	case r.Method == http.MethodPut && r.URL.Path != "/":
+		if r.ContentLength > rc.maxSize {
+			http.Error(w, fmt.Sprintf("file exceeds the limit of %s", formatSize(rc.maxSize)), http.StatusRequestEntityTooLarge)
+			return
+		}
+		file, err := rc.receive(path.Base(r.URL.Path), r.Body, r.ContentLength)
+		if err != nil {
+			writeReceiveError(w, err)
+			return
+		}
+		writeReceiveJSON(w, []receivedFile{file})
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (rc *receiver) receiveMultipart(w http.ResponseWriter, r *http.Request) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "expected a multipart/form-data upload", http.StatusBadRequest)
+		return
+	}
+	files := []receivedFile{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "bad multipart body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if part.FileName() == "" {
+			_, _ = io.Copy(io.Discard, io.LimitReader(part, 1<<20))
+			continue
+		}
+		file, err := rc.receive(part.FileName(), part, -1)
+		if err != nil {
+			writeReceiveError(w, err)
+			return
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		http.Error(w, "no files in the upload", http.StatusBadRequest)
+		return
+	}
+	writeReceiveJSON(w, files)
+}
+
+// receive stores one file. size is -1 when the sender did not announce it.
+func (rc *receiver) receive(name string, body io.Reader, size int64) (receivedFile, error) {
+	name, err := sanitizeUploadName(name)
+	if err != nil {
+		return receivedFile{}, err
+	}
+	if !rc.reserve() {
+		return receivedFile{}, errUploadLimitReached
+	}
+	stored := false
+	defer func() { rc.release(stored) }()
+
+	f, name, err := createUniqueFile(rc.dir, name)
+	if err != nil {
+		return receivedFile{}, err
+	}
+	log.Printf("receive: receiving %s", name)
+
+	progress := newUploadProgress(name, size)
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), &countingReader{
+		r:      &maxSizeReader{r: body, limit: rc.maxSize},
+		onRead: progress.add,
+	})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filepath.Join(rc.dir, name))
+		log.Printf("receive: %s failed after %s: %v", name, formatSize(n), err)
+		return receivedFile{}, err
+	}
+
+	stored = true
+	file := receivedFile{Name: name, Size: n, SHA256: hex.EncodeToString(hash.Sum(nil))}
+	log.Printf("receive: saved %s (%s) sha256 %s", file.Name, formatSize(file.Size), file.SHA256)
+	return file, nil
+}
+
+// reserve claims an upload slot so concurrent uploads cannot exceed
+// maxUploads.
+func (rc *receiver) reserve() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.maxUploads > 0 && rc.stored+rc.reserved >= rc.maxUploads {
+		return false
+	}
+	rc.reserved++
+	return true
+}
+
+func (rc *receiver) release(stored bool) {
+	rc.mu.Lock()
+	rc.reserved--
+	if stored {
+		rc.stored++
+	}
+	finished := stored && rc.maxUploads > 0 && rc.stored == rc.maxUploads
+	rc.mu.Unlock()
+	if finished && rc.done != nil {
+		rc.done()
+	}
+}
+
+// sanitizeUploadName keeps the base name of an upload and replaces the
+// characters that are not allowed in file names on Windows.
+func sanitizeUploadName(name string) (string, error) {
+	name = strings.TrimSpace(path.Base(strings.ReplaceAll(name, "\\", "/")))
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return "", fmt.Errorf("invalid file name")
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	return name, nil
+}
+
+// createUniqueFile creates name in dir, or name-1, name-2, ... when it
+// already exists.
+func createUniqueFile(dir, name string) (*os.File, string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; i < 1000; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		f, err := os.OpenFile(filepath.Join(dir, candidate), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		return f, candidate, nil
+	}
+	return nil, "", fmt.Errorf("too many files named %s", name)
+}
+
+// uploadProgress logs the bytes received so far at most once per interval.
+type uploadProgress struct {
+	name   string
+	size   int64
+	read   int64
+	logged time.Time
+}
+
+func newUploadProgress(name string, size int64) *uploadProgress {
+	return &uploadProgress{name: name, size: size, logged: time.Now()}
+}
+
+func (p *uploadProgress) add(n int) {
+	p.read += int64(n)
+	if time.Since(p.logged) < receiveProgressInterval {
+		return
+	}
+	p.logged = time.Now()
+	if p.size > 0 {
+		log.Printf("receive: %s %s/%s (%d%%)", p.name, formatSize(p.read), formatSize(p.size), p.read*100/p.size)
+		return
+	}
+	log.Printf("receive: %s %s", p.name, formatSize(p.read))
+}
+
+func writeReceiveJSON(w http.ResponseWriter, files []receivedFile) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"files": files})
+}
+
+func writeReceiveError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errMaxSizeExceeded):
+		http.Error(w, "file exceeds the size limit", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errUploadLimitReached):
+		http.Error(w, "this drop no longer accepts files", http.StatusGone)
+	default:
+		http.Error(w, "upload failed: "+err.Error(), http.StatusBadRequest)
+	}
+}
+
+// receiveUI is the upload page. Each file is sent with its own PUT so the
+// page can show its progress; the form also works without JavaScript.
+const receiveUI = `<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>kai receive</title>
+<style>
+  body { margin: 40px auto; max-width: 560px; padding: 0 16px; font: 14px/1.5 -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; color: #1f2328; }
+  form { border: 2px dashed #d0d7de; border-radius: 8px; padding: 24px; text-align: center; }
+  form.over { border-color: #0969da; background: #ddf4ff; }
+  ul { list-style: none; padding: 0; }
+  li { padding: 6px 0; border-bottom: 1px solid #eaeef2; word-break: break-all; }
+  progress { width: 100%; }
+  .ok { color: #1a7f37; } .err { color: #cf222e; }
+  code { font-size: 11px; color: #57606a; }
+</style>
+</head>
+<body>
+<h2>Send files</h2>
+<form id="form" method="post" enctype="multipart/form-data">
+  <p>Drop files here or choose them.</p>
+  <input type="file" name="file" id="files" multiple>
+  <button type="submit">Upload</button>
+</form>
+<ul id="list"></ul>
+<script>
+const form = document.getElementById("form");
+const input = document.getElementById("files");
+const list = document.getElementById("list");
+
+function upload(file) {
+  const item = document.createElement("li");
+  const bar = document.createElement("progress");
+  bar.max = file.size || 1;
+  item.textContent = file.name + " ";
+  item.appendChild(bar);
+  list.appendChild(item);
+
+  return new Promise(resolve => {
+    const xhr = new XMLHttpRequest();
+    xhr.open("PUT", "/" + encodeURIComponent(file.name));
+    xhr.upload.onprogress = e => { bar.value = e.loaded; };
+    xhr.onload = () => {
+      if (xhr.status === 200) {
+        const saved = JSON.parse(xhr.responseText).files[0];
+        item.innerHTML = "";
+        item.className = "ok";
+        item.textContent = "✓ " + saved.name + " ";
+        const sum = document.createElement("code");
+        sum.textContent = "sha256 " + saved.sha256;
+        item.appendChild(sum);
+      } else {
+        item.className = "err";
+        item.textContent = file.name + ": " + xhr.responseText.trim();
+      }
+      resolve();
+    };
+    xhr.onerror = () => { item.className = "err"; item.textContent = file.name + ": connection failed"; resolve(); };
+    xhr.send(file);
+  });
+}
+
+async function send(files) {
+  for (const file of files) {
+    await upload(file);
+  }
+  input.value = "";
+}
+
+form.addEventListener("submit", e => { e.preventDefault(); send(input.files); });
+form.addEventListener("dragover", e => { e.preventDefault(); form.classList.add("over"); });
+form.addEventListener("dragleave", () => form.classList.remove("over"));
+form.addEventListener("drop", e => { e.preventDefault(); form.classList.remove("over"); send(e.dataTransfer.files); });
+</script>
+</body>
+</html>
+`
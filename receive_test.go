@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func putUpload(t *testing.T, url, body string) (int, []receivedFile) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPut, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Files []receivedFile `json:"files"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out.Files
+}
+
+func TestReceiverPutAndMultipart(t *testing.T) {
+	dir := t.TempDir()
+	srv := httptest.NewServer(&receiver{dir: dir, maxSize: 1024})
+	defer srv.Close()
+
+	status, files := putUpload(t, srv.URL+"/report.txt", "hello")
+	sum := sha256.Sum256([]byte("hello"))
+	if status != http.StatusOK || len(files) != 1 || files[0].Name != "report.txt" || files[0].Size != 5 || files[0].SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected put result: %d %+v", status, files)
+	}
+	// A second file with the same name does not overwrite the first.
+	if _, files := putUpload(t, srv.URL+"/report.txt", "again"); len(files) != 1 || files[0].Name != "report-1.txt" {
+		t.Fatalf("expected a unique name, got %+v", files)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("note", "ignored")
+	part, _ := mw.CreateFormFile("file", `..\..\evil.sh`)
+	_, _ = part.Write([]byte("#!/bin/sh"))
+	mw.Close()
+	resp, err := http.Post(srv.URL+"/", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("multipart upload: %d", resp.StatusCode)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "evil.sh")); err != nil || string(data) != "#!/bin/sh" {
+		t.Fatalf("expected evil.sh inside the drop dir: %q, %v", data, err)
+	}
+
+	if status, _ := putUpload(t, srv.URL+"/big.bin", strings.Repeat("x", 2048)); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "big.bin")); !os.IsNotExist(err) {
+		t.Fatalf("expected the oversized upload to be removed, got %v", err)
+	}
+}
+
+func TestReceiverUploadLimit(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(&receiver{dir: t.TempDir(), maxSize: 1024, maxUploads: 2, done: func() { close(done) }})
+	defer srv.Close()
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if status, _ := putUpload(t, srv.URL+"/"+name, name); status != http.StatusOK {
+			t.Fatalf("upload %s: %d", name, status)
+		}
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatalf("expected done after two uploads")
+	}
+	if status, _ := putUpload(t, srv.URL+"/c.txt", "c"); status != http.StatusGone {
+		t.Fatalf("expected 410 after the limit, got %d", status)
+	}
+}
+
+func TestSanitizeUploadName(t *testing.T) {
+	for raw, want := range map[string]string{
+		"photo.jpg":          "photo.jpg",
+		"../../etc/passwd":   "passwd",
+		`C:\Users\me\a.txt`:  "a.txt",
+		"what?.txt":          "what_.txt",
+		"  spaced name.md  ": "spaced name.md",
+	} {
+		if got, err := sanitizeUploadName(raw); err != nil || got != want {
+			t.Fatalf("sanitizeUploadName(%q) = %q, %v; want %q", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"", "..", "/"} {
+		if _, err := sanitizeUploadName(raw); err == nil {
+			t.Fatalf("expected an error for %q", raw)
+		}
+	}
+}
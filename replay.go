@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	replayTimeout       = 30 * time.Second
+	replayMaxDiffLines  = 2000
+	replayClientTimeout = replayTimeout + 5*time.Second
+)
+
+// replayRequest edits a captured request before it is sent again. Headers are
+// "Key: Value" lines that replace headers of the same name; an empty value
+// removes the header. A nil Body resends the captured body.
+type replayRequest struct {
+	Headers []string `json:"headers,omitempty"`
+	Body    *string  `json:"body,omitempty"`
+}
+
+type replayResult struct {
+	Original *inspectedExchange `json:"original"`
+	Replay   *inspectedExchange `json:"replay"`
+	Diff     responseDiff       `json:"diff"`
+}
+
+// responseDiff compares the responses of the original and replayed requests.
+// The Date header is ignored because it always differs.
+type responseDiff struct {
+	StatusFrom  int            `json:"status_from"`
+	StatusTo    int            `json:"status_to"`
+	Headers     []headerChange `json:"headers"`
+	BodyChanged bool           `json:"body_changed"`
+	Body        []string       `json:"body"`
+}
+
+type headerChange struct {
+	Key  string `json:"key"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (d responseDiff) empty() bool {
+	return d.StatusFrom == d.StatusTo && len(d.Headers) == 0 && !d.BodyChanged
+}
+
+var (
+	errReplayNotFound      = errors.New("request not found")
+	errReplayTruncatedBody = errors.New("the captured request body was truncated; pass a new body to replay it")
+)
+
+// replay re-sends a captured request to the local service it originally went
+// to and records the new exchange.
+func (i *inspector) replay(ctx context.Context, id string, edits replayRequest) (*replayResult, error) {
+	original := i.store.get(id)
+	if original == nil {
+		return nil, errReplayNotFound
+	}
+
+	body := original.RequestBody.Data
+	if edits.Body != nil {
+		body = []byte(*edits.Body)
+	} else if original.RequestBody.Truncated {
+		return nil, errReplayTruncatedBody
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, replayTimeout)
+	defer cancel()
+	target := &url.URL{Scheme: "http", Host: original.Target}
+	req, err := http.NewRequestWithContext(ctx, original.Method, target.String()+original.Path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Host = original.Host
+	for key, values := range original.RequestHeaders {
+		if isHopByHopHeader(key) || strings.EqualFold(key, "Content-Length") {
+			continue
+		}
+		req.Header[key] = append([]string(nil), values...)
+	}
+	for _, raw := range edits.Headers {
+		key, value, err := parseHeaderLine("--header", raw)
+		if err != nil {
+			return nil, err
+		}
+		if value == "" {
+			req.Header.Del(key)
+			continue
+		}
+		req.Header.Set(key, value)
+	}
+
+	exchange := &inspectedExchange{
+		Proxy:          original.Proxy,
+		Target:         original.Target,
+		ReplayOf:       original.ID,
+		Time:           time.Now().UTC(),
+		Method:         original.Method,
+		Host:           original.Host,
+		Path:           original.Path,
+		RequestHeaders: req.Header.Clone(),
+	}
+	reqCapture := &bodyCapture{limit: i.cfg.BodyLimit}
+	_, _ = reqCapture.Write(body)
+	exchange.RequestBody = reqCapture.body
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		exchange.Error = err.Error()
+		exchange.Status = http.StatusBadGateway
+	} else {
+		respCapture := &bodyCapture{limit: i.cfg.BodyLimit}
+		_, copyErr := io.Copy(respCapture, resp.Body)
+		resp.Body.Close()
+		exchange.Status = resp.StatusCode
+		exchange.ResponseHeaders = resp.Header
+		exchange.ResponseBody = respCapture.body
+		if copyErr != nil {
+			exchange.Error = copyErr.Error()
+		}
+	}
+	exchange.DurationMS = time.Since(start).Milliseconds()
+	i.store.add(exchange)
+
+	return &replayResult{
+		Original: original,
+		Replay:   exchange,
+		Diff:     diffResponses(original, exchange),
+	}, nil
+}
+
+func (i *inspector) handleReplay(w http.ResponseWriter, r *http.Request) {
+	var edits replayRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, i.cfg.BodyLimit+64*1024)).Decode(&edits); err != nil && !errors.Is(err, io.EOF) {
+			writeInspectorJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid replay request: " + err.Error()})
+			return
+		}
+	}
+	result, err := i.replay(r.Context(), r.PathValue("id"), edits)
+	switch {
+	case errors.Is(err, errReplayNotFound):
+		writeInspectorJSON(w, http.StatusNotFound, map[string]any{"error": err.Error()})
+	case errors.Is(err, errReplayTruncatedBody):
+		writeInspectorJSON(w, http.StatusConflict, map[string]any{"error": err.Error()})
+	case err != nil:
+		writeInspectorJSON(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
+	default:
+		writeInspectorJSON(w, http.StatusOK, result)
+	}
+}
+
+func diffResponses(original, replayed *inspectedExchange) responseDiff {
+	diff := responseDiff{StatusFrom: original.Status, StatusTo: replayed.Status, Headers: []headerChange{}}
+
+	keys := make(map[string]bool)
+	for key := range original.ResponseHeaders {
+		keys[key] = true
+	}
+	for key := range replayed.ResponseHeaders {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		if key != "Date" {
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		from := strings.Join(original.ResponseHeaders.Values(key), ", ")
+		to := strings.Join(replayed.ResponseHeaders.Values(key), ", ")
+		if from != to {
+			diff.Headers = append(diff.Headers, headerChange{Key: key, From: from, To: to})
+		}
+	}
+
+	diff.BodyChanged = !bytes.Equal(original.ResponseBody.Data, replayed.ResponseBody.Data)
+	if diff.BodyChanged {
+		diff.Body = diffLines(bodyLines(original.ResponseBody), bodyLines(replayed.ResponseBody))
+	}
+	return diff
+}
+
+// bodyLines splits a body for diffing, pretty-printing JSON first so that a
+// single changed field shows up as a single changed line.
+func bodyLines(body capturedBody) []string {
+	data := body.Data
+	var pretty bytes.Buffer
+	if json.Valid(data) && json.Indent(&pretty, data, "", "  ") == nil {
+		data = pretty.Bytes()
+	}
+	text := strings.TrimRight(string(data), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// diffLines returns a line diff of a and b with "-", "+" and " " prefixes.
+func diffLines(a, b []string) []string {
+	if len(a) > replayMaxDiffLines || len(b) > replayMaxDiffLines {
+		return []string{fmt.Sprintf("(bodies differ; %d and %d lines are too many to diff)", len(a), len(b))}
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	out := make([]string, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "-"+a[i])
+			i++
+		default:
+			out = append(out, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+"+b[j])
+	}
+	return out
+}
+
+func runReplay(args []string) error {
+	var id string
+	normalizedArgs := args
+	if len(normalizedArgs) > 0 && !strings.HasPrefix(normalizedArgs[0], "-") {
+		id = normalizedArgs[0]
+		normalizedArgs = normalizedArgs[1:]
+	}
+
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		printReplayUsage(fs)
+	}
+
+	var headers repeatableValue
+	fs.Var(&headers, "header", "Header override, repeatable (\"Key: Value\"; empty value removes it)")
+	fs.Var(&headers, "H", "Alias of --header")
+	data := fs.String("data", "", "Replacement request body, or @file to read it from a file")
+	addr := fs.String("inspect-addr", defaultInspectAddr, "Address of the running inspector")
+	output := fs.String("output", "text", "Output format: text or json")
+
+	if err := fs.Parse(normalizedArgs); err != nil {
+		return err
+	}
+	if id == "" && fs.NArg() > 0 {
+		id = fs.Arg(0)
+	}
+	id = strings.TrimPrefix(id, "#")
+	if id == "" {
+		return fmt.Errorf("error: request id is required (kai replay <id>)")
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("error: --output must be text or json")
+	}
+
+	edits := replayRequest{Headers: headers}
+	if *data != "" {
+		body := *data
+		if path, ok := strings.CutPrefix(body, "@"); ok {
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("error: read --data file: %w", err)
+			}
+			body = string(raw)
+		}
+		edits.Body = &body
+	}
+	for _, raw := range edits.Headers {
+		if _, _, err := parseHeaderLine("--header", raw); err != nil {
+			return fmt.Errorf("error: %w", err)
+		}
+	}
+
+	payload, err := json.Marshal(edits)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("http://%s/api/requests/%s/replay", *addr, url.PathEscape(id))
+	client := &http.Client{Timeout: replayClientTimeout}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("error: inspector not reachable at %s (is a tunnel running with --inspect?): %v", *addr, err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error: read inspector response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		_ = json.Unmarshal(raw, &apiErr)
+		if apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		return fmt.Errorf("error: replay #%s failed: %s", id, apiErr.Error)
+	}
+
+	if *output == "json" {
+		_, err := os.Stdout.Write(raw)
+		return err
+	}
+	var result replayResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return fmt.Errorf("error: decode replay result: %w", err)
+	}
+	printReplayResult(os.Stdout, result)
+	return nil
+}
+
+func printReplayResult(w io.Writer, result replayResult) {
+	replayed := result.Replay
+	fmt.Fprintf(w, "Replayed #%s as #%s: %s %s -> %d (%dms)\n",
+		result.Original.ID, replayed.ID, replayed.Method, replayed.Path, replayed.Status, replayed.DurationMS)
+	if replayed.Error != "" {
+		fmt.Fprintf(w, "error: %s\n", replayed.Error)
+	}
+	if result.Diff.empty() {
+		fmt.Fprintln(w, "Response unchanged.")
+		return
+	}
+	if result.Diff.StatusFrom != result.Diff.StatusTo {
+		fmt.Fprintf(w, "status: %d -> %d\n", result.Diff.StatusFrom, result.Diff.StatusTo)
+	}
+	for _, change := range result.Diff.Headers {
+		switch {
+		case change.From == "":
+			fmt.Fprintf(w, "header +%s: %s\n", change.Key, change.To)
+		case change.To == "":
+			fmt.Fprintf(w, "header -%s: %s\n", change.Key, change.From)
+		default:
+			fmt.Fprintf(w, "header ~%s: %s -> %s\n", change.Key, change.From, change.To)
+		}
+	}
+	if result.Diff.BodyChanged {
+		fmt.Fprintln(w, "body:")
+		for _, line := range result.Diff.Body {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+func printReplayUsage(fs *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  kai replay <id> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Re-sends a request captured by a tunnel running with --inspect and shows")
+	fmt.Fprintln(os.Stderr, "how the response differs from the original.")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Examples:")
+	fmt.Fprintln(os.Stderr, "  kai replay 3")
+	fmt.Fprintln(os.Stderr, "  kai replay 3 -H \"Stripe-Signature: t=1,v1=test\" --data @event.json")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Flags:")
+	fs.PrintDefaults()
+}
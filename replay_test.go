@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestInspectorReplayDiffsResponses(t *testing.T) {
+	var calls atomic.Int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Signature") == "bad" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		w.Header().Set("X-Call", fmt.Sprint(n))
+		fmt.Fprintf(w, `{"host":%q,"body":%q}`, r.Host, body)
+	}))
+	defer local.Close()
+
+	insp, engineCfg := startTestInspector(t, local, 1024)
+	proxyURL := fmt.Sprintf("http://127.0.0.1:%d/webhook", engineCfg.Proxies[0].LocalPort)
+	req, _ := http.NewRequest(http.MethodPost, proxyURL, strings.NewReader("ping"))
+	req.Host = "web.p.ranax.co"
+	req.Header.Set("X-Signature", "good")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request through inspector: %v", err)
+	}
+	resp.Body.Close()
+	waitForExchanges(t, insp, 1)
+
+	same, err := insp.replay(context.Background(), "1", replayRequest{})
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if same.Replay.ReplayOf != "1" || same.Replay.ID != "2" {
+		t.Fatalf("unexpected replay exchange: %+v", same.Replay)
+	}
+	if same.Diff.BodyChanged || same.Diff.StatusFrom != same.Diff.StatusTo {
+		t.Fatalf("identical replay should only differ in headers: %+v", same.Diff)
+	}
+	if len(same.Diff.Headers) != 1 || same.Diff.Headers[0] != (headerChange{Key: "X-Call", From: "1", To: "2"}) {
+		t.Fatalf("unexpected header diff: %+v", same.Diff.Headers)
+	}
+
+	body := "pong"
+	edited, err := insp.replay(context.Background(), "1", replayRequest{Headers: []string{"X-Signature: bad"}, Body: &body})
+	if err != nil {
+		t.Fatalf("edited replay: %v", err)
+	}
+	if edited.Diff.StatusFrom != http.StatusOK || edited.Diff.StatusTo != http.StatusUnauthorized {
+		t.Fatalf("unexpected status diff: %+v", edited.Diff)
+	}
+	if !edited.Diff.BodyChanged {
+		t.Fatalf("expected a body diff, got %+v", edited.Diff)
+	}
+	if !contains(edited.Diff.Body, "-  \"body\": \"ping\"") || !contains(edited.Diff.Body, "+  \"body\": \"pong\"") || !contains(edited.Diff.Body, "   \"host\": \"web.p.ranax.co\",") {
+		t.Fatalf("unexpected body diff: %q", edited.Diff.Body)
+	}
+
+	if _, err := insp.replay(context.Background(), "99", replayRequest{}); !errors.Is(err, errReplayNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	var out bytes.Buffer
+	printReplayResult(&out, *edited)
+	if !strings.Contains(out.String(), "Replayed #1 as #3") || !strings.Contains(out.String(), "status: 200 -> 401") {
+		t.Fatalf("unexpected text output: %q", out.String())
+	}
+}
+
+func TestInspectorReplayRefusesTruncatedBody(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer local.Close()
+
+	insp, engineCfg := startTestInspector(t, local, 4)
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/", engineCfg.Proxies[0].LocalPort), "text/plain", strings.NewReader("0123456789"))
+	if err != nil {
+		t.Fatalf("request through inspector: %v", err)
+	}
+	resp.Body.Close()
+	waitForExchanges(t, insp, 1)
+
+	replayURL := insp.URL() + "/api/requests/1/replay"
+	resp, err = http.Post(replayURL, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for a truncated body, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(replayURL, "application/json", strings.NewReader(`{"body":"new"}`))
+	if err != nil {
+		t.Fatalf("replay with body: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected replay with a new body to succeed, got %d", resp.StatusCode)
+	}
+}
+
+func TestInspectorReplayRefusesCrossSiteRequests(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer local.Close()
+
+	insp, engineCfg := startTestInspector(t, local, 1024)
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/", engineCfg.Proxies[0].LocalPort), "text/plain", strings.NewReader("ping"))
+	if err != nil {
+		t.Fatalf("request through inspector: %v", err)
+	}
+	resp.Body.Close()
+	waitForExchanges(t, insp, 1)
+
+	replayURL := insp.URL() + "/api/requests/1/replay"
+	// A form or a no-cors fetch from another page can only send simple
+	// content types such as text/plain.
+	resp, err = http.Post(replayURL, "text/plain", strings.NewReader(`{"body":"evil"}`))
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415 for a text/plain replay, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, replayURL, strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Origin", "https://attacker.example")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("cross-origin replay: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for a cross-origin replay, got %d", resp.StatusCode)
+	}
+	if n := len(insp.store.list()); n != 1 {
+		t.Fatalf("expected no replays, got %d exchanges", n)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	got := diffLines([]string{"a", "b", "c"}, []string{"a", "x", "c", "d"})
+	want := []string{" a", "-b", "+x", " c", "+d"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("diffLines = %q, want %q", got, want)
+	}
+}
+
+func contains(lines []string, want string) bool {
+	for _, line := range lines {
+		if line == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+)
+
+const (
+	publicURLEnv = "KAI_PUBLIC_URL"
+	// defaultRunWaitLocal is how long `kai run` waits for the command to
+	// listen when --wait-local is not given. Dev servers can take a while.
+	defaultRunWaitLocal = 2 * time.Minute
+)
+
+// commandExitError carries the exit status of the command started by
+// `kai run`, which kai exits with.
+type commandExitError struct {
+	Code int
+}
+
+func (e *commandExitError) Error() string {
+	return fmt.Sprintf("command exited with status %d", e.Code)
+}
+
+// runRun starts a command, tunnels the port it listens on once it is up and
+// stops the tunnel when the command exits:
+//
+//	kai run --subdomain app -p 3000 -- npm run dev
+func runRun(args []string) error {
+	sep := slices.Index(args, "--")
+	if sep < 0 || sep == len(args)-1 || slices.Contains(args[:sep], "-h") || slices.Contains(args[:sep], "--help") {
+		printRunUsage()
+		if sep < 0 || sep == len(args)-1 {
+			return fmt.Errorf("error: kai run needs a command after --")
+		}
+		return flag.ErrHelp
+	}
+	command := args[sep+1:]
+
+	cfg, err := parseTunnelArgs(args[:sep])
+	if err != nil {
+		return err
+	}
+	if cfg.WaitLocal == 0 {
+		cfg.WaitLocal = defaultRunWaitLocal
+	}
+	// The command gets the public URL before the tunnel starts, so a
+	// generated subdomain is kept instead of being replaced if it is taken.
+	for i := range cfg.Proxies {
+		cfg.Proxies[i].AutoSubdomain = false
+	}
+
+	return runWithTunnel(newRunCommand(command, cfg), func(ctx context.Context) error {
+		return startTunnelContext(ctx, cfg)
+	})
+}
+
+// newRunCommand prepares the command with the public URL in its environment.
+// With --output json stdout carries the tunnel events, so the command's
+// output goes to stderr.
+func newRunCommand(command []string, cfg TunnelConfig) *exec.Cmd {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if cfg.Output == "json" {
+		cmd.Stdout = os.Stderr
+	}
+	cmd.Env = os.Environ()
+	if url := runPublicURL(cfg); url != "" {
+		cmd.Env = append(cmd.Env, publicURLEnv+"="+url)
+	}
+	return cmd
+}
+
+// runWithTunnel starts cmd and the tunnel side by side. When the command
+// exits the tunnel is closed, and when the tunnel ends for any reason, be it
+// a failure, Ctrl+C or `kai stop`, the command is stopped.
+func runWithTunnel(cmd *exec.Cmd, tunnel func(context.Context) error) error {
+	name := filepath.Base(cmd.Path)
+
+	// Registered before the command starts so no signal is missed. The
+	// tunnel listens for the same signals itself.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error: start %s: %w", name, err)
+	}
+	commandDone := make(chan error, 1)
+	go func() {
+		commandDone <- cmd.Wait()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnelDone := make(chan error, 1)
+	go func() {
+		tunnelDone <- tunnel(ctx)
+	}()
+
+	var tunnelErr error
+	var killTimer *time.Timer
+	signaled, stopped := false, false
+	for {
+		select {
+		case sig := <-signals:
+			// On Windows the console already delivers Ctrl+C to the
+			// command and Signal fails; there is nothing to forward.
+			_ = cmd.Process.Signal(sig)
+			signaled = true
+		case tunnelErr = <-tunnelDone:
+			tunnelDone = nil
+			log.Printf("Tunnel stopped, stopping %s", name)
+			if !signaled {
+				stopCommand(cmd.Process)
+			}
+			stopped = true
+			killTimer = time.AfterFunc(defaultStopTimeout, func() { _ = cmd.Process.Kill() })
+		case err := <-commandDone:
+			if killTimer != nil {
+				killTimer.Stop()
+			}
+			if tunnelDone != nil {
+				log.Printf("%s exited, stopping the tunnel", name)
+				cancel()
+				tunnelErr = <-tunnelDone
+			} else if stopped && tunnelErr == nil {
+				// The command was stopped because the tunnel was closed
+				// on purpose, not because it failed.
+				return nil
+			}
+			return runResult(err, tunnelErr)
+		}
+	}
+}
+
+// runResult picks what `kai run` exits with: a tunnel failure that stopped
+// the command, otherwise the command's own status.
+func runResult(commandErr, tunnelErr error) error {
+	if tunnelErr != nil {
+		return tunnelErr
+	}
+	var exitErr *exec.ExitError
+	if errors.As(commandErr, &exitErr) {
+		code := exitErr.ExitCode()
+		if code < 0 {
+			// Killed by a signal.
+			code = 1
+		}
+		return &commandExitError{Code: code}
+	}
+	return commandErr
+}
+
+// runPublicURL is the URL of the first tunnel, or "" when it is only known
+// once frps assigns a port.
+func runPublicURL(cfg TunnelConfig) string {
+	if len(cfg.Proxies) == 0 {
+		return ""
+	}
+	proxy := cfg.Proxies[0]
+	if (proxy.Type == "tcp" || proxy.Type == "udp") && proxy.RemotePort == 0 {
+		return ""
+	}
+	return publicURL(cfg.ServerAddr, proxy)
+}
+
+// stopCommand asks the command to exit and kills it where that is not
+// possible.
+func stopCommand(p *os.Process) {
+	if err := p.Signal(os.Interrupt); err != nil {
+		_ = p.Kill()
+	}
+}
+
+func printRunUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  kai run [tunnel flags] -- <command> [args...]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Starts the command, opens the tunnel once the local port is listening and stops")
+	fmt.Fprintln(os.Stderr, "the tunnel when the command exits. The command sees the public URL in "+publicURLEnv+".")
+	fmt.Fprintln(os.Stderr, "Tunnel flags (-p, --subdomain, ...) are listed by `kai -h`.")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runHelperEnv makes the test binary act as the command started by kai run,
+// see TestRunHelperProcess.
+const runHelperEnv = "KAI_TEST_RUN_HELPER"
+
+// TestRunHelperProcess is not a real test: runHelperCommand re-executes the
+// test binary to run it as a child process.
+func TestRunHelperProcess(t *testing.T) {
+	switch os.Getenv(runHelperEnv) {
+	case "":
+		return
+	case "print-url":
+		fmt.Println(os.Getenv(publicURLEnv))
+		os.Exit(7)
+	case "wait":
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+}
+
+func runHelperCommand(t *testing.T, mode string, cfg TunnelConfig) *exec.Cmd {
+	t.Helper()
+	cmd := newRunCommand([]string{os.Args[0], "-test.run=^TestRunHelperProcess$"}, cfg)
+	cmd.Env = append(cmd.Env, runHelperEnv+"="+mode)
+	return cmd
+}
+
+func TestRunResult(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	err := exec.Command("sh", "-c", "exit 3").Run()
+	var exitErr *commandExitError
+	if !errors.As(runResult(err, nil), &exitErr) || exitErr.Code != 3 {
+		t.Fatalf("expected exit status 3, got %v", runResult(err, nil))
+	}
+	tunnelErr := &tunnelError{Code: "local_unavailable", ExitCode: exitCodeTunnelLocalUnavailable}
+	if got := runResult(err, tunnelErr); got != tunnelErr {
+		t.Fatalf("expected the tunnel error, got %v", got)
+	}
+	if got := runResult(nil, nil); got != nil {
+		t.Fatalf("expected success, got %v", got)
+	}
+}
+
+func TestRunPublicURL(t *testing.T) {
+	cfg := TunnelConfig{ServerAddr: "p.ranax.co", Proxies: []ProxyConfig{{Type: "http", Subdomain: "app"}}}
+	if got := runPublicURL(cfg); got != publicURL("p.ranax.co", cfg.Proxies[0]) || got == "" {
+		t.Fatalf("unexpected http URL %q", got)
+	}
+	if got := runPublicURL(TunnelConfig{ServerAddr: "p.ranax.co", Proxies: []ProxyConfig{{Type: "tcp"}}}); got != "" {
+		t.Fatalf("expected no URL before frps assigns a port, got %q", got)
+	}
+	if got := runPublicURL(TunnelConfig{ServerAddr: "p.ranax.co", Proxies: []ProxyConfig{{Type: "tcp", RemotePort: 6000}}}); got != "tcp://p.ranax.co:6000" {
+		t.Fatalf("unexpected tcp URL %q", got)
+	}
+}
+
+func TestRunNeedsCommand(t *testing.T) {
+	for _, args := range [][]string{{"-p", "3000"}, {"-p", "3000", "--"}} {
+		if err := runRun(args); err == nil {
+			t.Fatalf("expected an error for %q", args)
+		}
+	}
+}
+
+func TestRunWithTunnelPassesURLAndExitCode(t *testing.T) {
+	cfg := TunnelConfig{ServerAddr: "p.ranax.co", Proxies: []ProxyConfig{{Type: "http", Subdomain: "app"}}}
+	cmd := runHelperCommand(t, "print-url", cfg)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	tunnelCanceled := make(chan struct{})
+	err := runWithTunnel(cmd, func(ctx context.Context) error {
+		<-ctx.Done()
+		close(tunnelCanceled)
+		return nil
+	})
+	var exitErr *commandExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 7 {
+		t.Fatalf("expected the command's exit status 7, got %v", err)
+	}
+	if got := strings.TrimSpace(out.String()); got != publicURL("p.ranax.co", cfg.Proxies[0]) {
+		t.Fatalf("command saw %s=%q", publicURLEnv, got)
+	}
+	select {
+	case <-tunnelCanceled:
+	default:
+		t.Fatalf("expected the tunnel to be stopped when the command exited")
+	}
+}
+
+func TestRunWithTunnelStopsCommandWhenTunnelEnds(t *testing.T) {
+	for _, tunnelErr := range []error{nil, &tunnelError{Code: "auth_failed", ExitCode: exitCodeTunnelAuth}} {
+		cmd := runHelperCommand(t, "wait", TunnelConfig{})
+		done := make(chan error, 1)
+		go func() {
+			done <- runWithTunnel(cmd, func(ctx context.Context) error {
+				time.Sleep(100 * time.Millisecond)
+				return tunnelErr
+			})
+		}()
+
+		select {
+		case err := <-done:
+			if tunnelErr == nil && err != nil {
+				t.Fatalf("expected a clean exit after the tunnel was closed, got %v", err)
+			}
+			if tunnelErr != nil && err != tunnelErr {
+				t.Fatalf("expected the tunnel error, got %v", err)
+			}
+		case <-time.After(defaultStopTimeout + 5*time.Second):
+			t.Fatalf("the command was not stopped when the tunnel ended")
+		}
+		if cmd.ProcessState == nil {
+			t.Fatalf("expected the command to have exited")
+		}
+	}
+}
+
+func TestNewRunCommandSendsOutputToStderrForJSON(t *testing.T) {
+	if cmd := newRunCommand([]string{"true"}, TunnelConfig{Output: "json"}); cmd.Stdout != os.Stderr {
+		t.Fatalf("expected the command's stdout on stderr with --output json")
+	}
+	if cmd := newRunCommand([]string{"true"}, TunnelConfig{Output: "text"}); cmd.Stdout != os.Stdout {
+		t.Fatalf("expected the command's stdout on stdout")
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serveFlags are the flags of `kai serve` itself; everything else on the
+// command line is passed to the tunnel.
+var serveFlags = []string{"list", "spa", "gzip", "h", "help"}
+
+// runServe serves a directory with an in-process file server on an ephemeral
+// loopback port and tunnels it like `kai -p <port>`. The server stops when
+// the tunnel does.
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  kai serve [dir] [flags] [tunnel flags]")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Serves dir (default .) through an http tunnel. Tunnel flags such as --subdomain,")
+		fmt.Fprintln(os.Stderr, "--basic-auth and --inspect are listed by `kai -h`.")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Flags:")
+		fs.PrintDefaults()
+	}
+	list := fs.Bool("list", true, "List directories without an index.html")
+	spa := fs.Bool("spa", false, "Serve /index.html for paths that do not exist (single-page apps)")
+	gzipOn := fs.Bool("gzip", true, "Compress text responses for clients that accept gzip")
+
+	dir, serveArgs, tunnelArgs, err := splitServeArgs(args)
+	if err != nil {
+		return err
+	}
+	if err := fs.Parse(serveArgs); err != nil {
+		return err
+	}
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return fmt.Errorf("error: serve %s: %w", dir, err)
+	}
+	defer root.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("error: file server listen: %w", err)
+	}
+	handler := newFileServer(http.FS(root.FS()), fileServerOptions{List: *list, SPA: *spa, Gzip: *gzipOn})
+	srv := &http.Server{Handler: logFileRequests(handler), ReadHeaderTimeout: 30 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("file server: %v", err)
+		}
+	}()
+	defer srv.Close()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	log.Printf("Serving %s on http://127.0.0.1:%d", dir, port)
+
+	return runTunnel(append([]string{"-local-host", "127.0.0.1", "-p", strconv.Itoa(port)}, tunnelArgs...))
+}
+
+// splitServeArgs separates the optional leading directory, the flags of
+// `kai serve` and the tunnel flags.
+func splitServeArgs(args []string) (dir string, serveArgs, tunnelArgs []string, err error) {
+	dir = "."
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		dir, args = args[0], args[1:]
+	}
+	serveArgs, tunnelArgs, err = splitTunnelArgs(args, serveFlags, nil)
+	return dir, serveArgs, tunnelArgs, err
+}
+
+// splitTunnelArgs separates the flags of a command that serves its own local
+// service from the tunnel flags passed on to runTunnel. valueFlags take the
+// following argument unless written as --flag=value. Flags that choose the
+// local service are rejected unless the command handles them itself.
+func splitTunnelArgs(args, boolFlags, valueFlags []string) (own, tunnel []string, err error) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		switch {
+		case !strings.HasPrefix(arg, "-"):
+			tunnel = append(tunnel, arg)
+		case slices.Contains(boolFlags, name):
+			own = append(own, arg)
+		case slices.Contains(valueFlags, name):
+			own = append(own, arg)
+			if !hasValue && i+1 < len(args) {
+				i++
+				own = append(own, args[i])
+			}
+		case name == "p" || name == "local-host" || name == "http" || name == "tcp" || name == "udp":
+			return nil, nil, fmt.Errorf("error: --%s is not supported here; kai picks the local address itself", name)
+		default:
+			tunnel = append(tunnel, arg)
+		}
+	}
+	return own, tunnel, nil
+}
+
+// hasTunnelFlag reports whether args set the flag name.
+func hasTunnelFlag(args []string, name string) bool {
+	for _, arg := range args {
+		flagName, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && flagName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnelFlagValue returns the value of the flag name in args, written as
+// "--name value" or "--name=value".
+func tunnelFlagValue(args []string, name string) string {
+	for i, arg := range args {
+		flagName, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || flagName != name {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+type fileServerOptions struct {
+	// List shows a listing for directories without an index.html.
+	List bool
+	// SPA serves /index.html instead of 404 for paths that do not exist.
+	SPA bool
+	// Gzip compresses compressible responses.
+	Gzip bool
+}
+
+// newFileServer serves files from fsys with http.FileServer, which handles
+// index.html, conditional and range requests. Dot files are never served.
+func newFileServer(fsys http.FileSystem, opts fileServerOptions) http.Handler {
+	var handler http.Handler = http.FileServer(serveFileSystem{fs: fsys, list: opts.List, spa: opts.SPA})
+	if opts.Gzip {
+		handler = gzipHandler(handler)
+	}
+	return handler
+}
+
+// serveFileSystem hides dot files, turns unlisted directories into 404s and
+// falls back to /index.html for single-page apps.
+type serveFileSystem struct {
+	fs   http.FileSystem
+	list bool
+	spa  bool
+}
+
+func (s serveFileSystem) Open(name string) (http.File, error) {
+	if hasDotSegment(name) {
+		return nil, os.ErrNotExist
+	}
+	f, err := s.fs.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return s.fallback(name, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil || !info.IsDir() {
+		return f, err
+	}
+	if !s.list {
+		index, err := s.fs.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return s.fallback(name, os.ErrNotExist)
+		}
+		index.Close()
+	}
+	return dotFileFilter{f}, nil
+}
+
+func (s serveFileSystem) fallback(name string, err error) (http.File, error) {
+	if !s.spa || name == "/index.html" {
+		return nil, err
+	}
+	return s.fs.Open("/index.html")
+}
+
+func hasDotSegment(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// dotFileFilter leaves dot files out of directory listings.
+type dotFileFilter struct {
+	http.File
+}
+
+func (f dotFileFilter) Readdir(n int) ([]os.FileInfo, error) {
+	entries, err := f.File.Readdir(n)
+	visible := entries[:0]
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			visible = append(visible, entry)
+		}
+	}
+	return visible, err
+}
+
+// gzipHandler compresses text responses when the client accepts gzip. Range
+// requests are answered uncompressed so Content-Range stays correct.
+func gzipHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter decides on compression when the header is written,
+// once the status and Content-Type are known.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if status == http.StatusOK && h.Get("Content-Encoding") == "" && compressibleType(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		h.Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *gzipResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/wasm", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// logFileRequests prints one line per request, like python -m http.server.
+func logFileRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		log.Printf("serve: %s %s %d", r.Method, r.URL.RequestURI(), rec.status)
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
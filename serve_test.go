@@ -0,0 +1,147 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestFileServer(t *testing.T, opts fileServerOptions) (*httptest.Server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":      "<h1>home</h1>",
+		"app.js":          strings.Repeat("console.log('kai');\n", 100),
+		"docs/guide.txt":  "guide",
+		".env":            "SECRET=1",
+		".git/config":     "[core]",
+		"assets/logo.bin": "0123456789",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { root.Close() })
+	srv := httptest.NewServer(newFileServer(http.FS(root.FS()), opts))
+	t.Cleanup(srv.Close)
+	return srv, dir
+}
+
+func getFile(t *testing.T, url string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	// Use a transport that does not decompress, to see the raw encoding.
+	resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestFileServerListingAndDotFiles(t *testing.T) {
+	srv, _ := newTestFileServer(t, fileServerOptions{List: true})
+
+	if resp, body := getFile(t, srv.URL+"/", nil); resp.StatusCode != http.StatusOK || body != "<h1>home</h1>" {
+		t.Fatalf("index: %d %q", resp.StatusCode, body)
+	}
+	resp, body := getFile(t, srv.URL+"/docs/", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "guide.txt") {
+		t.Fatalf("listing: %d %q", resp.StatusCode, body)
+	}
+	if _, body := getFile(t, srv.URL+"/", nil); strings.Contains(body, ".env") {
+		t.Fatalf("dot file listed: %q", body)
+	}
+	for _, path := range []string{"/.env", "/.git/config", "/missing"} {
+		if resp, _ := getFile(t, srv.URL+path, nil); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: expected 404, got %d", path, resp.StatusCode)
+		}
+	}
+
+	unlisted, _ := newTestFileServer(t, fileServerOptions{})
+	if resp, _ := getFile(t, unlisted.URL+"/docs/", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unlisted directory, got %d", resp.StatusCode)
+	}
+}
+
+func TestFileServerSPAFallback(t *testing.T) {
+	srv, _ := newTestFileServer(t, fileServerOptions{SPA: true})
+	for _, path := range []string{"/users/42", "/docs"} {
+		resp, body := getFile(t, srv.URL+path, nil)
+		if resp.StatusCode != http.StatusOK || body != "<h1>home</h1>" {
+			t.Fatalf("%s: %d %q", path, resp.StatusCode, body)
+		}
+	}
+	if resp, _ := getFile(t, srv.URL+"/.env", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a dot file, got %d", resp.StatusCode)
+	}
+}
+
+func TestFileServerGzipAndRange(t *testing.T) {
+	srv, dir := newTestFileServer(t, fileServerOptions{Gzip: true})
+	want, err := os.ReadFile(filepath.Join(dir, "app.js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := getFile(t, srv.URL+"/app.js", http.Header{"Accept-Encoding": {"gzip, br"}})
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzip response, got %v", resp.Header)
+	}
+	zr, err := gzip.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := io.ReadAll(zr); err != nil || string(plain) != string(want) {
+		t.Fatalf("decompressed body mismatch: %v", err)
+	}
+
+	if resp, _ := getFile(t, srv.URL+"/assets/logo.bin", http.Header{"Accept-Encoding": {"gzip"}}); resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("binary file was compressed")
+	}
+
+	resp, body = getFile(t, srv.URL+"/app.js", http.Header{"Accept-Encoding": {"gzip"}, "Range": {"bytes=0-6"}})
+	if resp.StatusCode != http.StatusPartialContent || body != "console" || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("range: %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+}
+
+func TestSplitServeArgs(t *testing.T) {
+	dir, serveArgs, tunnelArgs, err := splitServeArgs([]string{"./dist", "--spa", "--subdomain", "docs", "--list=false", "--inspect"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != "./dist" || strings.Join(serveArgs, " ") != "--spa --list=false" || strings.Join(tunnelArgs, " ") != "--subdomain docs --inspect" {
+		t.Fatalf("unexpected split: %q %q %q", dir, serveArgs, tunnelArgs)
+	}
+	if dir, _, _, _ := splitServeArgs([]string{"--gzip=false"}); dir != "." {
+		t.Fatalf("expected the current directory by default, got %q", dir)
+	}
+	if _, _, _, err := splitServeArgs([]string{"-p", "3000"}); err == nil {
+		t.Fatalf("expected an error for -p")
+	}
+}
@@ -470,20 +470,11 @@ func openSourceWithRetry(ctx context.Context, client *http.Client, cfg shareConf
 		}
 
 		for _, rawHeader := range cfg.Headers {
-			parts := strings.SplitN(rawHeader, ":", 2)
-			if len(parts) != 2 {
-				return nil, &shareError{
-					Code:     "INVALID_HEADER",
-					Message:  fmt.Sprintf("invalid --header format: %q (use \"Key: Value\")", rawHeader),
-					ExitCode: exitCodeUsage,
-				}
-			}
-			key := strings.TrimSpace(parts[0])
-			value := strings.TrimSpace(parts[1])
-			if key == "" {
+			key, value, err := parseHeaderLine("--header", rawHeader)
+			if err != nil {
 				return nil, &shareError{
 					Code:     "INVALID_HEADER",
-					Message:  "header name cannot be empty",
+					Message:  err.Error(),
 					ExitCode: exitCodeUsage,
 				}
 			}
@@ -1109,6 +1100,20 @@ func sleepWithContext(ctx context.Context, d time.Duration) error {
 	}
 }
 
+// parseHeaderLine splits a "Key: Value" header flag; flagName is used in the
+// error message.
+func parseHeaderLine(flagName, raw string) (string, string, error) {
+	key, value, ok := strings.Cut(raw, ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid %s format: %q (use \"Key: Value\")", flagName, raw)
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return "", "", errors.New("header name cannot be empty")
+	}
+	return key, strings.TrimSpace(value), nil
+}
+
 func isHopByHopHeader(key string) bool {
 	switch strings.ToLower(strings.TrimSpace(key)) {
 	case "connection", "keep-alive", "proxy-authenticate", "proxy-authorization", "te", "trailer", "transfer-encoding", "upgrade":
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runState is written to ~/.kai/run/<pid>.json while a tunnel runs so other
+// kai commands can find its status API.
+type runState struct {
+	ID      string    `json:"id"`
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	// ProcessStart is when the OS started the process, so a reused PID is
+	// not mistaken for the tunnel.
+	ProcessStart time.Time `json:"process_start,omitzero"`
+	Engine       string    `json:"engine"`
+	Server       string    `json:"server"`
+	Config       string    `json:"config,omitempty"`
+	Tunnels      []string  `json:"tunnels,omitempty"`
+	Proxies      []string  `json:"proxies"`
+	URLs         []string  `json:"urls,omitempty"`
+	LogFile      string    `json:"log_file,omitempty"`
+	TempDir      string    `json:"temp_dir,omitempty"`
+	StatusAddr   string    `json:"status_addr"`
+	StatusToken  string    `json:"status_token"`
+}
+
+// tunnelStatus is what `kai status` reports for one running kai process.
+type tunnelStatus struct {
+	ID        string        `json:"id"`
+	PID       int           `json:"pid"`
+	Engine    string        `json:"engine"`
+	Server    string        `json:"server"`
+	Started   time.Time     `json:"started"`
+	Connected bool          `json:"connected"`
+	Restarts  int           `json:"restarts"`
+	LastError string        `json:"last_error,omitempty"`
+	Inspector string        `json:"inspector,omitempty"`
+	Proxies   []proxyStatus `json:"proxies"`
+}
+
+type proxyStatus struct {
+	Name       string        `json:"name"`
+	Type       string        `json:"type"`
+	Status     string        `json:"status"`
+	RemoteAddr string        `json:"remote_addr,omitempty"`
+	Local      string        `json:"local"`
+	Error      string        `json:"error,omitempty"`
+	Traffic    *proxyTraffic `json:"traffic,omitempty"`
+}
+
+// proxyTraffic is omitted for UDP proxies, which kai does not count.
+type proxyTraffic struct {
+	BytesIn     int64 `json:"bytes_in"`
+	BytesOut    int64 `json:"bytes_out"`
+	Connections int64 `json:"connections"`
+	Active      int64 `json:"active"`
+}
+
+// statusServer serves the API of the running tunnel on loopback: GET
+// /api/status for `kai status`/`kai ls` and POST /api/stop for `kai stop`.
+// Requests must carry the bearer token from the run state file.
+type statusServer struct {
+	state     runState
+	cfg       TunnelConfig
+	monitor   *tunnelMonitor
+	admin     *frpcAdmin
+	inspector string
+	// stop shuts the tunnel down the same way Ctrl+C does.
+	stop func()
+
+	server    *http.Server
+	statePath string
+}
+
+// start listens, serves the API and writes the run state file.
+func (s *statusServer) start() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("error: status listen: %w", err)
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		ln.Close()
+		return fmt.Errorf("error: generate status token: %w", err)
+	}
+	s.state.StatusAddr = ln.Addr().String()
+	s.state.StatusToken = hex.EncodeToString(token)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", s.authorized(s.handleStatus))
+	mux.HandleFunc("POST /api/stop", s.authorized(s.handleStop))
+	s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("status server: %v", err)
+		}
+	}()
+
+	// Without a state file `kai status` cannot find the tunnel, but the
+	// tunnel itself works fine.
+	if s.statePath, err = writeRunState(s.state); err != nil {
+		log.Printf("Could not write tunnel state: %v", err)
+	}
+	return nil
+}
+
+// updateURLs rewrites the run state file after a public URL changed, such as
+// a replaced subdomain.
+func (s *statusServer) updateURLs(cfg TunnelConfig) {
+	s.state.URLs = runStateURLs(cfg)
+	if s.statePath == "" {
+		return
+	}
+	if _, err := writeRunState(s.state); err != nil {
+		log.Printf("Could not update tunnel state: %v", err)
+	}
+}
+
+func (s *statusServer) Close() error {
+	if s.statePath != "" {
+		_ = os.Remove(s.statePath)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+func (s *statusServer) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.state.StatusToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *statusServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.collect(r.Context()))
+}
+
+func (s *statusServer) handleStop(w http.ResponseWriter, r *http.Request) {
+	if s.stop == nil {
+		http.Error(w, "stop not supported", http.StatusNotImplemented)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	log.Println("Stop requested, shutting down...")
+	s.stop()
+}
+
+// collect merges the monitor's view with frpc's admin API (when the frpc
+// engine runs) and the traffic counters.
+func (s *statusServer) collect(ctx context.Context) tunnelStatus {
+	snap := s.monitor.snapshot()
+	status := tunnelStatus{
+		ID:        s.state.ID,
+		PID:       s.state.PID,
+		Engine:    s.state.Engine,
+		Server:    s.state.Server,
+		Started:   s.state.Started,
+		Connected: snap.Connected,
+		Restarts:  snap.Restarts,
+		LastError: snap.LastError,
+		Inspector: s.inspector,
+	}
+
+	frpcProxies := make(map[string]frpcProxyStatus)
+	if s.admin != nil {
+		if groups, err := s.admin.status(ctx); err == nil {
+			for _, group := range groups {
+				for _, proxy := range group {
+					frpcProxies[proxy.Name] = proxy
+				}
+			}
+		}
+	}
+
+	for _, proxy := range snap.Proxies {
+		ps := proxyStatus{
+			Name:       proxy.Name,
+			Type:       proxy.Type,
+			Status:     "wait start",
+			RemoteAddr: publicURL(s.cfg.ServerAddr, proxy),
+			Local:      fmt.Sprintf("%s:%d", proxy.LocalIP, proxy.LocalPort),
+			Error:      snap.ProxyErrors[proxy.Name],
+		}
+		switch {
+		case ps.Error != "":
+			ps.Status = "start error"
+		case snap.Ready[proxy.Name]:
+			ps.Status = "running"
+		}
+		if isSecretProxyType(proxy.Type) {
+			ps.RemoteAddr = ""
+		}
+		if fp, ok := frpcProxies[proxy.Name]; ok {
+			ps.Status = fp.Status
+			if fp.Err != "" {
+				ps.Error = fp.Err
+			}
+		}
+		if counter := s.cfg.Traffic.counter(proxy.Name); counter != nil {
+			ps.Traffic = &proxyTraffic{
+				BytesIn:     counter.BytesIn.Load(),
+				BytesOut:    counter.BytesOut.Load(),
+				Connections: counter.Connections.Load(),
+				Active:      counter.Active.Load(),
+			}
+		}
+		status.Proxies = append(status.Proxies, ps)
+	}
+	return status
+}
+
+func runStateDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".kai", "run"), nil
+}
+
+// writeRunState stores state as <pid>.json, readable only by the user since
+// it holds the status token.
+func writeRunState(state runState) (string, error) {
+	dir, err := runStateDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d.json", state.PID))
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// readRunStates lists the state files of running tunnels, oldest first.
+func readRunStates() ([]runState, error) {
+	dir, err := runStateDir()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var states []runState
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var state runState
+		if err := json.Unmarshal(data, &state); err != nil || state.PID == 0 {
+			continue
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Started.Before(states[j].Started) })
+	return states, nil
+}
+
+// removeRunState deletes the state file of a tunnel that is gone.
+func removeRunState(pid int) {
+	if dir, err := runStateDir(); err == nil {
+		_ = os.Remove(filepath.Join(dir, fmt.Sprintf("%d.json", pid)))
+	}
+}
+
+// errTunnelNotRunning is returned by callTunnelAPI when nothing listens on
+// the status address, which means the tunnel is gone.
+var errTunnelNotRunning = errors.New("tunnel is not running")
+
+// callTunnelAPI sends an authorized request to a running tunnel. A failed
+// dial means the process is gone and its state file is stale.
+func callTunnelAPI(ctx context.Context, state runState, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+state.StatusAddr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+state.StatusToken)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return nil, fmt.Errorf("%w: %v", errTunnelNotRunning, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("status API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func fetchTunnelStatus(ctx context.Context, state runState) (*tunnelStatus, error) {
+	resp, err := callTunnelAPI(ctx, state, http.MethodGet, "/api/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var status tunnelStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("decode status: %w", err)
+	}
+	return &status, nil
+}
+
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  kai status [flags]")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Show the proxies, errors and traffic of running kai tunnels.")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Flags:")
+		fs.PrintDefaults()
+	}
+	output := fs.String("output", "text", "Output format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("error: --output must be text or json")
+	}
+
+	states, err := readRunStates()
+	if err != nil {
+		return fmt.Errorf("error: read tunnel state: %w", err)
+	}
+	statuses := make([]tunnelStatus, 0, len(states))
+	for _, state := range states {
+		status, err := fetchTunnelStatus(context.Background(), state)
+		if err != nil && isStaleRunState(state, err) {
+			cleanupRunState(state)
+			continue
+		}
+		if err != nil {
+			log.Printf("kai %d: %v", state.PID, err)
+			continue
+		}
+		statuses = append(statuses, *status)
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]any{"tunnels": statuses})
+	}
+	printTunnelStatuses(os.Stdout, statuses, time.Now())
+	return nil
+}
+
+func printTunnelStatuses(w io.Writer, statuses []tunnelStatus, now time.Time) {
+	if len(statuses) == 0 {
+		fmt.Fprintln(w, "No running tunnels.")
+		return
+	}
+	for i, status := range statuses {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		state := "connected"
+		if !status.Connected {
+			state = "connecting"
+		}
+		fmt.Fprintf(w, "kai %d (%s, %s): %s, up %s, %d restarts\n",
+			status.PID, status.Engine, status.Server, state, now.Sub(status.Started).Round(time.Second), status.Restarts)
+		if status.LastError != "" {
+			fmt.Fprintf(w, "  last error: %s\n", status.LastError)
+		}
+		if status.Inspector != "" {
+			fmt.Fprintf(w, "  inspector: %s\n", status.Inspector)
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  NAME\tTYPE\tSTATUS\tREMOTE\tLOCAL\tIN\tOUT\tCONNS\tERROR")
+		for _, proxy := range status.Proxies {
+			in, out, conns := "-", "-", "-"
+			if proxy.Traffic != nil {
+				in, out = formatSize(proxy.Traffic.BytesIn), formatSize(proxy.Traffic.BytesOut)
+				conns = fmt.Sprintf("%d (%d open)", proxy.Traffic.Connections, proxy.Traffic.Active)
+			}
+			remote := proxy.RemoteAddr
+			if remote == "" {
+				remote = "-"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				proxy.Name, proxy.Type, proxy.Status, remote, proxy.Local, in, out, conns, proxy.Error)
+		}
+		tw.Flush()
+	}
+}
+
+// formatSize prints a byte count with the units parseSize accepts.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, suffix := float64(n), "B"
+	for _, next := range []string{"KB", "MB", "GB", "TB"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, next
+	}
+	return fmt.Sprintf("%.1f%s", value, suffix)
+}
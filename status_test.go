@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusServerReportsProxiesAndTraffic(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	captureLog(t)
+	echoPort := startEchoServer(t)
+
+	cfg := TunnelConfig{
+		ServerAddr: "p.ranax.co",
+		Proxies: []ProxyConfig{
+			{Name: "ssh", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: echoPort, RemotePort: 22022},
+			{Name: "dns", Type: "udp", LocalIP: "127.0.0.1", LocalPort: 53, RemotePort: 5353},
+		},
+	}
+	cfg.Traffic = newTrafficStats(cfg.Proxies)
+	monitor := newTunnelMonitor(cfg)
+	relays, engineCfg, err := startTrafficRelays(cfg, func(error) {})
+	if err != nil {
+		t.Fatalf("start relays: %v", err)
+	}
+	defer relays.Close()
+	if engineCfg.Proxies[0].LocalPort == echoPort || engineCfg.Proxies[1].LocalPort != 53 {
+		t.Fatalf("only the tcp proxy should be relayed: %+v", engineCfg.Proxies)
+	}
+
+	monitor.reset()
+	monitor.loginSucceeded()
+	monitor.proxyStarted("ssh")
+	_ = monitor.proxyFailed("dns", "port not allowed")
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(engineCfg.Proxies[0].LocalPort)))
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+
+	srv := &statusServer{
+		state:   runState{ID: "a1b2c3", PID: 4242, Started: time.Now().UTC(), Engine: "native", Server: "p.ranax.co:7000"},
+		cfg:     cfg,
+		monitor: monitor,
+	}
+	if err := srv.start(); err != nil {
+		t.Fatalf("start status server: %v", err)
+	}
+	states, err := readRunStates()
+	if err != nil || len(states) != 1 || states[0].PID != 4242 {
+		t.Fatalf("expected one run state, got %+v, %v", states, err)
+	}
+
+	status, err := fetchTunnelStatus(context.Background(), states[0])
+	if err != nil {
+		t.Fatalf("fetch status: %v", err)
+	}
+	if !status.Connected || len(status.Proxies) != 2 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	ssh, dns := status.Proxies[0], status.Proxies[1]
+	if ssh.Status != "running" || ssh.RemoteAddr != "tcp://p.ranax.co:22022" || ssh.Traffic == nil {
+		t.Fatalf("unexpected ssh status: %+v", ssh)
+	}
+	if ssh.Traffic.BytesIn != 5 || ssh.Traffic.BytesOut != 5 || ssh.Traffic.Connections != 1 || ssh.Traffic.Active != 1 {
+		t.Fatalf("unexpected ssh traffic: %+v", ssh.Traffic)
+	}
+	if dns.Status != "start error" || dns.Error != "port not allowed" || dns.Traffic != nil {
+		t.Fatalf("unexpected dns status: %+v", dns)
+	}
+	conn.Close()
+
+	badToken := states[0]
+	badToken.StatusToken = "wrong"
+	if _, err := fetchTunnelStatus(context.Background(), badToken); err == nil {
+		t.Fatalf("expected the status API to require the token")
+	}
+
+	srv.Close()
+	if states, _ := readRunStates(); len(states) != 0 {
+		t.Fatalf("state file should be removed on close, got %+v", states)
+	}
+	if _, err := fetchTunnelStatus(context.Background(), badToken); !errors.Is(err, errTunnelNotRunning) {
+		t.Fatalf("expected a stale state after close, got %v", err)
+	}
+}
+
+func TestPrintTunnelStatuses(t *testing.T) {
+	var buf bytes.Buffer
+	printTunnelStatuses(&buf, nil, time.Now())
+	if buf.String() != "No running tunnels.\n" {
+		t.Fatalf("unexpected empty output: %q", buf.String())
+	}
+
+	started := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	buf.Reset()
+	printTunnelStatuses(&buf, []tunnelStatus{{
+		PID: 4242, Engine: "frpc", Server: "p.ranax.co:7000", Started: started, Connected: true, Restarts: 1,
+		LastError: "frpc exited: exit status 1",
+		Proxies: []proxyStatus{
+			{Name: "web", Type: "http", Status: "running", RemoteAddr: "http://web.p.ranax.co", Local: "127.0.0.1:3000",
+				Traffic: &proxyTraffic{BytesIn: 2048, BytesOut: 3 * 1024 * 1024, Connections: 4, Active: 1}},
+		},
+	}}, started.Add(90*time.Second))
+	for _, want := range []string{
+		"kai 4242 (frpc, p.ranax.co:7000): connected, up 1m30s, 1 restarts",
+		"last error: frpc exited: exit status 1",
+		"http://web.p.ranax.co",
+		"2.0KB",
+		"3.0MB",
+		"4 (1 open)",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("expected %q in output, got %q", want, buf.String())
+		}
+	}
+}
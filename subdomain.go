@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// maxSubdomainRetries is how often a generated subdomain is replaced after
+// frps reports it as taken.
+const maxSubdomainRetries = 3
+
+var subdomainAdjectives = []string{
+	"amber", "brave", "bright", "calm", "clever", "cosmic", "crisp", "daring",
+	"eager", "fancy", "fuzzy", "gentle", "golden", "happy", "hidden", "humble",
+	"icy", "jolly", "keen", "lively", "lucky", "mellow", "mighty", "misty",
+	"nimble", "noble", "plucky", "proud", "quick", "quiet", "rapid", "rusty",
+	"shiny", "silent", "silver", "sleepy", "snowy", "solar", "spicy", "steady",
+	"sunny", "swift", "tidy", "tiny", "vivid", "wild", "witty", "zesty",
+}
+
+var subdomainNouns = []string{
+	"badger", "beacon", "breeze", "canyon", "cedar", "comet", "coral", "crane",
+	"delta", "ember", "falcon", "fern", "fjord", "forest", "gecko", "glacier",
+	"harbor", "heron", "island", "jaguar", "lagoon", "lantern", "maple", "meadow",
+	"meteor", "nebula", "orbit", "otter", "panda", "pebble", "pine", "planet",
+	"prairie", "quartz", "raven", "reef", "river", "rocket", "sparrow", "summit",
+	"thunder", "tiger", "tundra", "valley", "walrus", "willow", "yak", "zephyr",
+}
+
+// randomSubdomain returns a memorable name such as "brave-otter-4821".
+func randomSubdomain() string {
+	return fmt.Sprintf("%s-%s-%04d",
+		subdomainAdjectives[rand.IntN(len(subdomainAdjectives))],
+		subdomainNouns[rand.IntN(len(subdomainNouns))],
+		rand.IntN(10000))
+}
+
+// assignSubdomains fills in a subdomain for http/https proxies that have
+// neither a subdomain nor a custom domain. Generated names are marked so a
+// collision can be retried with a new one; names derived from git stay
+// stable and are not retried.
+func assignSubdomains(proxies []ProxyConfig, fromGit bool) error {
+	var gitName string
+	used := make(map[string]bool, len(proxies))
+	for _, proxy := range proxies {
+		if proxy.Subdomain != "" {
+			used[proxy.Subdomain] = true
+		}
+	}
+
+	for i := range proxies {
+		proxy := &proxies[i]
+		if (proxy.Type != "http" && proxy.Type != "https") || proxy.Subdomain != "" || len(proxy.CustomDomains) > 0 {
+			continue
+		}
+		if !fromGit {
+			proxy.Subdomain = uniqueRandomSubdomain(used)
+			proxy.AutoSubdomain = true
+			continue
+		}
+		if gitName == "" {
+			var err error
+			if gitName, err = gitSubdomain(); err != nil {
+				return err
+			}
+		}
+		name := gitName
+		if used[name] {
+			name = sanitizeSubdomain(fmt.Sprintf("%s-%d", gitName, proxy.LocalPort))
+		}
+		proxy.Subdomain = name
+		used[name] = true
+	}
+	return nil
+}
+
+func uniqueRandomSubdomain(used map[string]bool) string {
+	for {
+		name := randomSubdomain()
+		if !used[name] {
+			used[name] = true
+			return name
+		}
+	}
+}
+
+// retrySubdomain replaces the generated subdomain of the named proxy in every
+// config passed in, returning the old and new name. ok is false when the proxy
+// did not have a generated subdomain. The configs get new proxy slices, since
+// the old ones may be shared with a running monitor.
+func retrySubdomain(name string, configs ...*TunnelConfig) (string, string, bool) {
+	used := make(map[string]bool)
+	for _, cfg := range configs {
+		for _, proxy := range cfg.Proxies {
+			used[proxy.Subdomain] = true
+		}
+	}
+
+	var oldName, newName string
+	for _, cfg := range configs {
+		cfg.Proxies = slices.Clone(cfg.Proxies)
+		for i := range cfg.Proxies {
+			proxy := &cfg.Proxies[i]
+			if proxy.Name != name || !proxy.AutoSubdomain {
+				continue
+			}
+			if newName == "" {
+				oldName, newName = proxy.Subdomain, uniqueRandomSubdomain(used)
+			}
+			proxy.Subdomain = newName
+		}
+	}
+	return oldName, newName, newName != ""
+}
+
+// gitSubdomain derives "<repo>-<branch>" from the current git checkout, so a
+// branch keeps the same preview URL across runs.
+func gitSubdomain() (string, error) {
+	top, err := gitOutput("rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", fmt.Errorf("error: --subdomain-from-git needs a git repository: %w", err)
+	}
+	branch, err := gitOutput("rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("error: --subdomain-from-git could not read the branch: %w", err)
+	}
+	if branch == "HEAD" {
+		// Detached HEAD: use the commit instead of the literal "HEAD".
+		if branch, err = gitOutput("rev-parse", "--short", "HEAD"); err != nil {
+			return "", fmt.Errorf("error: --subdomain-from-git could not read the commit: %w", err)
+		}
+	}
+	name := sanitizeSubdomain(filepath.Base(top) + "-" + branch)
+	if name == "" {
+		return "", fmt.Errorf("error: --subdomain-from-git could not derive a subdomain from %q", branch)
+	}
+	return name, nil
+}
+
+func gitOutput(args ...string) (string, error) {
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// sanitizeSubdomain turns s into a DNS label: lowercase letters, digits and
+// single dashes, at most 63 characters. Long names are shortened with a hash
+// suffix so different branches do not end up with the same label.
+func sanitizeSubdomain(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	label := strings.TrimRight(b.String(), "-")
+	if len(label) <= 63 {
+		return label
+	}
+	sum := sha256.Sum256([]byte(s))
+	return strings.TrimRight(label[:54], "-") + "-" + hex.EncodeToString(sum[:])[:8]
+}
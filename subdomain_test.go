@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAssignSubdomains(t *testing.T) {
+	proxies := []ProxyConfig{
+		{Type: "http", LocalPort: 3000},
+		{Type: "http", LocalPort: 3001, Subdomain: "web"},
+		{Type: "http", LocalPort: 3002, CustomDomains: []string{"demo.customer.com"}},
+		{Type: "tcp", LocalPort: 22, RemotePort: 22022},
+	}
+	if err := assignSubdomains(proxies, false); err != nil {
+		t.Fatalf("assign subdomains: %v", err)
+	}
+	if !regexp.MustCompile(`^[a-z]+-[a-z]+-\d{4}$`).MatchString(proxies[0].Subdomain) || !proxies[0].AutoSubdomain {
+		t.Fatalf("expected a generated subdomain, got %+v", proxies[0])
+	}
+	if proxies[1].Subdomain != "web" || proxies[1].AutoSubdomain {
+		t.Fatalf("explicit subdomain changed: %+v", proxies[1])
+	}
+	if proxies[2].Subdomain != "" || proxies[3].Subdomain != "" {
+		t.Fatalf("proxies with a domain or without HTTP should not get a subdomain: %+v", proxies)
+	}
+}
+
+func TestRetrySubdomainReplacesGeneratedName(t *testing.T) {
+	cfg := TunnelConfig{Proxies: []ProxyConfig{
+		{Name: "auto", Type: "http", Subdomain: "calm-otter-0001", AutoSubdomain: true},
+		{Name: "fixed", Type: "http", Subdomain: "web"},
+	}}
+	engineCfg := cfg
+	engineCfg.Proxies = append([]ProxyConfig(nil), cfg.Proxies...)
+	monitor := newTunnelMonitor(cfg)
+
+	oldName, newName, ok := retrySubdomain("auto", &cfg, &engineCfg)
+	if !ok || oldName != "calm-otter-0001" || newName == oldName {
+		t.Fatalf("unexpected retry: %q -> %q (%v)", oldName, newName, ok)
+	}
+	if cfg.Proxies[0].Subdomain != newName || engineCfg.Proxies[0].Subdomain != newName {
+		t.Fatalf("both configs should use the new name: %+v %+v", cfg.Proxies[0], engineCfg.Proxies[0])
+	}
+	// The monitor's proxies are only changed under its lock.
+	if got := monitor.snapshot().Proxies[0].Subdomain; got != oldName {
+		t.Fatalf("retrySubdomain changed the monitor's proxies: %q", got)
+	}
+	monitor.setSubdomain("auto", newName)
+	if got := monitor.snapshot().Proxies[0].Subdomain; got != newName {
+		t.Fatalf("monitor still has %q", got)
+	}
+	if _, _, ok := retrySubdomain("fixed", &cfg, &engineCfg); ok {
+		t.Fatalf("explicit subdomains must not be replaced")
+	}
+}
+
+func TestSubdomainFromGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := filepath.Join(t.TempDir(), "My_App")
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "feature/Login-Page", dir},
+		{"-C", dir, "-c", "user.name=kai", "-c", "user.email=kai@example.com", "commit", "-q", "--allow-empty", "-m", "init"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v %s", args, err, out)
+		}
+	}
+	t.Chdir(dir)
+
+	proxies := []ProxyConfig{{Type: "http", LocalPort: 3000}, {Type: "http", LocalPort: 8080}}
+	if err := assignSubdomains(proxies, true); err != nil {
+		t.Fatalf("assign subdomains: %v", err)
+	}
+	if proxies[0].Subdomain != "my-app-feature-login-page" || proxies[0].AutoSubdomain {
+		t.Fatalf("unexpected git subdomain: %+v", proxies[0])
+	}
+	if proxies[1].Subdomain != "my-app-feature-login-page-8080" {
+		t.Fatalf("second tunnel should get a port suffix: %+v", proxies[1])
+	}
+}
+
+func TestSanitizeSubdomain(t *testing.T) {
+	if got := sanitizeSubdomain("--Repo__Name/feat.x--"); got != "repo-name-feat-x" {
+		t.Fatalf("sanitizeSubdomain = %q", got)
+	}
+	long := sanitizeSubdomain("repo-" + strings.Repeat("a", 80))
+	other := sanitizeSubdomain("repo-" + strings.Repeat("a", 81))
+	if len(long) > 63 || long == other {
+		t.Fatalf("long names should be shortened distinctly: %q %q", long, other)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+const defaultMaxRestarts = 10
+
+// restartPolicy controls how a tunnel engine is restarted after it exits.
+type restartPolicy struct {
+	// MaxRestarts is how many restarts in a row are allowed; a run that lasts
+	// StableAfter starts a new count. Zero disables restarts and a negative
+	// value restarts forever.
+	MaxRestarts int
+	// WindowLimit caps restarts within Window; extra restarts wait until the
+	// oldest one falls out of the window.
+	WindowLimit int
+	Window      time.Duration
+
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// StableAfter is how long a run must last for the backoff and the restart
+	// count to reset.
+	StableAfter time.Duration
+}
+
+func defaultRestartPolicy(maxRestarts int) restartPolicy {
+	return restartPolicy{
+		MaxRestarts: maxRestarts,
+		WindowLimit: 5,
+		Window:      time.Minute,
+		MinBackoff:  time.Second,
+		MaxBackoff:  30 * time.Second,
+		StableAfter: time.Minute,
+	}
+}
+
+// superviseTunnel runs the engine until the context is canceled, restarting it
+// with exponential backoff and jitter whenever it exits on its own.
+func superviseTunnel(ctx context.Context, policy restartPolicy, name string, events *tunnelEvents, run func(context.Context) error) error {
+	restarts := 0
+	backoff := policy.MinBackoff
+	var recent []time.Time
+
+	for {
+		started := time.Now()
+		err := run(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		var tunnelErr *tunnelError
+		if policy.MaxRestarts == 0 || errors.As(err, &tunnelErr) {
+			return err
+		}
+
+		reason := "exited with status 0"
+		if err != nil {
+			reason = err.Error()
+		}
+		if time.Since(started) >= policy.StableAfter {
+			restarts = 0
+			backoff = policy.MinBackoff
+		}
+		if policy.MaxRestarts > 0 && restarts >= policy.MaxRestarts {
+			return &tunnelError{
+				Code:     "tunnel_exited",
+				Message:  fmt.Sprintf("error: %s gave up after %d restarts: %s", name, restarts, reason),
+				ExitCode: exitCodeTunnelExited,
+				Err:      err,
+			}
+		}
+
+		delay := jitterBackoff(backoff)
+
+		now := time.Now()
+		for len(recent) > 0 && now.Sub(recent[0]) >= policy.Window {
+			recent = recent[1:]
+		}
+		if policy.WindowLimit > 0 && len(recent) >= policy.WindowLimit {
+			if wait := recent[0].Add(policy.Window).Sub(now); wait > delay {
+				delay = wait
+			}
+		}
+
+		restarts++
+		budget := "unlimited"
+		if policy.MaxRestarts > 0 {
+			budget = fmt.Sprint(policy.MaxRestarts)
+		}
+		log.Printf("%s stopped (%s), restarting in %s (restart %d/%s)", name, reason, delay.Round(time.Millisecond), restarts, budget)
+		events.emit(tunnelEvent{Event: "reconnecting", Attempt: restarts, DelayMS: delay.Milliseconds(), Reason: reason})
+		if err := sleepWithContext(ctx, delay); err != nil {
+			return nil
+		}
+		recent = append(recent, time.Now())
+		backoff = min(backoff*2, policy.MaxBackoff)
+	}
+}
+
+// jitterBackoff spreads restarts by ±20% so several clients that lose the
+// server at the same time do not reconnect in lockstep.
+func jitterBackoff(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	spread := int64(d) / 5
+	return d - time.Duration(spread) + time.Duration(rand.Int64N(2*spread+1))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fastRestartPolicy(maxRestarts int) restartPolicy {
+	return restartPolicy{
+		MaxRestarts: maxRestarts,
+		WindowLimit: 100,
+		Window:      time.Minute,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  4 * time.Millisecond,
+		StableAfter: time.Minute,
+	}
+}
+
+func TestSuperviseTunnelGivesUpAfterBudget(t *testing.T) {
+	runs := 0
+	err := superviseTunnel(context.Background(), fastRestartPolicy(3), "frpc", nil, func(ctx context.Context) error {
+		runs++
+		return errors.New("frpc exited: exit status 1")
+	})
+	if runs != 4 {
+		t.Fatalf("expected 1 run plus 3 restarts, got %d runs", runs)
+	}
+	if err == nil || !strings.Contains(err.Error(), "gave up after 3 restarts") || !strings.Contains(err.Error(), "exit status 1") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSuperviseTunnelStableRunResetsBudget(t *testing.T) {
+	policy := fastRestartPolicy(3)
+	policy.StableAfter = 20 * time.Millisecond
+	runs := 0
+	err := superviseTunnel(context.Background(), policy, "frpc", nil, func(ctx context.Context) error {
+		runs++
+		// Every third run stays up long enough to count as stable.
+		if runs%3 == 0 && runs < 9 {
+			time.Sleep(policy.StableAfter)
+		}
+		return errors.New("exited")
+	})
+	// Runs 3 and 6 start a new count, so the budget of 3 only runs out when
+	// run 9 fails after 3 restarts in a row.
+	if runs != 9 {
+		t.Fatalf("expected 9 runs, got %d", runs)
+	}
+	if err == nil || !strings.Contains(err.Error(), "gave up after 3 restarts") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSuperviseTunnelRestartsDisabled(t *testing.T) {
+	runs := 0
+	want := errors.New("boom")
+	err := superviseTunnel(context.Background(), fastRestartPolicy(0), "frpc", nil, func(ctx context.Context) error {
+		runs++
+		return want
+	})
+	if runs != 1 || !errors.Is(err, want) {
+		t.Fatalf("expected a single run returning the engine error, got %d runs and %v", runs, err)
+	}
+}
+
+func TestSuperviseTunnelStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	err := superviseTunnel(ctx, fastRestartPolicy(-1), "frpc", nil, func(ctx context.Context) error {
+		runs++
+		if runs == 3 {
+			cancel()
+		}
+		return errors.New("exited")
+	})
+	if err != nil || runs != 3 {
+		t.Fatalf("expected clean stop after 3 runs, got %d runs and %v", runs, err)
+	}
+}
+
+func TestSuperviseTunnelWindowLimit(t *testing.T) {
+	policy := fastRestartPolicy(-1)
+	policy.WindowLimit = 2
+	policy.Window = 150 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var starts []time.Time
+	_ = superviseTunnel(ctx, policy, "frpc", nil, func(ctx context.Context) error {
+		starts = append(starts, time.Now())
+		if len(starts) == 4 {
+			cancel()
+		}
+		return errors.New("exited")
+	})
+	if len(starts) != 4 {
+		t.Fatalf("expected 4 runs, got %d", len(starts))
+	}
+	if gap := starts[3].Sub(starts[1]); gap < policy.Window {
+		t.Fatalf("third restart should wait for the window, gap was %s", gap)
+	}
+}
+
+func TestJitterBackoffBounds(t *testing.T) {
+	for range 100 {
+		got := jitterBackoff(10 * time.Second)
+		if got < 8*time.Second || got > 12*time.Second {
+			t.Fatalf("jitter out of bounds: %s", got)
+		}
+	}
+}
+
+func TestSuperviseTunnelDoesNotRestartPermanentFailures(t *testing.T) {
+	runs := 0
+	err := superviseTunnel(context.Background(), fastRestartPolicy(-1), "frpc", nil, func(ctx context.Context) error {
+		runs++
+		return &tunnelError{Code: "auth_failed", ExitCode: exitCodeTunnelAuth}
+	})
+	var tunnelErr *tunnelError
+	if runs != 1 || !errors.As(err, &tunnelErr) || tunnelErr.Code != "auth_failed" {
+		t.Fatalf("expected a single run returning auth_failed, got %d runs and %v", runs, err)
+	}
+}
+
+func TestParseMaxRestartsFromConfig(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "config.toml")
+	content := `
+[forwarding]
+max_restarts = -1
+`
+	if err := os.WriteFile(cfgPath, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	got, err := parseTunnelDefaultsFromConfig(cfgPath)
+	if err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+	if !got.hasMaxRestarts || got.MaxRestarts != -1 {
+		t.Fatalf("max_restarts mismatch: got %d", got.MaxRestarts)
+	}
+}
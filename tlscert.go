@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const selfSignedValidity = 30 * 24 * time.Hour
+
+// generateSelfSignedCert returns PEM-encoded certificate and key for hosts.
+// It is meant for testing --local-tls without a real certificate.
+func generateSelfSignedCert(hosts ...string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate serial: %w", err)
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"kai self-signed"}},
+		DNSNames:              hosts,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// localTLSHosts are the names the certificate for a --local-tls proxy must
+// cover: the subdomain under the server and every custom domain.
+func localTLSHosts(serverAddr string, proxy ProxyConfig) []string {
+	var hosts []string
+	if proxy.Subdomain != "" {
+		hosts = append(hosts, fmt.Sprintf("%s.%s", proxy.Subdomain, serverAddr))
+	}
+	return append(hosts, proxy.CustomDomains...)
+}
+
+// writeLocalTLSFiles generates self-signed certificates into dir for every
+// --local-tls proxy without a cert/key pair, so frpc's https2http plugin can
+// load them. The returned proxies point at the written files.
+func writeLocalTLSFiles(dir string, cfg TunnelConfig) ([]ProxyConfig, error) {
+	proxies := append([]ProxyConfig(nil), cfg.Proxies...)
+	for i := range proxies {
+		proxy := &proxies[i]
+		if !proxy.LocalTLS || proxy.TLSCertFile != "" {
+			continue
+		}
+		certPEM, keyPEM, err := generateSelfSignedCert(localTLSHosts(cfg.ServerAddr, *proxy)...)
+		if err != nil {
+			return nil, err
+		}
+		certPath := filepath.Join(dir, proxy.Name+".crt")
+		keyPath := filepath.Join(dir, proxy.Name+".key")
+		if err := os.WriteFile(certPath, certPEM, 0600); err != nil {
+			return nil, fmt.Errorf("write certificate error: %w", err)
+		}
+		if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+			return nil, fmt.Errorf("write key error: %w", err)
+		}
+		proxy.TLSCertFile = certPath
+		proxy.TLSKeyFile = keyPath
+	}
+	return proxies, nil
+}
+
+// localTLSConfig loads (or generates) the certificate the native engine
+// presents for a --local-tls proxy.
+func localTLSConfig(serverAddr string, proxy ProxyConfig) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if proxy.TLSCertFile != "" {
+		cert, err = tls.LoadX509KeyPair(proxy.TLSCertFile, proxy.TLSKeyFile)
+	} else {
+		var certPEM, keyPEM []byte
+		certPEM, keyPEM, err = generateSelfSignedCert(localTLSHosts(serverAddr, proxy)...)
+		if err == nil {
+			cert, err = tls.X509KeyPair(certPEM, keyPEM)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate for %s: %w", proxy.Name, err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
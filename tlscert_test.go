@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+)
+
+func TestWriteLocalTLSFilesRendersHTTPS2HTTPPlugin(t *testing.T) {
+	cfg := TunnelConfig{
+		ServerAddr: "p.ranax.co",
+		ServerPort: 7000,
+		Token:      "abc",
+		Proxies: []ProxyConfig{
+			{Name: "secure", Type: "https", LocalIP: "127.0.0.1", LocalPort: 3000, Subdomain: "demo", LocalTLS: true},
+		},
+	}
+
+	proxies, err := writeLocalTLSFiles(t.TempDir(), cfg)
+	if err != nil {
+		t.Fatalf("write local TLS files: %v", err)
+	}
+	if cfg.Proxies[0].TLSCertFile != "" {
+		t.Fatalf("expected input proxies to be left untouched")
+	}
+
+	pair, err := tls.LoadX509KeyPair(proxies[0].TLSCertFile, proxies[0].TLSKeyFile)
+	if err != nil {
+		t.Fatalf("load generated pair: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse generated certificate: %v", err)
+	}
+	if err := leaf.VerifyHostname("demo.p.ranax.co"); err != nil {
+		t.Fatalf("certificate does not cover tunnel host: %v", err)
+	}
+
+	cfg.Proxies = proxies
+	rendered, err := renderFrpcConfig(cfg)
+	if err != nil {
+		t.Fatalf("render config: %v", err)
+	}
+	text := string(rendered)
+	for _, want := range []string{
+		`type      = "https"`,
+		`subdomain = "demo"`,
+		`plugin.type      = "https2http"`,
+		`plugin.localAddr = "127.0.0.1:3000"`,
+		`plugin.crtPath   = ` + tomlQuote(proxies[0].TLSCertFile),
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("expected %q in rendered config, got %q", want, text)
+		}
+	}
+}
+
+func TestRenderFrpcConfigWindowsTLSPaths(t *testing.T) {
+	rendered, err := renderFrpcConfig(TunnelConfig{
+		ServerAddr: "p.ranax.co",
+		ServerPort: 7000,
+		Proxies: []ProxyConfig{{
+			Name: "secure", Type: "https", LocalIP: "127.0.0.1", LocalPort: 3000, Subdomain: "demo", LocalTLS: true,
+			TLSCertFile: `C:\Users\me\AppData\Local\Temp\kai\secure.crt`,
+			TLSKeyFile:  `C:\Users\me\AppData\Local\Temp\kai\secure.key`,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("render config: %v", err)
+	}
+	text := string(rendered)
+	for _, want := range []string{
+		`plugin.crtPath   = "C:\\Users\\me\\AppData\\Local\\Temp\\kai\\secure.crt"`,
+		`plugin.keyPath   = "C:\\Users\\me\\AppData\\Local\\Temp\\kai\\secure.key"`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("expected %q in rendered config, got %q", want, text)
+		}
+	}
+}
+
+func TestValidateProxyLocalTLS(t *testing.T) {
+	httpProxy := ProxyConfig{Type: "http", LocalPort: 80, Subdomain: "x", LocalTLS: true}
+	if err := validateProxy(httpProxy); err == nil {
+		t.Fatalf("expected --local-tls to be rejected for http tunnels")
+	}
+	halfPair := ProxyConfig{Type: "https", LocalPort: 80, Subdomain: "x", LocalTLS: true, TLSCertFile: "a.crt"}
+	if err := validateProxy(halfPair); err == nil {
+		t.Fatalf("expected error when only --tls-cert is set")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// trafficCounter counts what kai relayed for one proxy. In is traffic from
+// the tunnel to the local service, Out the responses.
+type trafficCounter struct {
+	BytesIn     atomic.Int64
+	BytesOut    atomic.Int64
+	Connections atomic.Int64
+	Active      atomic.Int64
+}
+
+// join copies between a tunnel connection and the local service, counting
+// both directions.
+func (c *trafficCounter) join(tunnel, local net.Conn) {
+	c.Connections.Add(1)
+	c.Active.Add(1)
+	defer c.Active.Add(-1)
+	joinCounted(tunnel, local, &c.BytesIn, &c.BytesOut)
+}
+
+// trafficStats are the counters of the TCP-based proxies by name. UDP
+// proxies are not counted.
+type trafficStats map[string]*trafficCounter
+
+func newTrafficStats(proxies []ProxyConfig) trafficStats {
+	stats := make(trafficStats)
+	for _, proxy := range proxies {
+		if proxy.Type != "udp" {
+			stats[proxy.Name] = &trafficCounter{}
+		}
+	}
+	return stats
+}
+
+// counter returns the counter of the named proxy, or nil.
+func (s trafficStats) counter(name string) *trafficCounter {
+	return s[name]
+}
+
+// trafficRelays are loopback TCP listeners between frpc and the local
+// services. The native engine counts traffic itself; frpc only sees the
+// relays. A relay refuses connections while its local service is down, so
+// frpc's health check on it fails and frpc withdraws the proxy.
+type trafficRelays struct {
+	relays map[string]*trafficRelay
+}
+
+// startTrafficRelays puts a counting relay in front of every proxy with a
+// counter in cfg.Traffic and returns cfg pointed at the relays. fail is
+// called with a tunnelError when a relay cannot get its address back, since
+// frpc would never see the proxy's local service again.
+func startTrafficRelays(cfg TunnelConfig, fail func(error)) (*trafficRelays, TunnelConfig, error) {
+	relays := &trafficRelays{relays: make(map[string]*trafficRelay)}
+	engineCfg := cfg
+	engineCfg.Proxies = append([]ProxyConfig(nil), cfg.Proxies...)
+
+	for i, proxy := range engineCfg.Proxies {
+		counter := cfg.Traffic.counter(proxy.Name)
+		if counter == nil {
+			continue
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			relays.Close()
+			return nil, cfg, err
+		}
+		relay := &trafficRelay{
+			name:    proxy.Name,
+			target:  net.JoinHostPort(proxy.LocalIP, strconv.Itoa(proxy.LocalPort)),
+			counter: counter,
+			addr:    ln.Addr().String(),
+			ln:      ln,
+		}
+		relays.relays[proxy.Name] = relay
+		go relay.serve(ln)
+
+		engineCfg.Proxies[i].LocalIP = "127.0.0.1"
+		engineCfg.Proxies[i].LocalPort = ln.Addr().(*net.TCPAddr).Port
+	}
+
+	if cfg.Health != nil {
+		cfg.Health.watch(func(name string, up bool) {
+			relay := relays.relays[name]
+			if relay == nil {
+				return
+			}
+			if err := relay.setOpen(up); err != nil {
+				fail(err)
+			}
+		})
+	}
+	return relays, engineCfg, nil
+}
+
+func (r *trafficRelays) Close() error {
+	for _, relay := range r.relays {
+		relay.close()
+	}
+	return nil
+}
+
+// trafficRelay forwards to one local service. Its listener is closed while
+// the service is down and opened again on the same address once it is back.
+type trafficRelay struct {
+	name    string
+	target  string
+	counter *trafficCounter
+	addr    string
+
+	mu     sync.Mutex
+	ln     net.Listener
+	closed bool
+}
+
+func (r *trafficRelay) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			local, err := net.Dial("tcp", r.target)
+			if err != nil {
+				log.Printf("connect local service %s: %v", r.target, err)
+				conn.Close()
+				return
+			}
+			r.counter.join(conn, local)
+		}()
+	}
+}
+
+// setOpen opens or closes the relay's listener. frpc's config points at the
+// relay's address, so failing to listen on it again is fatal for the tunnel.
+func (r *trafficRelay) setOpen(open bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case r.closed:
+	case !open && r.ln != nil:
+		r.ln.Close()
+		r.ln = nil
+	case open && r.ln == nil:
+		ln, err := net.Listen("tcp", r.addr)
+		if err != nil {
+			return &tunnelError{
+				Code:     "relay_unavailable",
+				Message:  fmt.Sprintf("error: traffic relay of tunnel %q could not listen on %s again: %v", r.name, r.addr, err),
+				ExitCode: exitCodeTunnelRelayUnavailable,
+				Err:      err,
+				Proxy:    r.name,
+			}
+		}
+		r.ln = ln
+		go r.serve(ln)
+	}
+	return nil
+}
+
+func (r *trafficRelay) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.ln != nil {
+		r.ln.Close()
+		r.ln = nil
+	}
+}
+
+// joinCounted copies between the tunnel side and the local side until either
+// closes. Bytes are counted as they pass so long-lived connections show up
+// in the counters before they end.
+func joinCounted(tunnel, local net.Conn, in, out *atomic.Int64) {
+	var once sync.Once
+	closeBoth := func() {
+		tunnel.Close()
+		local.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(local, &countingReader{r: tunnel, onRead: func(n int) { in.Add(int64(n)) }})
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(tunnel, &countingReader{r: local, onRead: func(n int) { out.Add(int64(n)) }})
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenEcho serves an echo service on addr until the listener is closed.
+func listenEcho(t *testing.T, addr string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen echo: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestTrafficRelayRefusesWhileLocalServiceIsDown(t *testing.T) {
+	captureLog(t)
+	echo := listenEcho(t, "127.0.0.1:0")
+	echoAddr := echo.Addr().String()
+
+	cfg := TunnelConfig{Proxies: []ProxyConfig{
+		{Name: "db", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: echo.Addr().(*net.TCPAddr).Port},
+	}}
+	cfg.Traffic = newTrafficStats(cfg.Proxies)
+	cfg.Health = newLocalHealth(cfg.Proxies, nil)
+	cfg.Health.interval = 10 * time.Millisecond
+	relays, engineCfg, err := startTrafficRelays(cfg, func(err error) { t.Errorf("unexpected relay failure: %v", err) })
+	if err != nil {
+		t.Fatalf("start relays: %v", err)
+	}
+	defer relays.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cfg.Health.run(ctx)
+
+	relayAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(engineCfg.Proxies[0].LocalPort))
+	roundTrip := func() error {
+		conn, err := net.DialTimeout("tcp", relayAddr, time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, make([]byte, 4))
+		return err
+	}
+	waitFor := func(what string, ok func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !ok() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if err := roundTrip(); err != nil {
+		t.Fatalf("relay should forward while the service is up: %v", err)
+	}
+	echo.Close()
+	waitFor("the relay to refuse connections", func() bool {
+		conn, err := net.DialTimeout("tcp", relayAddr, time.Second)
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	})
+
+	echo = listenEcho(t, echoAddr)
+	defer echo.Close()
+	waitFor("the relay to reopen", func() bool { return roundTrip() == nil })
+	if got := cfg.Traffic.counter("db").Connections.Load(); got < 2 {
+		t.Fatalf("expected the relayed connections to be counted, got %d", got)
+	}
+}
+
+func TestTrafficRelayFailsTunnelWhenItsPortIsTaken(t *testing.T) {
+	captureLog(t)
+	echo := listenEcho(t, "127.0.0.1:0")
+	echoAddr := echo.Addr().String()
+
+	cfg := TunnelConfig{Proxies: []ProxyConfig{
+		{Name: "db", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: echo.Addr().(*net.TCPAddr).Port},
+	}}
+	cfg.Traffic = newTrafficStats(cfg.Proxies)
+	cfg.Health = newLocalHealth(cfg.Proxies, nil)
+	cfg.Health.interval = 10 * time.Millisecond
+	failed := make(chan error, 1)
+	relays, engineCfg, err := startTrafficRelays(cfg, func(err error) { failed <- err })
+	if err != nil {
+		t.Fatalf("start relays: %v", err)
+	}
+	defer relays.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cfg.Health.run(ctx)
+
+	// Another program grabs the relay's port while the service is down.
+	relayAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(engineCfg.Proxies[0].LocalPort))
+	echo.Close()
+	var squatter net.Listener
+	deadline := time.Now().Add(5 * time.Second)
+	for squatter == nil {
+		if ln, err := net.Listen("tcp", relayAddr); err == nil {
+			squatter = ln
+		} else if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the relay to close: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer squatter.Close()
+
+	echo = listenEcho(t, echoAddr)
+	defer echo.Close()
+	select {
+	case err := <-failed:
+		var tunnelErr *tunnelError
+		if !errors.As(err, &tunnelErr) || tunnelErr.Code != "relay_unavailable" || tunnelErr.ExitCode != exitCodeTunnelRelayUnavailable {
+			t.Fatalf("expected a relay_unavailable error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the relay to report that it could not reopen")
+	}
+}
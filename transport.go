@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var transportProtocols = []string{"tcp", "kcp", "quic", "websocket", "wss"}
+
+// TransportConfig is how the client connects to frps. It is rendered as
+// frpc's [transport] options; the native engine supports TCP with or without
+// TLS.
+type TransportConfig struct {
+	// Protocol is tcp (default), kcp, quic, websocket or wss.
+	Protocol string
+	// PoolCount is how many work connections frpc opens in advance. frps
+	// caps it with its transport.maxPoolCount.
+	PoolCount int
+
+	// TLS wraps the connection to frps in TLS, which frpc enables by
+	// default. Without TLSCAFile the server certificate is not verified;
+	// TLSCertFile/TLSKeyFile present a client certificate for mTLS.
+	TLS           bool
+	TLSCAFile     string
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSServerName string
+}
+
+// validateTransport checks the transport options and makes the file paths
+// absolute.
+func validateTransport(t *TransportConfig) error {
+	if t.Protocol != "" && !slices.Contains(transportProtocols, t.Protocol) {
+		return fmt.Errorf("error: unsupported --protocol %q (use %s)", t.Protocol, strings.Join(transportProtocols, ", "))
+	}
+	if t.PoolCount < 0 {
+		return fmt.Errorf("error: --pool-count must not be negative")
+	}
+	if (t.TLSCertFile == "") != (t.TLSKeyFile == "") {
+		return fmt.Errorf("error: --tls-client-cert and --tls-client-key must be used together")
+	}
+	if !t.TLS && (t.TLSCAFile != "" || t.TLSCertFile != "" || t.TLSServerName != "") {
+		return fmt.Errorf("error: --tls-ca, --tls-client-cert and --tls-server-name need TLS (remove --tls=false)")
+	}
+	for _, path := range []*string{&t.TLSCAFile, &t.TLSCertFile, &t.TLSKeyFile} {
+		if *path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*path)
+		if err != nil {
+			return fmt.Errorf("error: TLS file %q: %w", *path, err)
+		}
+		if _, err := os.Stat(abs); err != nil {
+			return fmt.Errorf("error: TLS file: %w", err)
+		}
+		*path = abs
+	}
+	return nil
+}
+
+// clientTLSConfig builds the TLS config for the connection to frps the same
+// way frpc does.
+func (t TransportConfig) clientTLSConfig(serverAddr string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: t.TLSServerName, MinVersion: tls.VersionTLS12}
+	if cfg.ServerName == "" {
+		cfg.ServerName = serverAddr
+	}
+	if t.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(filepath.FromSlash(t.TLSCertFile), filepath.FromSlash(t.TLSKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("error: load TLS client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if t.TLSCAFile == "" {
+		cfg.InsecureSkipVerify = true
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(filepath.FromSlash(t.TLSCAFile))
+	if err != nil {
+		return nil, fmt.Errorf("error: read TLS CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("error: no certificates found in %s", t.TLSCAFile)
+	}
+	cfg.RootCAs = pool
+	return cfg, nil
+}
+
+// applyTransportKey sets a key from the [transport] section of config.toml.
+// frpc's dotted names (tls.enable, tls.trustedCaFile) are accepted as well.
+func applyTransportKey(defaults *tunnelDefaults, key, value string) error {
+	key = strings.ReplaceAll(strings.ToLower(key), ".", "_")
+	t := &defaults.Transport
+	var target *string
+	switch key {
+	case "protocol":
+		target = &t.Protocol
+	case "pool_count", "poolcount":
+		num, err := parseTomlInt(value)
+		if err != nil {
+			return err
+		}
+		t.PoolCount = num
+		return nil
+	case "tls", "tls_enable":
+		enabled, err := parseTomlBool(value)
+		if err != nil {
+			return err
+		}
+		t.TLS = enabled
+		defaults.hasTransportTLS = true
+		return nil
+	case "tls_ca", "tls_trusted_ca_file", "tls_trustedcafile":
+		target = &t.TLSCAFile
+	case "tls_cert", "tls_cert_file", "tls_certfile":
+		target = &t.TLSCertFile
+	case "tls_key", "tls_key_file", "tls_keyfile":
+		target = &t.TLSKeyFile
+	case "tls_server_name", "tls_servername":
+		target = &t.TLSServerName
+	case "use_encryption", "useencryption":
+		enabled, err := parseTomlBool(value)
+		if err != nil {
+			return err
+		}
+		defaults.UseEncryption = enabled
+		return nil
+	case "use_compression", "usecompression":
+		enabled, err := parseTomlBool(value)
+		if err != nil {
+			return err
+		}
+		defaults.UseCompression = enabled
+		return nil
+	default:
+		return nil
+	}
+	str, err := parseTomlString(value)
+	if err != nil {
+		return err
+	}
+	*target = str
+	return nil
+}
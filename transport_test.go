@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateTransport(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caFile, []byte("ca"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		transport TransportConfig
+		wantErr   string
+	}{
+		{TransportConfig{}, ""},
+		{TransportConfig{Protocol: "wss", PoolCount: 5, TLS: true, TLSCAFile: caFile, TLSServerName: "frps.example.com"}, ""},
+		{TransportConfig{Protocol: "http"}, "unsupported --protocol"},
+		{TransportConfig{PoolCount: -1}, "--pool-count"},
+		{TransportConfig{TLS: true, TLSCertFile: caFile}, "must be used together"},
+		{TransportConfig{TLSCAFile: caFile}, "need TLS"},
+		{TransportConfig{TLS: true, TLSCAFile: filepath.Join(dir, "missing.crt")}, "TLS file"},
+	}
+	for _, tc := range cases {
+		transport := tc.transport
+		err := validateTransport(&transport)
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Fatalf("validateTransport(%+v) = %v, want %q", tc.transport, err, tc.wantErr)
+		}
+	}
+
+	t.Chdir(dir)
+	transport := TransportConfig{TLS: true, TLSCAFile: "ca.crt"}
+	if err := validateTransport(&transport); err != nil || transport.TLSCAFile != caFile {
+		t.Fatalf("expected an absolute CA path, got %q, %v", transport.TLSCAFile, err)
+	}
+}
+
+func TestRenderFrpcConfigTransport(t *testing.T) {
+	rendered, err := renderFrpcConfig(TunnelConfig{
+		ServerAddr: "p.ranax.co",
+		ServerPort: 7000,
+		Token:      "abc",
+		Transport: TransportConfig{
+			Protocol: "wss", PoolCount: 3, TLS: true,
+			TLSCAFile: "/etc/kai/ca.crt", TLSCertFile: "/etc/kai/client.crt", TLSKeyFile: "/etc/kai/client.key", TLSServerName: "frps.internal",
+		},
+		Proxies:  []ProxyConfig{{Name: "web", Type: "http", LocalIP: "127.0.0.1", LocalPort: 3000, Subdomain: "web", UseEncryption: true, UseCompression: true}},
+		Visitors: []VisitorConfig{{Name: "db-visitor", Type: "stcp", ServerName: "db", SecretKey: "k", BindAddr: "127.0.0.1", BindPort: 5432, UseEncryption: true}},
+	})
+	if err != nil {
+		t.Fatalf("render config: %v", err)
+	}
+
+	text := string(rendered)
+	for _, want := range []string{
+		`transport.protocol   = "wss"`,
+		`transport.tls.enable = true`,
+		`transport.poolCount  = 3`,
+		`transport.tls.trustedCaFile = "/etc/kai/ca.crt"`,
+		`transport.tls.certFile = "/etc/kai/client.crt"`,
+		`transport.tls.keyFile  = "/etc/kai/client.key"`,
+		`transport.tls.serverName = "frps.internal"`,
+		`transport.useCompression = true`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("expected %q in rendered config, got %q", want, text)
+		}
+	}
+	if got := strings.Count(text, "transport.useEncryption = true"); got != 2 {
+		t.Fatalf("expected encryption on the proxy and the visitor, got %d in %q", got, text)
+	}
+	if transport, auth := strings.Index(text, "transport.protocol"), strings.Index(text, "[auth]"); transport > auth {
+		t.Fatalf("expected the transport options before [auth], got %q", text)
+	}
+}
+
+func TestParseTransportFromConfig(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "config.toml")
+	content := `
+[transport]
+protocol = "websocket"
+pool_count = 4
+tls.enable = false
+use-encryption = true
+
+[tunnels.web]
+port = 3000
+use_compression = true
+`
+	if err := os.WriteFile(cfgPath, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	got, err := parseTunnelDefaultsFromConfig(cfgPath)
+	if err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+	if got.Transport.Protocol != "websocket" || got.Transport.PoolCount != 4 || got.Transport.TLS || !got.hasTransportTLS || !got.UseEncryption {
+		t.Fatalf("unexpected transport defaults: %+v", got)
+	}
+	if len(got.Profiles) != 1 || !got.Profiles[0].Proxy.UseCompression {
+		t.Fatalf("unexpected profiles: %+v", got.Profiles)
+	}
+}
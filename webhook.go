@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const defaultWebhookFile = "webhooks.jsonl"
+
+// webhookRecord is one received request, as appended to the JSONL file.
+type webhookRecord struct {
+	ID         int          `json:"id"`
+	Time       time.Time    `json:"time"`
+	Method     string       `json:"method"`
+	Host       string       `json:"host"`
+	Path       string       `json:"path"`
+	RemoteAddr string       `json:"remote_addr,omitempty"`
+	Headers    http.Header  `json:"headers"`
+	Body       capturedBody `json:"body"`
+}
+
+// runWebhook answers every request on an ephemeral loopback port with a fixed
+// response, prints the requests and records them, and tunnels the port like
+// `kai -p <port>`.
+func runWebhook(args []string) error {
+	fs := flag.NewFlagSet("webhook", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  kai webhook [flags] [tunnel flags]")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Accepts any request through an http tunnel, prints it and appends it to a JSONL file.")
+		fmt.Fprintln(os.Stderr, "Tunnel flags such as --subdomain and --response-header are listed by `kai -h`.")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Flags:")
+		fs.PrintDefaults()
+	}
+	status := fs.Int("status", http.StatusOK, "Status code of every response")
+	body := fs.String("body", "", "Body of every response (JSON bodies are sent as application/json)")
+	out := fs.String("out", defaultWebhookFile, "JSONL file the requests are appended to (empty: none)")
+	bodyLimit := fs.String("body-limit", "1MB", "Bytes of each request body to print and record")
+
+	webhookArgs, tunnelArgs, err := splitTunnelArgs(args, []string{"h", "help"}, []string{"status", "body", "out", "body-limit"})
+	if err != nil {
+		return err
+	}
+	if err := fs.Parse(webhookArgs); err != nil {
+		return err
+	}
+	if *status < 100 || *status > 599 {
+		return fmt.Errorf("error: --status must be between 100 and 599")
+	}
+	limit, err := parseSize(*bodyLimit)
+	if err != nil {
+		return fmt.Errorf("error: invalid --body-limit %q: %v", *bodyLimit, err)
+	}
+
+	hook := &webhookHandler{status: *status, body: []byte(*body), bodyLimit: limit, out: os.Stdout}
+	// With --output json, stdout carries the tunnel events.
+	if tunnelFlagValue(tunnelArgs, "output") == "json" {
+		hook.out = os.Stderr
+	}
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("error: --out: %w", err)
+		}
+		defer f.Close()
+		hook.record = f
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("error: webhook listen: %w", err)
+	}
+	srv := &http.Server{Handler: hook, ReadHeaderTimeout: 30 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("webhook server: %v", err)
+		}
+	}()
+	defer srv.Close()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	if *out != "" {
+		log.Printf("Recording requests to %s", *out)
+	}
+	return runTunnel(append([]string{"-local-host", "127.0.0.1", "-p", strconv.Itoa(port)}, tunnelArgs...))
+}
+
+// webhookHandler answers every request with the same response and writes
+// each request to out and, as JSON, to record.
+type webhookHandler struct {
+	status    int
+	body      []byte
+	bodyLimit int64
+	out       io.Writer
+	record    io.Writer
+
+	mu   sync.Mutex
+	next int
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	capture := &bodyCapture{limit: h.bodyLimit}
+	_, _ = io.Copy(capture, r.Body)
+
+	h.mu.Lock()
+	h.next++
+	rec := webhookRecord{
+		ID:         h.next,
+		Time:       time.Now(),
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.RequestURI(),
+		RemoteAddr: r.Header.Get("X-Forwarded-For"),
+		Headers:    r.Header,
+		Body:       capture.body,
+	}
+	printWebhookRecord(h.out, rec)
+	if h.record != nil {
+		if err := json.NewEncoder(h.record).Encode(rec); err != nil {
+			log.Printf("webhook: record request: %v", err)
+		}
+	}
+	h.mu.Unlock()
+
+	if len(h.body) > 0 {
+		contentType := "text/plain; charset=utf-8"
+		if json.Valid(h.body) {
+			contentType = "application/json"
+		}
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(h.status)
+	_, _ = w.Write(h.body)
+}
+
+// printWebhookRecord prints a request with its headers and body. JSON bodies
+// are indented; binary bodies are only summarized.
+func printWebhookRecord(w io.Writer, rec webhookRecord) {
+	from := ""
+	if rec.RemoteAddr != "" {
+		from = " from " + rec.RemoteAddr
+	}
+	fmt.Fprintf(w, "\n#%d %s %s %s%s\n", rec.ID, rec.Time.Format("15:04:05"), rec.Method, rec.Path, from)
+	keys := make([]string, 0, len(rec.Headers))
+	for key := range rec.Headers {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		for _, value := range rec.Headers[key] {
+			fmt.Fprintf(w, "%s: %s\n", key, value)
+		}
+	}
+	if rec.Body.Size == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	data := rec.Body.Data
+	if !utf8.Valid(data) {
+		fmt.Fprintf(w, "[%s of binary data]\n", formatSize(rec.Body.Size))
+		return
+	}
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, data, "", "  ") == nil {
+		data = pretty.Bytes()
+	}
+	_, _ = w.Write(data)
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		fmt.Fprintln(w)
+	}
+	if rec.Body.Truncated {
+		fmt.Fprintf(w, "[truncated, %s in total]\n", formatSize(rec.Body.Size))
+	}
+}
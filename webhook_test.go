@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookHandlerRespondsAndRecords(t *testing.T) {
+	var out, record bytes.Buffer
+	hook := &webhookHandler{status: http.StatusAccepted, body: []byte(`{"ok":true}`), bodyLimit: 1024, out: &out, record: &record}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/github?delivery=1", strings.NewReader(`{"action":"opened","number":7}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "pull_request")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || string(body) != `{"ok":true}` || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response: %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+
+	printed := out.String()
+	for _, want := range []string{"#1 ", "POST /github?delivery=1", "X-Github-Event: pull_request", "{\n  \"action\": \"opened\",\n  \"number\": 7\n}\n"} {
+		if !strings.Contains(printed, want) {
+			t.Fatalf("expected %q in output, got %q", want, printed)
+		}
+	}
+
+	if _, err := http.Post(srv.URL+"/other", "application/octet-stream", bytes.NewReader([]byte{0xff, 0xfe, 0x00})); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "[3B of binary data]") {
+		t.Fatalf("expected a binary summary, got %q", out.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(record.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected two JSONL records, got %q", record.String())
+	}
+	var rec webhookRecord
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.ID != 1 || rec.Method != http.MethodPost || rec.Path != "/github?delivery=1" || string(rec.Body.Data) != `{"action":"opened","number":7}` || rec.Headers.Get("X-Github-Event") != "pull_request" {
+		t.Fatalf("unexpected record: %+v", rec)
+	}
+}
+
+func TestTunnelFlagValue(t *testing.T) {
+	for _, args := range [][]string{{"--output", "json"}, {"--output=json"}, {"--subdomain", "x", "-output", "json"}} {
+		if got := tunnelFlagValue(args, "output"); got != "json" {
+			t.Fatalf("tunnelFlagValue(%q) = %q", args, got)
+		}
+	}
+	if got := tunnelFlagValue([]string{"--subdomain", "output"}, "output"); got != "" {
+		t.Fatalf("expected no value, got %q", got)
+	}
+}